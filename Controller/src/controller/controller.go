@@ -21,6 +21,7 @@
 package controller
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 	"sync"
@@ -35,6 +36,7 @@ var (
 	clock          utils.Timer
 	logger         Logger
 	vms            map[string]*regionalVM
+	vmsLock        sync.RWMutex
 	stoppedVMs     int
 	stoppedVMsLock sync.Mutex
 	stopping       bool
@@ -63,17 +65,23 @@ func (ctrl *Controller) InitServer() {
 	if err != nil {
 		logger.LogFatalf("Controller: unable to add project metadata %v", err)
 	}
+	err = serveStatus()
+	if err != nil {
+		logger.LogErrorf("Controller: unable to serve status: %v", err)
+	}
 }
 
 // Start all VMs in regions in which the required hardware is available, and for which there are probes specified
 func (ctrl *Controller) InitProbes() {
+	currentTemplate = getTemplate(config)
 	getPossibleZones()
 
 	// Assign all probe configurations to their designated regions
 	for _, p := range config.Probes.Probe {
 		vm, ok := vms[p.GetRegion()+"-a"]
 		if !ok {
-			logger.LogErrorf("Controller: zone %s in region %s does not meet minimum requirements or does not exist", p.GetRegion()+"-a", p.GetRegion())
+			logger.Log(LogLevel_ERROR, "Controller: zone does not meet minimum requirements or does not exist",
+				Fields{Zone: p.GetRegion() + "-a", Region: p.GetRegion()})
 			continue
 		}
 		vm.probes = append(vm.probes, p)
@@ -87,7 +95,7 @@ func (ctrl *Controller) InitProbes() {
 		}
 		err := v.startVM()
 		if err != nil {
-			logger.LogErrorf("Controller: regional VM could not be started in zone %s", v.zone)
+			logger.Log(LogLevel_ERROR, fmt.Sprintf("Controller: regional VM could not be started: %v", err), v.fields())
 		}
 	}
 
@@ -106,6 +114,36 @@ func getPossibleZones() {
 	}
 }
 
+func getVM(name string) (*regionalVM, bool) {
+	vmsLock.RLock()
+	defer vmsLock.RUnlock()
+	vm, ok := vms[name]
+	return vm, ok
+}
+
+func putVM(vm *regionalVM) {
+	vmsLock.Lock()
+	defer vmsLock.Unlock()
+	vms[vm.name] = vm
+}
+
+func removeVM(name string) {
+	vmsLock.Lock()
+	defer vmsLock.Unlock()
+	delete(vms, name)
+}
+
+// Copy the current set of VMs so that it can be iterated over while VMs are added or removed
+func listVMs() []*regionalVM {
+	vmsLock.RLock()
+	defer vmsLock.RUnlock()
+	ret := make([]*regionalVM, 0, len(vms))
+	for _, vm := range vms {
+		ret = append(ret, vm)
+	}
+	return ret
+}
+
 func (ctrl *Controller) MonitorProbes() {
 	checkVMs(time.Duration(config.PingConfig.GetTimeout()) * time.Minute)
 }
@@ -113,5 +151,6 @@ func (ctrl *Controller) MonitorProbes() {
 func waitForInterrupt(c chan os.Signal) {
 	signal.Notify(c, os.Interrupt, syscall.SIGINT)
 	<-c
+	logger.Log(LogLevel_INFO, "Controller: stopping", Fields{})
 	stopping = true
 }
@@ -17,8 +17,10 @@
 package controller
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,12 +29,41 @@ import (
 )
 
 type fakeControllerLogger struct {
+	logs    []*fakeLog
+	errLogs []string
+	lock    sync.Mutex
+}
+
+type fakeLog struct {
+	lvl    LogLevel
+	msg    string
+	fields Fields
+}
+
+// Tests that do not inspect logs need a logger, since routine events are logged
+func init() {
+	logger = new(fakeControllerLogger)
+}
+
+func (f *fakeControllerLogger) Log(lvl LogLevel, msg string, fl Fields) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.logs = append(f.logs, &fakeLog{lvl, msg, fl})
+	if lvl == LogLevel_ERROR {
+		f.errLogs = append(f.errLogs, msg)
+	}
 }
 
 func (f *fakeControllerLogger) LogFatal(desc string)                       {}
 func (f *fakeControllerLogger) LogFatalf(desc string, args ...interface{}) {}
-func (f *fakeControllerLogger) LogError(desc string)                       {}
-func (f *fakeControllerLogger) LogErrorf(desc string, args ...interface{}) {}
+
+func (f *fakeControllerLogger) LogError(desc string) {
+	f.Log(LogLevel_ERROR, desc, Fields{})
+}
+
+func (f *fakeControllerLogger) LogErrorf(desc string, args ...interface{}) {
+	f.LogError(fmt.Sprintf(desc, args...))
+}
 
 func TestGetPossibleZones(t *testing.T) {
 	testStrings := []string{"REGION-a\nREGION-b\nREGION2-a\nREGION2-B",
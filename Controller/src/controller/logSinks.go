@@ -0,0 +1,64 @@
+/*
+ * Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package controller
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/logsink"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+// Directory in which entries that could not be written are spooled until their sink recovers
+const logSpoolDir = "log-spool"
+
+// Create a sink from its configuration, with the sinks probes use
+func newLogSink(cfg *LogSink) (logsink.Sink, error) {
+	switch cfg.GetType() {
+	case LogSinkType_GCLOUD:
+		return &logsink.GcloudSink{Maker: currentMaker{}, Dest: cfg.GetDestination()}, nil
+	case LogSinkType_STDOUT:
+		return &logsink.WriterSink{W: os.Stdout}, nil
+	case LogSinkType_FILE:
+		return logsink.NewFileSink(cfg.GetDestination(), cfg.GetMaxSize(), time.Duration(cfg.GetMaxAge())*time.Second,
+			int(cfg.GetMaxFiles()))
+	case LogSinkType_HTTP:
+		return logsink.NewHttpSink(cfg.GetDestination())
+	}
+	return nil, fmt.Errorf("newLogSink: unsupported sink type for the controller: %s", cfg.GetType())
+}
+
+// Create a sink from its configuration that writes in the background, spooling to a file named by the sink's index in
+// the configuration
+func newBatchedSink(cfg *LogSink, i int) (logsink.Sink, error) {
+	s, err := newLogSink(cfg)
+	if err != nil {
+		return nil, err
+	}
+	spool := filepath.Join(logSpoolDir, fmt.Sprintf("controller-%d.spool", i))
+	return logsink.NewBatchedSink(s, nil, spool, logsink.BatchConfig{}), nil
+}
+
+// Runs commands with the controller's command maker, which is only set once the controller is created
+type currentMaker struct{}
+
+func (currentMaker) Command(name string, arg ...string) utils.CommandRunner {
+	return maker.Command(name, arg...)
+}
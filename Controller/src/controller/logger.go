@@ -17,45 +17,121 @@
 package controller
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"sync"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/logsink"
 )
 
-// Wrapper for controller error logging to Cloud Logger
+// Wrapper for controller logging
 type Logger interface {
+	Log(lvl LogLevel, msg string, f Fields)
 	LogFatal(desc string)
 	LogFatalf(desc string, args ...interface{})
 	LogError(desc string)
 	LogErrorf(desc string, args ...interface{})
 }
 
-// Logs controller-based errors
+// Context of a log entry. Empty fields are omitted
+type Fields struct {
+	VM      string `json:"vm,omitempty"`      // Name of the VM to which the entry relates
+	Zone    string `json:"zone,omitempty"`    // Zone in which the VM is located
+	Region  string `json:"region,omitempty"`  // Region in which the VM is located
+	State   string `json:"state,omitempty"`   // State of the VM
+	Probes  int    `json:"probes,omitempty"`  // Number of probes the VM runs
+	Attempt int    `json:"attempt,omitempty"` // Number of times the VM has been restarted since it last registered
+}
+
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Fields
+}
+
+// Logs controller events as JSON to each of its sinks
 type ControllerLogger struct {
-	Destination string // Location in Cloud Logger to which errors are logged
+	Destination string   // Location in Cloud Logger to which logs are written without sinks
+	Level       LogLevel // Minimum level of entries that are written, INFO if unset
+	sinks       []logsink.Sink
+	lock        sync.Mutex
+}
+
+// Create a logger with the sinks and level in the configuration, or that writes to Cloud Logger without sinks. Each
+// sink is written in the background, so that logging does not delay the controller's RPCs
+func NewControllerLogger(cfg *ControllerConfig) (*ControllerLogger, error) {
+	ret := &ControllerLogger{Destination: cfg.GetControllerLogDestination(), Level: cfg.GetLogLevel()}
+	sinks := cfg.GetLogSinks()
+	if len(sinks) == 0 {
+		sinks = []*LogSink{{Type: LogSinkType_GCLOUD, Destination: ret.Destination}}
+	}
+	for i, sc := range sinks {
+		s, err := newBatchedSink(sc, i)
+		if err != nil {
+			ret.Close()
+			return nil, err
+		}
+		ret.sinks = append(ret.sinks, s)
+	}
+	return ret, nil
+}
+
+// Queue an entry with its context to be written to each sink, if its level is at least the minimum level
+func (c *ControllerLogger) Log(lvl LogLevel, msg string, f Fields) {
+	min := c.Level
+	if min == LogLevel_DEFAULT_LEVEL {
+		min = LogLevel_INFO
+	}
+	if lvl < min {
+		return
+	}
+	l, err := json.Marshal(&logEntry{time.Now().UTC().Format(time.RFC3339Nano), lvl.String(), msg, f})
+	if err != nil {
+		log.Printf("Unable to log: unable to marshal JSON: %v", err)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, s := range c.sinks {
+		err = s.Write([][]byte{l})
+		if err != nil {
+			log.Printf("Unable to log: %v", err)
+		}
+	}
 }
 
 // Log error and terminate program
 func (c *ControllerLogger) LogFatal(desc string) {
 	c.LogError(fmt.Sprintf("fatal: %s", desc))
+	c.Close()
 	os.Exit(1)
 }
 
 // Log error with format and terminate program
 func (c *ControllerLogger) LogFatalf(desc string, args ...interface{}) {
-	c.LogError(fmt.Sprintf("fatal: "+desc, args...))
-	os.Exit(1)
+	c.LogFatal(fmt.Sprintf(desc, args...))
 }
 
-// Log error to Cloud Logger
+// Log error without context
 func (c *ControllerLogger) LogError(desc string) {
-	err := maker.Command("gcloud", "logging", "write", config.GetControllerLogDestination(), desc).Run()
-	if err != nil {
-		log.Printf("Unable to log error: unable to send to server: %v", err)
-	}
+	c.Log(LogLevel_ERROR, desc, Fields{})
 }
 
 // Log error with format
 func (c *ControllerLogger) LogErrorf(desc string, args ...interface{}) {
 	c.LogError(fmt.Sprintf(desc, args...))
 }
+
+// Write the entries queued for each sink and close it
+func (c *ControllerLogger) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, s := range c.sinks {
+		s.Close()
+	}
+}
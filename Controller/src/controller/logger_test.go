@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/logsink"
+)
+
+func TestControllerLogger(t *testing.T) {
+	b := new(bytes.Buffer)
+	cl := &ControllerLogger{sinks: []logsink.Sink{&logsink.WriterSink{W: b}}}
+
+	cl.Log(LogLevel_DEBUG, "HEARTBEAT", Fields{VM: "VM"})
+	cl.Log(LogLevel_INFO, "REGISTERED", Fields{VM: "VM", Zone: "us-east1-b", Region: "us-east1", State: "idle",
+		Probes: 2})
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 {
+		t.Logf("TestControllerLogger: entries below the default level written: %q", b)
+		t.FailNow()
+	}
+	var e map[string]interface{}
+	err := json.Unmarshal([]byte(lines[0]), &e)
+	if err != nil || e["level"] != "INFO" || e["message"] != "REGISTERED" || e["vm"] != "VM" ||
+		e["region"] != "us-east1" || e["state"] != "idle" || e["probes"] != 2.0 || e["time"] == nil {
+		t.Logf("TestControllerLogger: incorrect entry written: %s", lines[0])
+		t.Fail()
+	}
+	if _, ok := e["attempt"]; ok {
+		t.Log("TestControllerLogger: empty field not omitted")
+		t.Fail()
+	}
+}
+
+func TestControllerLoggerLevel(t *testing.T) {
+	b := new(bytes.Buffer)
+	cl := &ControllerLogger{Level: LogLevel_WARN, sinks: []logsink.Sink{&logsink.WriterSink{W: b}}}
+
+	cl.Log(LogLevel_INFO, "CREATED", Fields{})
+	cl.LogError("ERROR")
+
+	if !strings.Contains(b.String(), `"level":"ERROR"`) || strings.Contains(b.String(), "CREATED") {
+		t.Logf("TestControllerLoggerLevel: minimum level not applied: %q", b)
+		t.Fail()
+	}
+}
+
+func TestNewControllerLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controllerLogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var posted []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&posted)
+	}))
+	defer srv.Close()
+	path := filepath.Join(dir, "controller.log")
+	cl, err := NewControllerLogger(&ControllerConfig{LogSinks: []*LogSink{
+		{Type: LogSinkType_FILE, Destination: path}, {Type: LogSinkType_HTTP, Destination: srv.URL}}})
+	if err != nil {
+		t.Logf("TestNewControllerLogger: error on valid sinks: %v", err)
+		t.FailNow()
+	}
+
+	cl.Log(LogLevel_INFO, "STOPPED", Fields{VM: "VM"})
+	cl.Close()
+
+	c, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(c), `"message":"STOPPED"`) {
+		t.Logf("TestNewControllerLogger: entry not written to file: %q", c)
+		t.Fail()
+	}
+	if len(posted) != 1 || posted[0]["vm"] != "VM" {
+		t.Logf("TestNewControllerLogger: entry not posted: %v", posted)
+		t.Fail()
+	}
+}
+
+func TestNewControllerLoggerBackground(t *testing.T) {
+	release := make(chan struct{})
+	var posted []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		json.NewDecoder(r.Body).Decode(&posted)
+	}))
+	defer srv.Close()
+	cl, err := NewControllerLogger(&ControllerConfig{LogSinks: []*LogSink{{Type: LogSinkType_HTTP,
+		Destination: srv.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logged := make(chan struct{})
+	go func() {
+		cl.Log(LogLevel_INFO, "CREATED", Fields{VM: "VM"})
+		close(logged)
+	}()
+	select {
+	case <-logged:
+	case <-time.After(time.Second):
+		t.Log("TestNewControllerLoggerBackground: logging waited for a slow sink")
+		t.Fail()
+	}
+	close(release)
+	cl.Close()
+
+	if len(posted) != 1 || posted[0]["message"] != "CREATED" {
+		t.Logf("TestNewControllerLoggerBackground: queued entry not written on close: %v", posted)
+		t.Fail()
+	}
+}
+
+func TestNewControllerLoggerRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "controllerLogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "controller.log")
+	cl, err := NewControllerLogger(&ControllerConfig{LogSinks: []*LogSink{{Type: LogSinkType_FILE,
+		Destination: path, MaxSize: 10, MaxFiles: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl.Log(LogLevel_INFO, "CREATED", Fields{})
+	cl.Log(LogLevel_INFO, "DELETED", Fields{})
+	cl.Close()
+
+	c, _ := ioutil.ReadFile(path)
+	r, _ := ioutil.ReadFile(path + ".1")
+	if !strings.Contains(string(c), "DELETED") || !strings.Contains(string(r), "CREATED") {
+		t.Logf("TestNewControllerLoggerRotate: file not rotated at its maximum size: %q %q", c, r)
+		t.Fail()
+	}
+}
+
+func TestNewControllerLoggerUnsupported(t *testing.T) {
+	_, err := NewControllerLogger(&ControllerConfig{LogSinks: []*LogSink{{Type: LogSinkType_CLOUD_LOGGING}}})
+
+	if err == nil {
+		t.Log("TestNewControllerLoggerUnsupported: no error on sink the controller does not support")
+		t.Fail()
+	}
+}
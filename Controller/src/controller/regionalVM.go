@@ -17,7 +17,10 @@
 package controller
 
 import (
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,41 +34,131 @@ const (
 	stopped
 )
 
+// Number of errors reported by each VM that are kept for its status
+const maxRecentErrors = 10
+
+func (s vmState) String() string {
+	switch s {
+	case inactive:
+		return "inactive"
+	case starting:
+		return "starting"
+	case idle:
+		return "idle"
+	case probing:
+		return "probing"
+	case stopped:
+		return "stopped"
+	}
+	return fmt.Sprintf("vmState(%d)", int(s))
+}
+
 type regionalVM struct {
-	name      string
-	zone      string
-	state     vmState
-	stateLock sync.Mutex
-	probes    []*ProbeConfig
-	lastPing  time.Time
+	name       string
+	zone       string
+	state      vmState
+	stateLock  sync.Mutex
+	probes     []*ProbeConfig
+	lastPing   time.Time // Time of the VM's last heartbeat or registration. Guarded by stateLock
+	generation int
+	template   string // Template from which the VM instance was last created. Guarded by stateLock
+	resolved   int32  // Number of probes the VM has reported as resolved
+	unresolved int32  // Number of messages the VM last reported as awaiting receipts
+	oldest     int32  // Seconds since the oldest message awaiting a receipt was sent, as last reported by the VM
+	restarts   int32  // Number of times the VM has been restarted since it last registered
+	// FCM access token refresh metrics, as last reported by the VM. Guarded by stateLock
+	tokens tokenMetrics
+	// Most recent errors reported by the VM, oldest first
+	errors     []*reportedError
+	errorsLock sync.Mutex
+}
+
+// Counts of the FCM access token refreshes of a VM, and milliseconds taken by the most recent
+type tokenMetrics struct {
+	refreshes           int32
+	failures            int32
+	consecutiveFailures int32
+	fetchMillis         int32
+}
+
+// Error reported by a VM, with the time at which the controller received it and the region in which the VM logged it
+type reportedError struct {
+	time   time.Time
+	desc   string
+	region string
 }
 
 func newRegionalVM(name string, zone string) *regionalVM {
 	return &regionalVM{name: name, zone: zone, lastPing: clock.Now()}
 }
 
+// Create a VM in the same zone with the same probes, under a name that does not collide with this VM
+func (vm *regionalVM) newReplacement() *regionalVM {
+	ret := newRegionalVM(fmt.Sprintf("%s-%d", vm.zone, vm.generation+1), vm.zone)
+	ret.generation = vm.generation + 1
+	ret.probes = vm.probes
+	return ret
+}
+
+// Region in which the VM's zone is located
+func (vm *regionalVM) region() string {
+	if i := strings.LastIndex(vm.zone, "-"); i >= 0 {
+		return vm.zone[:i]
+	}
+	return vm.zone
+}
+
+// Context of the VM for log entries
+func (vm *regionalVM) fields() Fields {
+	return Fields{VM: vm.name, Zone: vm.zone, Region: vm.region(), State: vm.getState().String(), Probes: len(vm.probes),
+		Attempt: int(atomic.LoadInt32(&vm.restarts))}
+}
+
+// Number of emulators the VM runs, as configured for its region or otherwise for all VMs
+func (vm *regionalVM) emulators() int32 {
+	if n, ok := config.GetRegionEmulators()[vm.region()]; ok && n > 0 {
+		return n
+	}
+	if config.GetEmulators() > 0 {
+		return config.GetEmulators()
+	}
+	return 1
+}
+
 func (vm *regionalVM) startVM() error {
+	image, script, tmpl := templateSettings()
 	err := maker.Command("gcloud", "compute", "instances", "create", vm.name, "--zone", vm.zone,
 		"--quiet", "--min-cpu-platform", config.GetMinCpu(),
 		"--service-account", config.GetMetadata().GetAccount().GetServiceAccount(),
-		"--image", config.GetImageName(), "--machine-type", "n1-standard-4", "--scopes", "cloud-platform",
-		"--metadata-from-file=startup-script="+config.GetStartupScriptPath()).Run()
+		"--image", image, "--machine-type", "n1-standard-4", "--scopes", "cloud-platform",
+		"--metadata-from-file=startup-script="+script).Run()
 	if err != nil {
 		return err
 	}
+	vm.stateLock.Lock()
+	vm.template = tmpl
+	vm.stateLock.Unlock()
+	atomic.StoreInt32(&vm.resolved, 0)
+	atomic.StoreInt32(&vm.unresolved, 0)
+	atomic.StoreInt32(&vm.oldest, 0)
 	vm.updatePingTime()
 	vm.setState(starting)
+	logger.Log(LogLevel_INFO, "startVM: created VM", vm.fields())
 	return nil
 }
 
 func (vm *regionalVM) stopVM() {
 	err := maker.Command("gcloud", "compute", "instances", "delete", vm.name, "--zone", vm.zone, "--quiet").Run()
 	if err != nil {
-		logger.LogErrorf("stopVM: unable to stop VM %s in zone %s: %v", vm.name, vm.zone, err)
+		logger.Log(LogLevel_ERROR, fmt.Sprintf("stopVM: unable to stop VM: %v", err), vm.fields())
+		return
 	}
+	logger.Log(LogLevel_INFO, "stopVM: deleted VM", vm.fields())
 }
 
 func (vm *regionalVM) restartVM() {
+	atomic.AddInt32(&vm.restarts, 1)
+	logger.Log(LogLevel_INFO, "restartVM: restarting VM", vm.fields())
 	vm.stopVM()
 	if stopping || vm.state == stopped {
 		// Controller is shutting down, so do not start VM again
@@ -75,19 +168,69 @@ func (vm *regionalVM) restartVM() {
 	vm.setState(starting)
 	err := vm.startVM()
 	if err != nil {
-		logger.LogErrorf("stopVM: unable to restart VM %s in zone %s: %v", vm.name, vm.zone, err)
+		logger.Log(LogLevel_ERROR, fmt.Sprintf("restartVM: unable to restart VM: %v", err), vm.fields())
 		vm.setState(stopped)
 	}
 }
 
+// Remove VM from the set of VMs monitored by the controller and delete its instance
+func (vm *regionalVM) retireVM() {
+	removeVM(vm.name)
+	vm.stateLock.Lock()
+	if vm.state == stopped {
+		// VM is no longer monitored, so it should not count towards the VMs that have stopped
+		stoppedVMsLock.Lock()
+		stoppedVMs--
+		stoppedVMsLock.Unlock()
+	}
+	prev := vm.state
+	vm.state = stopped
+	vm.stateLock.Unlock()
+	vm.logTransition(prev, stopped)
+	logger.Log(LogLevel_INFO, "retireVM: retiring VM", vm.fields())
+	vm.stopVM()
+}
+
+// Record errors reported by the VM, keeping only the most recent
+func (vm *regionalVM) addErrors(errs []*ProbeError) {
+	if len(errs) == 0 {
+		return
+	}
+	now := clock.Now()
+	vm.errorsLock.Lock()
+	defer vm.errorsLock.Unlock()
+	for _, e := range errs {
+		vm.errors = append(vm.errors, &reportedError{now, e.GetDescription(), e.GetRegion()})
+	}
+	if len(vm.errors) > maxRecentErrors {
+		vm.errors = append([]*reportedError(nil), vm.errors[len(vm.errors)-maxRecentErrors:]...)
+	}
+}
+
+func (vm *regionalVM) recentErrors() []*reportedError {
+	vm.errorsLock.Lock()
+	defer vm.errorsLock.Unlock()
+	return append([]*reportedError(nil), vm.errors...)
+}
+
 func (vm *regionalVM) updatePingTime() {
-	vm.lastPing = clock.Now()
+	now := clock.Now()
+	vm.stateLock.Lock()
+	defer vm.stateLock.Unlock()
+	vm.lastPing = now
 }
 
-func (vm *regionalVM) setState(s vmState) {
+func (vm *regionalVM) getLastPing() time.Time {
 	vm.stateLock.Lock()
 	defer vm.stateLock.Unlock()
+	return vm.lastPing
+}
+
+func (vm *regionalVM) setState(s vmState) {
+	vm.stateLock.Lock()
+	prev := vm.state
 	if vm.state == stopped {
+		vm.stateLock.Unlock()
 		return
 	} else if s == stopped {
 		stoppedVMsLock.Lock()
@@ -95,4 +238,41 @@ func (vm *regionalVM) setState(s vmState) {
 		stoppedVMsLock.Unlock()
 	}
 	vm.state = s
+	vm.stateLock.Unlock()
+	vm.logTransition(prev, s)
+}
+
+// Log a change in the VM's state, once the state lock is released
+func (vm *regionalVM) logTransition(prev vmState, s vmState) {
+	if prev == s {
+		return
+	}
+	f := vm.fields()
+	f.State = s.String()
+	logger.Log(LogLevel_INFO, fmt.Sprintf("setState: VM state changed from %s", prev), f)
+}
+
+func (vm *regionalVM) getState() vmState {
+	vm.stateLock.Lock()
+	defer vm.stateLock.Unlock()
+	return vm.state
+}
+
+// Template from which the VM instance was last created
+func (vm *regionalVM) getTemplate() string {
+	vm.stateLock.Lock()
+	defer vm.stateLock.Unlock()
+	return vm.template
+}
+
+func (vm *regionalVM) setTokenMetrics(m tokenMetrics) {
+	vm.stateLock.Lock()
+	defer vm.stateLock.Unlock()
+	vm.tokens = m
+}
+
+func (vm *regionalVM) tokenMetrics() tokenMetrics {
+	vm.stateLock.Lock()
+	defer vm.stateLock.Unlock()
+	return vm.tokens
 }
@@ -82,3 +82,65 @@ func TestSetState(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSetStateLogged(t *testing.T) {
+	fl := new(fakeControllerLogger)
+	logger = fl
+	vm := &regionalVM{name: "us-east1-b", zone: "us-east1-b", state: starting, probes: make([]*ProbeConfig, 2)}
+
+	vm.setState(idle)
+	vm.setState(idle)
+
+	if len(fl.logs) != 1 {
+		t.Logf("TestSetStateLogged: incorrect number of transitions logged: actual: %d, expected: 1", len(fl.logs))
+		t.FailNow()
+	}
+	l := fl.logs[0]
+	if l.lvl != LogLevel_INFO || l.msg != "setState: VM state changed from starting" ||
+		l.fields != (Fields{VM: "us-east1-b", Zone: "us-east1-b", Region: "us-east1", State: "idle", Probes: 2}) {
+		t.Logf("TestSetStateLogged: incorrect transition logged: %+v", l)
+		t.Fail()
+	}
+}
+
+func TestRestartVMAttempt(t *testing.T) {
+	maker = utils.NewFakeCommandMaker(make([]string, 4), make([]bool, 4), false)
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	stopping = false
+	fl := new(fakeControllerLogger)
+	logger = fl
+	vm := newRegionalVM("us-east1-b", "us-east1-b")
+
+	vm.restartVM()
+	vm.restartVM()
+
+	var attempts []int
+	for _, l := range fl.logs {
+		if l.msg == "restartVM: restarting VM" {
+			attempts = append(attempts, l.fields.Attempt)
+		}
+	}
+	if len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Logf("TestRestartVMAttempt: restarts not logged with their attempt: %v", attempts)
+		t.Fail()
+	}
+}
+
+func TestEmulators(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	config = &ControllerConfig{Emulators: 2, RegionEmulators: map[string]int32{"us-east1": 4}}
+
+	if n := newRegionalVM("", "us-east1-b").emulators(); n != 4 {
+		t.Logf("TestEmulators: region override not applied: actual: %d, expected: 4", n)
+		t.Fail()
+	}
+	if n := newRegionalVM("", "us-west1-a").emulators(); n != 2 {
+		t.Logf("TestEmulators: default not applied: actual: %d, expected: 2", n)
+		t.Fail()
+	}
+	config = &ControllerConfig{}
+	if n := newRegionalVM("", "us-west1-a").emulators(); n != 1 {
+		t.Logf("TestEmulators: incorrect count when unconfigured: actual: %d, expected: 1", n)
+		t.Fail()
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package controller
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	defaultRolloutTimeout      = 30 // Minutes
+	defaultRolloutPollInterval = 10 // Seconds
+)
+
+var (
+	currentTemplate string
+	rolloutLock     sync.Mutex
+	// Guards the template and rollout settings, which are replaced on reload while VMs are being started
+	templateLock sync.Mutex
+)
+
+// Reload the VM template from the configuration file on SIGHUP, and replace all VMs on SIGUSR1
+func (ctrl *Controller) WatchTemplate(path string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGUSR1)
+	go waitForRollout(c, path)
+}
+
+func waitForRollout(c chan os.Signal, path string) {
+	for s := range c {
+		if stopping {
+			return
+		}
+		force := s == syscall.SIGUSR1
+		if !force {
+			err := reloadTemplate(path)
+			if err != nil {
+				logger.LogErrorf("waitForRollout: unable to reload configuration: %v", err)
+				continue
+			}
+		}
+		go func() {
+			err := rollOut(force)
+			if err != nil {
+				logger.LogErrorf("waitForRollout: rollout stopped: %v", err)
+			}
+		}()
+	}
+}
+
+// Update the VM template and rollout settings from the configuration file. Other settings require a restart to change
+func reloadTemplate(path string) error {
+	c, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg := new(ControllerConfig)
+	err = proto.UnmarshalText(string(c), cfg)
+	if err != nil {
+		return err
+	}
+	tmpl := getTemplate(cfg)
+	templateLock.Lock()
+	defer templateLock.Unlock()
+	config.ImageName = cfg.GetImageName()
+	config.StartupScriptPath = cfg.GetStartupScriptPath()
+	config.Rollout = cfg.GetRollout()
+	currentTemplate = tmpl
+	return nil
+}
+
+// Image and startup script from which VMs are created, and the template they identify
+func templateSettings() (string, string, string) {
+	templateLock.Lock()
+	defer templateLock.Unlock()
+	return config.GetImageName(), config.GetStartupScriptPath(), currentTemplate
+}
+
+func rolloutSettings() *RolloutConfig {
+	templateLock.Lock()
+	defer templateLock.Unlock()
+	return config.GetRollout()
+}
+
+// Identify the template from which VMs are created by the image name and the contents of the startup script
+func getTemplate(cfg *ControllerConfig) string {
+	s, err := ioutil.ReadFile(cfg.GetStartupScriptPath())
+	if err != nil {
+		// Changes to the startup script can then only be detected by a change in its path
+		logger.LogErrorf("getTemplate: unable to read startup script: %v", err)
+	}
+	return fmt.Sprintf("%s:%s:%x", cfg.GetImageName(), cfg.GetStartupScriptPath(), sha256.Sum256(s))
+}
+
+// Replace VMs created from an outdated template, or all VMs if forced, a batch at a time.
+// Each replacement must register and resolve a probe before the VM it replaces is deleted
+func rollOut(force bool) error {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+
+	_, _, tmpl := templateSettings()
+	var outdated []*regionalVM
+	for _, vm := range listVMs() {
+		st := vm.getState()
+		if st != inactive && st != stopped && (force || vm.getTemplate() != tmpl) {
+			outdated = append(outdated, vm)
+		}
+	}
+
+	bs := int(rolloutSettings().GetBatchSize())
+	if bs <= 0 {
+		bs = 1
+	}
+	for i := 0; i < len(outdated); i += bs {
+		end := i + bs
+		if end > len(outdated) {
+			end = len(outdated)
+		}
+		err := replaceVMs(outdated[i:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start replacements for a batch of VMs. If any replacement fails, the batch is left as it was
+func replaceVMs(olds []*regionalVM) error {
+	var repls []*regionalVM
+	var err error
+	for _, old := range olds {
+		if stopping {
+			err = errors.New("replaceVMs: controller is stopping")
+			break
+		}
+		r := old.newReplacement()
+		logger.Log(LogLevel_INFO, "replaceVMs: replacing VM "+old.name, r.fields())
+		putVM(r)
+		repls = append(repls, r)
+		err = r.startVM()
+		if err != nil {
+			err = fmt.Errorf("replaceVMs: unable to start VM %s in zone %s: %v", r.name, r.zone, err)
+			break
+		}
+	}
+	for i := 0; err == nil && i < len(repls); i++ {
+		err = waitForReplacement(repls[i])
+	}
+
+	if err != nil {
+		for _, r := range repls {
+			r.retireVM()
+		}
+		return err
+	}
+	for _, old := range olds {
+		old.retireVM()
+	}
+	return nil
+}
+
+// Wait until a VM has registered and resolved at least one probe
+func waitForReplacement(vm *regionalVM) error {
+	rc := rolloutSettings()
+	timeout := time.Duration(rc.GetTimeout()) * time.Minute
+	if timeout <= 0 {
+		timeout = defaultRolloutTimeout * time.Minute
+	}
+	interval := time.Duration(rc.GetPollInterval()) * time.Second
+	if interval <= 0 {
+		interval = defaultRolloutPollInterval * time.Second
+	}
+	deadline := clock.Now().Add(timeout)
+
+	for {
+		st := vm.getState()
+		if st == probing && atomic.LoadInt32(&vm.resolved) > 0 {
+			return nil
+		}
+		if stopping || st == stopped {
+			return fmt.Errorf("waitForReplacement: VM %s in zone %s stopped before resolving a probe", vm.name, vm.zone)
+		}
+		if clock.Now().After(deadline) {
+			return fmt.Errorf("waitForReplacement: VM %s in zone %s did not resolve a probe within %v", vm.name, vm.zone, timeout)
+		}
+		clock.Sleep(interval)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+func TestGetTemplate(t *testing.T) {
+	logger = new(fakeControllerLogger)
+	t1 := getTemplate(&ControllerConfig{ImageName: "IMAGE", StartupScriptPath: "testConfig.txt"})
+	t2 := getTemplate(&ControllerConfig{ImageName: "IMAGE2", StartupScriptPath: "testConfig.txt"})
+	t3 := getTemplate(&ControllerConfig{ImageName: "IMAGE", StartupScriptPath: "testConfig.txt"})
+
+	if t1 == t2 {
+		t.Log("TestGetTemplate: template not changed when image changed")
+		t.Fail()
+	}
+	if t1 != t3 {
+		t.Log("TestGetTemplate: template changed when image and startup script did not change")
+		t.Fail()
+	}
+}
+
+func TestNewReplacement(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	vm := newRegionalVM("REGION-a", "REGION-a")
+	vm.probes = []*ProbeConfig{{Region: "REGION"}}
+
+	r := vm.newReplacement()
+	rr := r.newReplacement()
+
+	if r.name != "REGION-a-1" || rr.name != "REGION-a-2" {
+		t.Logf("TestNewReplacement: incorrect replacement names: %s, %s", r.name, rr.name)
+		t.Fail()
+	}
+	if r.zone != vm.zone || len(r.probes) != len(vm.probes) {
+		t.Log("TestNewReplacement: replacement does not match replaced VM")
+		t.Fail()
+	}
+}
+
+func TestRollOutStartFailure(t *testing.T) {
+	maker = utils.NewFakeCommandMaker([]string{"START_ERROR", ""}, []bool{true, false}, false)
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	logger = new(fakeControllerLogger)
+	config = &ControllerConfig{}
+	stopping = false
+	prevStopped := stoppedVMs
+	currentTemplate = "NEW"
+	old := newRegionalVM("REGION-a", "REGION-a")
+	old.state = probing
+	old.template = "OLD"
+	vms = map[string]*regionalVM{"REGION-a": old}
+
+	err := rollOut(false)
+
+	if err == nil {
+		t.Log("TestRollOutStartFailure: no error returned when replacement could not be started")
+		t.Fail()
+	}
+	if len(vms) != 1 || vms["REGION-a"] != old || old.state != probing {
+		t.Log("TestRollOutStartFailure: replaced VM modified after failed rollout")
+		t.Fail()
+	}
+	if stoppedVMs != prevStopped {
+		t.Logf("TestRollOutStartFailure: incorrect number of stopped VMs: actual: %d, expected: %d", stoppedVMs, prevStopped)
+		t.Fail()
+	}
+}
+
+func TestRollOutUpToDate(t *testing.T) {
+	maker = utils.NewFakeCommandMaker([]string{}, []bool{}, false)
+	config = &ControllerConfig{}
+	currentTemplate = "NEW"
+	vm := &regionalVM{name: "REGION-a", state: probing, template: "NEW"}
+	vms = map[string]*regionalVM{"REGION-a": vm}
+
+	err := rollOut(false)
+
+	if err != nil {
+		t.Logf("TestRollOutUpToDate: error returned when no VMs needed replacing: %v", err)
+		t.Fail()
+	}
+	if maker.(*utils.FakeCommandMaker).TimesCalled() != 0 {
+		t.Log("TestRollOutUpToDate: VM replaced when template was unchanged")
+		t.Fail()
+	}
+}
+
+func TestWaitForReplacement(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	config = &ControllerConfig{}
+	stopping = false
+	vm := &regionalVM{state: probing, resolved: 1}
+
+	err := waitForReplacement(vm)
+
+	if err != nil {
+		t.Logf("TestWaitForReplacement: error returned for VM that resolved a probe: %v", err)
+		t.Fail()
+	}
+}
+
+func TestWaitForReplacementTimeout(t *testing.T) {
+	fc := utils.NewFakeClock([]time.Time{time.Unix(0, 0), time.Unix(30, 0), time.Unix(61, 0)}, false)
+	clock = fc
+	config = &ControllerConfig{Rollout: &RolloutConfig{Timeout: 1, PollInterval: 30}}
+	stopping = false
+	vm := &regionalVM{state: probing}
+
+	err := waitForReplacement(vm)
+
+	if err == nil {
+		t.Log("TestWaitForReplacementTimeout: no error returned for VM that did not resolve a probe")
+		t.Fail()
+	}
+	if fc.Slept() != 30*time.Second {
+		t.Logf("TestWaitForReplacementTimeout: slept %v between polls, expected 30s", fc.Slept())
+		t.Fail()
+	}
+}
+
+func TestRetireVM(t *testing.T) {
+	maker = utils.NewFakeCommandMaker([]string{""}, []bool{false}, true)
+	logger = new(fakeControllerLogger)
+	stoppedVMs++
+	prevStopped := stoppedVMs
+	activeVM := &regionalVM{name: "ACTIVE", state: probing}
+	stoppedVM := &regionalVM{name: "STOPPED", state: stopped}
+	vms = map[string]*regionalVM{"ACTIVE": activeVM, "STOPPED": stoppedVM}
+
+	activeVM.retireVM()
+	stoppedVM.retireVM()
+
+	if len(vms) != 0 {
+		t.Log("TestRetireVM: retired VMs still monitored")
+		t.Fail()
+	}
+	if stoppedVMs != prevStopped-1 {
+		t.Logf("TestRetireVM: incorrect number of stopped VMs: actual: %d, expected: %d", stoppedVMs, prevStopped-1)
+		t.Fail()
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	"io/ioutil"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
@@ -90,37 +91,76 @@ type CommunicatorServer struct {
 
 // Provides regional VMs with information about which probes to run
 func (cs *CommunicatorServer) Register(ctx context.Context, in *RegisterRequest) (*RegisterResponse, error) {
-	vm, ok := vms[in.GetSource()]
+	vm, ok := getVM(in.GetSource())
 	if !ok {
-		logger.LogErrorf("Register: given source %s does not correspond to existing VM", in.GetSource())
+		logger.Log(LogLevel_ERROR, "Register: given source does not correspond to existing VM",
+			Fields{VM: in.GetSource()})
 		return &RegisterResponse{}, errors.New("invalid source")
 	}
+	atomic.StoreInt32(&vm.restarts, 0)
+	logger.Log(LogLevel_INFO, "Register: VM registered", vm.fields())
 	vm.setState(idle)
 	vm.updatePingTime()
 	return &RegisterResponse{
 		Probes:     &ProbeConfigs{Probe: vm.probes},
 		Account:    config.GetMetadata().GetAccount(),
-		PingConfig: config.GetPingConfig()}, nil
+		PingConfig: config.GetPingConfig(),
+		Zone:       vm.zone,
+		Emulators:  vm.emulators()}, nil
 }
 
 // Processes incoming information from probes
 func (cs *CommunicatorServer) Ping(ctx context.Context, in *Heartbeat) (*Heartbeat, error) {
+	vm, ok := getVM(in.GetSource())
+	if !ok {
+		// VM may have been retired during a rollout, in which case its instance is already being deleted
+		logger.Log(LogLevel_WARN, "Ping: given source does not correspond to existing VM", Fields{VM: in.GetSource()})
+		return &Heartbeat{}, errors.New("invalid source")
+	}
+	logger.Log(LogLevel_DEBUG, fmt.Sprintf("Ping: heartbeat with %d resolved, %d unresolved, stop %t",
+		in.GetResolved(), in.GetUnresolved(), in.GetStop()), vm.fields())
 	if in.GetStop() {
-		vms[in.GetSource()].restartVM()
+		vm.restartVM()
 	} else {
-		vms[in.GetSource()].setState(probing)
+		vm.setState(probing)
+		atomic.StoreInt32(&vm.resolved, in.GetResolved())
+		atomic.StoreInt32(&vm.unresolved, in.GetUnresolved())
+		atomic.StoreInt32(&vm.oldest, in.GetOldestUnresolved())
+		vm.setTokenMetrics(tokenMetrics{in.GetTokenRefreshes(), in.GetTokenRefreshFailures(),
+			in.GetTokenConsecutiveFailures(), in.GetTokenFetchMillis()})
 	}
-	vms[in.GetSource()].updatePingTime()
+	vm.updatePingTime()
 	src := "Controller"
 	in.Source = src
 	in.Stop = stopping
 	return in, nil
 }
 
+// Records errors that regional VMs forward, or were unable to write to their own logs
+func (cs *CommunicatorServer) ReportErrors(ctx context.Context, in *ErrorReport) (*ErrorReportResponse, error) {
+	vm, ok := getVM(in.GetSource())
+	if !ok {
+		logger.Log(LogLevel_ERROR, "ReportErrors: given source does not correspond to existing VM",
+			Fields{VM: in.GetSource()})
+		return &ErrorReportResponse{}, errors.New("invalid source")
+	}
+	logger.Log(LogLevel_INFO, fmt.Sprintf("ReportErrors: %d errors reported", len(in.GetErrors())), vm.fields())
+	for _, e := range in.GetErrors() {
+		msg := "ReportErrors: " + e.GetDescription()
+		if e.GetRegion() != "" {
+			msg = fmt.Sprintf("ReportErrors: %s (logged in region %s)", e.GetDescription(), e.GetRegion())
+		}
+		logger.Log(LogLevel_ERROR, msg, vm.fields())
+	}
+	vm.addErrors(in.GetErrors())
+	return &ErrorReportResponse{}, nil
+}
+
 func checkVMs(max time.Duration) {
-	for stoppedVMs < len(vms) {
-		for _, vm := range vms {
+	for stoppedVMs < len(listVMs()) {
+		for _, vm := range listVMs() {
 			if isTimedOut(vm, max) {
+				logger.Log(LogLevel_WARN, "checkVMs: no heartbeat from VM within timeout", vm.fields())
 				vm.restartVM()
 			}
 		}
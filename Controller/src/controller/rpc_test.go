@@ -17,6 +17,7 @@
 package controller
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -111,6 +112,49 @@ func TestPingExpected(t *testing.T) {
 	}
 }
 
+func TestPingNotFound(t *testing.T) {
+	server := &CommunicatorServer{}
+	req := &Heartbeat{Source: "DOES_NOT_EXIST"}
+	logger = new(fakeControllerLogger)
+	vms = map[string]*regionalVM{}
+
+	_, err := server.Ping(nil, req)
+
+	if err == nil {
+		t.Log("TestPingNotFound: No error returned given invalid source input")
+		t.Fail()
+	}
+}
+
+func TestPingResolved(t *testing.T) {
+	server := &CommunicatorServer{}
+	req := &Heartbeat{Source: "REGION", Resolved: 3, Unresolved: 4, OldestUnresolved: 30, TokenRefreshes: 5,
+		TokenRefreshFailures: 2, TokenConsecutiveFailures: 1, TokenFetchMillis: 120}
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	testVM := newRegionalVM("", "")
+	vms = map[string]*regionalVM{"REGION": testVM}
+
+	_, err := server.Ping(nil, req)
+	if err != nil {
+		t.Log("TestPingResolved: Error returned on valid input")
+		t.FailNow()
+	}
+
+	if testVM.resolved != 3 {
+		t.Logf("TestPingResolved: incorrect resolved count: actual: %d, expected: 3", testVM.resolved)
+		t.Fail()
+	}
+	if testVM.unresolved != 4 || testVM.oldest != 30 {
+		t.Logf("TestPingResolved: incorrect unresolved messages: actual: %d, %ds expected: 4, 30s", testVM.unresolved,
+			testVM.oldest)
+		t.Fail()
+	}
+	if testVM.tokens != (tokenMetrics{5, 2, 1, 120}) {
+		t.Logf("TestPingResolved: incorrect token metrics: actual: %+v, expected: {5 2 1 120}", testVM.tokens)
+		t.Fail()
+	}
+}
+
 func TestPingClientStop(t *testing.T) {
 	server := &CommunicatorServer{}
 	req := &Heartbeat{Source: "REGION", Stop: true}
@@ -168,3 +212,52 @@ func TestIsTimedOut(t *testing.T) {
 		}
 	}
 }
+
+func TestReportErrors(t *testing.T) {
+	server := &CommunicatorServer{}
+	fl := new(fakeControllerLogger)
+	logger = fl
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	testVM := newRegionalVM("us-east1-b-1", "us-east1-b")
+	vms = map[string]*regionalVM{"us-east1-b-1": testVM}
+	var errs []*ProbeError
+	for i := 0; i < maxRecentErrors+1; i++ {
+		errs = append(errs, &ProbeError{Description: fmt.Sprintf("ERROR %d", i), Region: "us-east1-b"})
+	}
+
+	_, err := server.ReportErrors(nil, &ErrorReport{Source: "us-east1-b-1", Errors: errs})
+	if err != nil {
+		t.Log("TestReportErrors: Error returned on valid input")
+		t.FailNow()
+	}
+
+	var logged []*fakeLog
+	for _, l := range fl.logs {
+		if l.lvl == LogLevel_ERROR {
+			logged = append(logged, l)
+		}
+	}
+	if len(logged) != len(errs) || logged[0].msg != "ReportErrors: ERROR 0 (logged in region us-east1-b)" || logged[0].fields.VM != "us-east1-b-1" ||
+		logged[0].fields.Zone != "us-east1-b" || logged[0].fields.Region != "us-east1" {
+		t.Logf("TestReportErrors: reported errors not logged with their VM: %v", fl.errLogs)
+		t.Fail()
+	}
+	re := testVM.recentErrors()
+	if len(re) != maxRecentErrors || re[0].desc != "ERROR 1" || re[0].region != "us-east1-b" || re[maxRecentErrors-1].desc != "ERROR 10" {
+		t.Logf("TestReportErrors: incorrect recent errors kept: %d", len(re))
+		t.Fail()
+	}
+}
+
+func TestReportErrorsNotFound(t *testing.T) {
+	server := &CommunicatorServer{}
+	logger = new(fakeControllerLogger)
+	vms = map[string]*regionalVM{}
+
+	_, err := server.ReportErrors(nil, &ErrorReport{Source: "DOES_NOT_EXIST"})
+
+	if err == nil {
+		t.Log("TestReportErrorsNotFound: No error returned given invalid source input")
+		t.Fail()
+	}
+}
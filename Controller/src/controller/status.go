@@ -0,0 +1,67 @@
+/*
+ * Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package controller
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Serve the status of each VM over HTTP at /status, if a status port is configured
+func serveStatus() error {
+	if config.GetStatusPort() <= 0 {
+		return nil
+	}
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", config.GetStatusPort()))
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeStatus(w)
+	})
+	go http.Serve(lis, mux)
+	return nil
+}
+
+// Write the state, last ping, message counts, token refresh metrics and recent errors of each VM, in order of name.
+// Errors are shown with the region in which the VM logged them, if it reported one
+func writeStatus(w io.Writer) {
+	vl := listVMs()
+	sort.Slice(vl, func(i, j int) bool { return vl[i].name < vl[j].name })
+	for _, vm := range vl {
+		tm := vm.tokenMetrics()
+		fmt.Fprintf(w, "%s (zone %s): %s, last ping %s, %d resolved, %d unresolved, oldest unresolved %ds, "+
+			"%d token refreshes, %d failed (%d consecutive), last fetch %dms\n",
+			vm.name, vm.zone, vm.getState(), vm.getLastPing().Format(time.RFC3339), atomic.LoadInt32(&vm.resolved),
+			atomic.LoadInt32(&vm.unresolved), atomic.LoadInt32(&vm.oldest), tm.refreshes, tm.failures,
+			tm.consecutiveFailures, tm.fetchMillis)
+		for _, e := range vm.recentErrors() {
+			if e.region != "" {
+				fmt.Fprintf(w, "\t%s (region %s): %s\n", e.time.Format(time.RFC3339), e.region, e.desc)
+			} else {
+				fmt.Fprintf(w, "\t%s: %s\n", e.time.Format(time.RFC3339), e.desc)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package controller
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+func TestWriteStatus(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0).UTC()}, true)
+	first := newRegionalVM("us-east1-b", "us-east1-b")
+	first.state = probing
+	first.resolved, first.unresolved, first.oldest = 3, 4, 30
+	first.tokens = tokenMetrics{5, 2, 1, 120}
+	first.addErrors([]*ProbeError{{Description: "ERROR", Region: "us-east1-b"}, {Description: "UNLABELLED"}})
+	second := newRegionalVM("us-west1-a", "us-west1-a")
+	second.state = stopped
+	vms = map[string]*regionalVM{second.name: second, first.name: first}
+	b := new(bytes.Buffer)
+
+	writeStatus(b)
+
+	expected := "us-east1-b (zone us-east1-b): probing, last ping 1970-01-01T00:00:00Z, 3 resolved, 4 unresolved, " +
+		"oldest unresolved 30s, 5 token refreshes, 2 failed (1 consecutive), last fetch 120ms\n" +
+		"\t1970-01-01T00:00:00Z (region us-east1-b): ERROR\n" +
+		"\t1970-01-01T00:00:00Z: UNLABELLED\n" +
+		"us-west1-a (zone us-west1-a): stopped, last ping 1970-01-01T00:00:00Z, 0 resolved, 0 unresolved, " +
+		"oldest unresolved 0s, 0 token refreshes, 0 failed (0 consecutive), last fetch 0ms\n"
+	if b.String() != expected {
+		t.Logf("TestWriteStatus: incorrect status:\n%s", b)
+		t.Fail()
+	}
+}
+
+func TestWriteStatusConcurrentPings(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0).UTC()}, true)
+	logger = new(fakeControllerLogger)
+	vm := newRegionalVM("us-east1-b", "us-east1-b")
+	vms = map[string]*regionalVM{vm.name: vm}
+	server := &CommunicatorServer{}
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+
+	// Run with -race to check that the status does not race with the fields pings update
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			server.Ping(nil, &Heartbeat{Source: vm.name, Resolved: int32(i), TokenRefreshes: int32(i)})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		writeStatus(ioutil.Discard)
+	}
+	wg.Wait()
+
+	b := new(bytes.Buffer)
+	writeStatus(b)
+	if !bytes.Contains(b.Bytes(), []byte("99 resolved")) {
+		t.Logf("TestWriteStatusConcurrentPings: last ping not shown: %s", b)
+		t.Fail()
+	}
+}
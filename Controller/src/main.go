@@ -38,9 +38,14 @@ func main() {
 	if err != nil {
 		log.Fatalf("Main: invalid configuration: %s", err.Error())
 	}
-	ctrl := controller.NewController(cfg, new(utils.CmdMaker), new(utils.ProbeClock),
-		&controller.ControllerLogger{cfg.GetControllerLogDestination()})
+	lg, err := controller.NewControllerLogger(cfg)
+	if err != nil {
+		log.Fatalf("Main: unable to create log sinks: %s", err.Error())
+	}
+	defer lg.Close()
+	ctrl := controller.NewController(cfg, new(utils.CmdMaker), new(utils.ProbeClock), lg)
 	ctrl.InitServer()
 	ctrl.InitProbes()
+	ctrl.WatchTemplate(*cf)
 	ctrl.MonitorProbes()
 }
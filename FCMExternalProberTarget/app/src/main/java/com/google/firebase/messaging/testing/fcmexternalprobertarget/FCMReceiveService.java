@@ -31,21 +31,32 @@ import java.time.Clock;
 import java.io.File;
 import java.io.FileWriter;
 import java.io.IOException;
+import java.io.OutputStream;
+import java.net.HttpURLConnection;
+import java.net.URL;
+import java.nio.charset.StandardCharsets;
 
 /**
  * Service that handles interaction with Firebase Cloud Messaging, and logs the results of the
- * messages both to the UI and files.
+ * messages both to the UI and files. Receipts of messages are posted to the probe as soon as they
+ * arrive, and are only written to files if the probe cannot be reached.
  */
 public class FCMReceiveService extends FirebaseMessagingService {
 
+    // Address to which receipts are posted, forwarded to the probe on the VM by "adb reverse"
+    private static final String RECEIPT_URL = "http://127.0.0.1:8765/receipts";
+    private static final int RECEIPT_TIMEOUT_MS = 1000;
+
     private Context context;
     private boolean viewLogging;
     private Clock logTimer;
+    private String receiptUrl;
 
     public FCMReceiveService () {
         this.context = this;
         viewLogging = false;
         logTimer = Clock.systemUTC();
+        receiptUrl = RECEIPT_URL;
     }
 
     /**
@@ -55,9 +66,21 @@ public class FCMReceiveService extends FirebaseMessagingService {
      */
     @VisibleForTesting
     public FCMReceiveService (Context context, boolean viewLogging, Clock logTimer) {
+        this(context, viewLogging, logTimer, RECEIPT_URL);
+    }
+
+    /**
+     * Create an instance for testing that posts receipts to the given address
+     * @param context Mocked Context object
+     * @param viewLogging Whether logs should be written to UI
+     * @param receiptUrl Address to which receipts are posted
+     */
+    @VisibleForTesting
+    public FCMReceiveService (Context context, boolean viewLogging, Clock logTimer, String receiptUrl) {
         this.context = context;
         this.viewLogging = viewLogging;
         this.logTimer = logTimer;
+        this.receiptUrl = receiptUrl;
     }
 
     @Override
@@ -77,6 +100,13 @@ public class FCMReceiveService extends FirebaseMessagingService {
         long receivedTime = logTimer.instant().toEpochMilli();
         String sendTime = remoteMessage.getData().get("sendTime");
         String type = remoteMessage.getData().get("type");
+        try {
+            postReceipt(type, sendTime, remoteMessage.getMessageId(), receivedTime);
+            logToUI("Info", "Message received and posted to the probe: " + type + sendTime);
+            return;
+        } catch (IOException exception) {
+            logToUI("Info", "Unable to post receipt, storing it instead: " + exception.toString());
+        }
         try {
             File logFile = makeExternalFile("logs", type + sendTime + ".txt");
             writeToFile(logFile, Long.toString(receivedTime));
@@ -87,6 +117,40 @@ public class FCMReceiveService extends FirebaseMessagingService {
     }
 
 
+    /**
+     * Post the receipt of a message to the probe. Messages are received on a background thread, so
+     * the receipt is posted synchronously
+     */
+    private void postReceipt(String type, String sendTime, String id, long receivedTime)
+            throws IOException {
+        String body = "{\"type\":" + quote(type) + ",\"sendTime\":" + quote(sendTime)
+                + ",\"id\":" + quote(id) + ",\"receivedTime\":" + receivedTime + "}";
+        HttpURLConnection connection = (HttpURLConnection) new URL(receiptUrl).openConnection();
+        try {
+            connection.setConnectTimeout(RECEIPT_TIMEOUT_MS);
+            connection.setReadTimeout(RECEIPT_TIMEOUT_MS);
+            connection.setRequestMethod("POST");
+            connection.setRequestProperty("Content-Type", "application/json");
+            connection.setDoOutput(true);
+            OutputStream output = connection.getOutputStream();
+            output.write(body.getBytes(StandardCharsets.UTF_8));
+            output.close();
+            int status = connection.getResponseCode();
+            if (status != HttpURLConnection.HTTP_OK) {
+                throw new IOException("Receipt rejected with status " + status);
+            }
+        } finally {
+            connection.disconnect();
+        }
+    }
+
+    private static String quote(String value) {
+        if (value == null) {
+            return "\"\"";
+        }
+        return "\"" + value.replace("\\", "\\\\").replace("\"", "\\\"") + "\"";
+    }
+
     private void logToUI(String tag, String logText) {
         Log.d(tag, logText);
         if (viewLogging) {
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package com.google.firebase.messaging.testing.fcmexternalprobertarget;
+
+import android.content.BroadcastReceiver;
+import android.content.Context;
+import android.content.Intent;
+import android.util.Log;
+
+import androidx.annotation.NonNull;
+import androidx.annotation.VisibleForTesting;
+
+import com.google.android.gms.tasks.OnCompleteListener;
+import com.google.android.gms.tasks.Task;
+import com.google.firebase.messaging.FirebaseMessaging;
+
+import java.io.File;
+import java.io.FileWriter;
+import java.io.IOException;
+import java.time.Clock;
+
+/**
+ * Subscribes the app to a topic on request of the probe, which sends a broadcast with the topic as the "topic" extra.
+ * Once the subscription completes, its completion time is stored in topics/TOPIC.txt so that the probe can measure
+ * subscription latency, or "error" if it failed
+ */
+public class SubscribeReceiver extends BroadcastReceiver {
+
+    private Clock logTimer;
+
+    public SubscribeReceiver() {
+        logTimer = Clock.systemUTC();
+    }
+
+    /**
+     * Create an instance for testing
+     * @param logTimer Clock from which completion times are taken
+     */
+    @VisibleForTesting
+    public SubscribeReceiver(Clock logTimer) {
+        this.logTimer = logTimer;
+    }
+
+    @Override
+    public void onReceive(final Context context, Intent intent) {
+        final String topic = intent.getStringExtra("topic");
+        if (topic == null) {
+            Log.d("Error", "Subscription requested without a topic");
+            return;
+        }
+        // Keep the receiver alive until the subscription completes
+        final PendingResult pending = goAsync();
+        FirebaseMessaging.getInstance().subscribeToTopic(topic).addOnCompleteListener(new OnCompleteListener<Void>() {
+            @Override
+            public void onComplete(@NonNull Task<Void> task) {
+                recordResult(context, topic, task.isSuccessful());
+                pending.finish();
+            }
+        });
+    }
+
+    @VisibleForTesting
+    void recordResult(Context context, @NonNull String topic, boolean success) {
+        String result = success ? Long.toString(logTimer.instant().toEpochMilli()) : "error";
+        try {
+            File path = new File(context.getExternalFilesDir(null), "topics");
+            if (!path.exists() && !path.mkdirs()) {
+                throw new IOException("Could not create directory: topics");
+            }
+            FileWriter outputWriter = new FileWriter(new File(path, topic + ".txt"));
+            outputWriter.write(result, 0, result.length());
+            outputWriter.close();
+        } catch (IOException exception) {
+            Log.d("Error", exception.toString());
+        }
+        Log.d("Info", "Subscription to " + topic + " completed: " + result);
+    }
+}
@@ -23,6 +23,9 @@ import android.text.TextUtils;
 import android.util.Log;
 
 import com.google.firebase.messaging.RemoteMessage;
+import com.sun.net.httpserver.HttpExchange;
+import com.sun.net.httpserver.HttpHandler;
+import com.sun.net.httpserver.HttpServer;
 
 import org.junit.Before;
 import org.junit.Rule;
@@ -35,6 +38,10 @@ import org.powermock.core.classloader.annotations.PrepareForTest;
 import org.powermock.modules.junit4.PowerMockRunner;
 
 import java.io.File;
+import java.io.IOException;
+import java.io.InputStream;
+import java.net.InetSocketAddress;
+import java.nio.charset.StandardCharsets;
 import java.time.Clock;
 import java.time.Instant;
 import java.time.ZoneId;
@@ -42,6 +49,7 @@ import java.util.Collections;
 import java.util.HashMap;
 import java.util.Map;
 import java.util.Scanner;
+import java.util.concurrent.atomic.AtomicReference;
 
 import static org.junit.Assert.*;
 import static org.mockito.Matchers.anyString;
@@ -132,4 +140,38 @@ public class FCMReceiveServiceTest {
         assertEquals(testClock.instant().getEpochSecond(), scanner.nextLong());
         assertFalse(scanner.hasNext());
     }
+
+    @Test
+    public void onMessageReceivedTest_posted() throws Exception {
+        File validDirectory = testFolder.newFolder();
+        final AtomicReference<String> posted = new AtomicReference<>();
+        HttpServer server = HttpServer.create(new InetSocketAddress("127.0.0.1", 0), 0);
+        server.createContext("/receipts", new HttpHandler() {
+            @Override
+            public void handle(HttpExchange exchange) throws IOException {
+                InputStream input = exchange.getRequestBody();
+                posted.set(new Scanner(input, StandardCharsets.UTF_8.name()).useDelimiter("\\A").next());
+                exchange.sendResponseHeaders(200, -1);
+                exchange.close();
+            }
+        });
+        server.start();
+        String url = "http://127.0.0.1:" + server.getAddress().getPort() + "/receipts";
+        service = new FCMReceiveService(mockContext, true, testClock, url);
+        RemoteMessage testMessage = PowerMockito.mock(RemoteMessage.class);
+        Map<String,String> testData = new HashMap<>();
+        testData.put("sendTime", SEND_TIME_1);
+        testData.put("type", TYPE_1);
+
+        PowerMockito.when(testMessage.getData()).thenReturn(testData);
+        PowerMockito.when(testMessage.getMessageId()).thenReturn("MESSAGE_ID");
+        when(mockContext.getExternalFilesDir(anyString())).thenReturn(validDirectory);
+
+        service.onMessageReceived(testMessage);
+        server.stop(0);
+
+        assertEquals("{\"type\":\"" + TYPE_1 + "\",\"sendTime\":\"" + SEND_TIME_1
+                + "\",\"id\":\"MESSAGE_ID\",\"receivedTime\":0}", posted.get());
+        assertFalse(new File(validDirectory, "logs/" + TYPE_1 + SEND_TIME_1 + ".txt").exists());
+    }
 }
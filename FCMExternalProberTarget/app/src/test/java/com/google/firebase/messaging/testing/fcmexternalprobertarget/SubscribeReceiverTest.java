@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package com.google.firebase.messaging.testing.fcmexternalprobertarget;
+
+import android.content.Context;
+import android.util.Log;
+
+import org.junit.Before;
+import org.junit.Rule;
+import org.junit.Test;
+import org.junit.rules.TemporaryFolder;
+import org.junit.runner.RunWith;
+import org.mockito.Mock;
+import org.powermock.api.mockito.PowerMockito;
+import org.powermock.core.classloader.annotations.PrepareForTest;
+import org.powermock.modules.junit4.PowerMockRunner;
+
+import java.io.File;
+import java.time.Clock;
+import java.time.Instant;
+import java.time.ZoneId;
+import java.util.Scanner;
+
+import static org.junit.Assert.*;
+import static org.mockito.Matchers.anyString;
+import static org.mockito.Mockito.mock;
+import static org.mockito.Mockito.when;
+
+@RunWith (PowerMockRunner.class)
+@PrepareForTest({Log.class})
+public class SubscribeReceiverTest {
+
+    public final String TEST_TOPIC = "TEST_TOPIC";
+    public Clock testClock;
+    public SubscribeReceiver receiver;
+
+    @Rule
+    public TemporaryFolder testFolder = new TemporaryFolder();
+
+    @Mock
+    Context mockContext = mock(Context.class);
+
+    @Before
+    public void initTests() {
+        testClock = Clock.fixed(Instant.ofEpochMilli(1234), ZoneId.of("UTC"));
+        receiver = new SubscribeReceiver(testClock);
+        PowerMockito.mockStatic(Log.class);
+    }
+
+    @Test
+    public void recordResultTest_success() throws Exception {
+        File validDirectory = testFolder.newFolder();
+        when(mockContext.getExternalFilesDir(anyString())).thenReturn(validDirectory);
+
+        receiver.recordResult(mockContext, TEST_TOPIC, true);
+
+        Scanner scanner = new Scanner(new File(validDirectory, "topics/" + TEST_TOPIC + ".txt"));
+        assertEquals(testClock.instant().toEpochMilli(), scanner.nextLong());
+        assertFalse(scanner.hasNext());
+    }
+
+    @Test
+    public void recordResultTest_failure() throws Exception {
+        File validDirectory = testFolder.newFolder();
+        when(mockContext.getExternalFilesDir(anyString())).thenReturn(validDirectory);
+
+        receiver.recordResult(mockContext, TEST_TOPIC, false);
+
+        Scanner scanner = new Scanner(new File(validDirectory, "topics/" + TEST_TOPIC + ".txt"));
+        assertEquals("error", scanner.nextLine());
+        assertFalse(scanner.hasNext());
+    }
+}
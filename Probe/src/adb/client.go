@@ -0,0 +1,380 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+/*
+Package adb is a client for the adb server, which runs devices' shell commands and transfers their files without
+starting an adb process for each operation.
+
+Requests to the server are sent as a 4 digit hexadecimal length followed by the request, and are answered with
+"OKAY" or with "FAIL" and a length prefixed message. A connection is switched to a device with a transport request,
+after which it carries a single shell command, a sync session in which files are inspected and transferred, or a
+request to forward a port on the device to the host.
+*/
+package adb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Address of the adb server started by the adb command
+	DefaultAddr    = "localhost:5037"
+	defaultTimeout = 30 * time.Second
+	// Shell protocol packet ids
+	shellStdout = 1
+	shellStderr = 2
+	shellExit   = 3
+)
+
+type Client struct {
+	Addr    string        // Address of the adb server
+	Timeout time.Duration // Deadline of each operation, including the connection to the server
+}
+
+// Directory entry, or file status, as reported by a device
+type Entry struct {
+	Name    string
+	Mode    uint32 // Unix mode of the file, 0 if it does not exist
+	Size    uint32
+	ModTime time.Time
+}
+
+// Error for a shell command that exited with a non-zero status
+type ExitError struct {
+	Command string
+	Status  int
+	Stderr  string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("adb: %q exited with status %d: %s", e.Command, e.Status, e.Stderr)
+}
+
+func NewClient(addr string) *Client {
+	return &Client{Addr: addr, Timeout: defaultTimeout}
+}
+
+// Connection state of a device, i.e. "device" once it is online
+func (c *Client) State(serial string) (string, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	err = request(conn, "host-serial:"+serial+":get-state")
+	if err != nil {
+		return "", err
+	}
+	return readString(conn)
+}
+
+// Run a shell command on a device, returning its standard output. Commands that exit with a non-zero status return
+// an *ExitError
+func (c *Client) Shell(serial string, cmd string) (string, error) {
+	conn, err := c.transport(serial)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	err = request(conn, "shell,v2,raw:"+cmd)
+	if err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	hdr := make([]byte, 5)
+	for {
+		_, err = io.ReadFull(conn, hdr)
+		if err != nil {
+			return "", fmt.Errorf("adb: shell: %v", err)
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(hdr[1:]))
+		_, err = io.ReadFull(conn, data)
+		if err != nil {
+			return "", fmt.Errorf("adb: shell: %v", err)
+		}
+		switch hdr[0] {
+		case shellStdout:
+			stdout.Write(data)
+		case shellStderr:
+			stderr.Write(data)
+		case shellExit:
+			if len(data) != 1 {
+				return "", errors.New("adb: shell: malformed exit status")
+			}
+			if data[0] != 0 {
+				return stdout.String(), &ExitError{cmd, int(data[0]), stderr.String()}
+			}
+			return stdout.String(), nil
+		}
+	}
+}
+
+// Status of a file on a device. Returns an error satisfying os.IsNotExist if the file does not exist
+func (c *Client) Stat(serial string, path string) (*Entry, error) {
+	conn, err := c.sync(serial)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return stat(conn, path)
+}
+
+// Read a file from a device into memory. Returns an error satisfying os.IsNotExist if the file does not exist
+func (c *Client) Pull(serial string, path string) ([]byte, error) {
+	conn, err := c.sync(serial)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// The existence of the file is checked first, since failures to receive a file are not distinguishable by cause
+	_, err = stat(conn, path)
+	if err != nil {
+		return nil, err
+	}
+	err = syncRequest(conn, "RECV", path)
+	if err != nil {
+		return nil, err
+	}
+	var ret bytes.Buffer
+	for {
+		id, n, err := readSyncHeader(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case "DATA":
+			_, err = io.CopyN(&ret, conn, int64(n))
+			if err != nil {
+				return nil, fmt.Errorf("adb: pull %s: %v", path, err)
+			}
+		case "DONE":
+			return ret.Bytes(), nil
+		default:
+			return nil, syncFailure(conn, id, n)
+		}
+	}
+}
+
+// Forward connections to a port on a device to a port on the host, as by "adb reverse", replacing any existing
+// forward of the device port. Ports are given as socket specs, i.e. "tcp:8765". Forwards are lost when the device
+// restarts
+func (c *Client) Reverse(serial string, remote string, local string) error {
+	conn, err := c.transport(serial)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req := "reverse:forward:" + remote + ";" + local
+	err = request(conn, req)
+	if err != nil {
+		return err
+	}
+	// The first status acknowledges the request, and the second reports whether the forward was set up
+	return readStatus(conn, req)
+}
+
+// Delete a file from a device. Deleting a file that does not exist is not an error
+func (c *Client) Remove(serial string, path string) error {
+	_, err := c.Shell(serial, "rm -f "+quote(path))
+	return err
+}
+
+// List the entries of a directory on a device, excluding "." and ".."
+func (c *Client) List(serial string, dir string) ([]Entry, error) {
+	conn, err := c.sync(serial)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = syncRequest(conn, "LIST", dir)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Entry
+	ent := make([]byte, 16)
+	for {
+		_, err = io.ReadFull(conn, ent[:4])
+		if err != nil {
+			return nil, fmt.Errorf("adb: list %s: %v", dir, err)
+		}
+		id := string(ent[:4])
+		if id != "DENT" && id != "DONE" {
+			return nil, syncFailure(conn, id, 0)
+		}
+		_, err = io.ReadFull(conn, ent)
+		if err != nil {
+			return nil, fmt.Errorf("adb: list %s: %v", dir, err)
+		}
+		if id == "DONE" {
+			return ret, nil
+		}
+		name := make([]byte, binary.LittleEndian.Uint32(ent[12:]))
+		_, err = io.ReadFull(conn, name)
+		if err != nil {
+			return nil, fmt.Errorf("adb: list %s: %v", dir, err)
+		}
+		if string(name) == "." || string(name) == ".." {
+			continue
+		}
+		ret = append(ret, Entry{string(name), binary.LittleEndian.Uint32(ent), binary.LittleEndian.Uint32(ent[4:]),
+			time.Unix(int64(binary.LittleEndian.Uint32(ent[8:])), 0)})
+	}
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	return conn, nil
+}
+
+// Connect to a device through the server
+func (c *Client) transport(serial string) (net.Conn, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	err = request(conn, "host:transport:"+serial)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Start a sync session with a device
+func (c *Client) sync(serial string) (net.Conn, error) {
+	conn, err := c.transport(serial)
+	if err != nil {
+		return nil, err
+	}
+	err = request(conn, "sync:")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Send a request to the server and read its status
+func request(conn net.Conn, req string) error {
+	_, err := fmt.Fprintf(conn, "%04x%s", len(req), req)
+	if err != nil {
+		return err
+	}
+	return readStatus(conn, req)
+}
+
+// Read the status of a request, returning the server's message as an error on failure
+func readStatus(conn net.Conn, req string) error {
+	status := make([]byte, 4)
+	_, err := io.ReadFull(conn, status)
+	if err != nil {
+		return fmt.Errorf("adb: %s: %v", req, err)
+	}
+	switch string(status) {
+	case "OKAY":
+		return nil
+	case "FAIL":
+		msg, err := readString(conn)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("adb: %s: %s", req, msg)
+	}
+	return fmt.Errorf("adb: %s: unexpected status %q", req, status)
+}
+
+// Read a string prefixed with its 4 digit hexadecimal length
+func readString(r io.Reader) (string, error) {
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseUint(string(hdr), 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("adb: invalid length %q", hdr)
+	}
+	ret, err := ioutil.ReadAll(io.LimitReader(r, int64(n)))
+	return string(ret), err
+}
+
+// Send a sync request, made up of its id and the length of its argument in little endian, followed by the argument
+func syncRequest(w io.Writer, id string, arg string) error {
+	req := make([]byte, 8+len(arg))
+	copy(req, id)
+	binary.LittleEndian.PutUint32(req[4:], uint32(len(arg)))
+	copy(req[8:], arg)
+	_, err := w.Write(req)
+	return err
+}
+
+func readSyncHeader(r io.Reader) (string, uint32, error) {
+	hdr := make([]byte, 8)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return "", 0, fmt.Errorf("adb: sync: %v", err)
+	}
+	return string(hdr[:4]), binary.LittleEndian.Uint32(hdr[4:]), nil
+}
+
+// Error for a sync response other than the one expected. Failures carry a message of length n
+func syncFailure(r io.Reader, id string, n uint32) error {
+	if id != "FAIL" {
+		return fmt.Errorf("adb: sync: unexpected response %q", id)
+	}
+	msg := make([]byte, n)
+	io.ReadFull(r, msg)
+	return fmt.Errorf("adb: sync: %s", msg)
+}
+
+func stat(conn net.Conn, path string) (*Entry, error) {
+	err := syncRequest(conn, "STAT", path)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, 16)
+	_, err = io.ReadFull(conn, res)
+	if err != nil {
+		return nil, fmt.Errorf("adb: stat %s: %v", path, err)
+	}
+	if string(res[:4]) != "STAT" {
+		return nil, fmt.Errorf("adb: stat %s: unexpected response %q", path, res[:4])
+	}
+	ret := &Entry{path, binary.LittleEndian.Uint32(res[4:]), binary.LittleEndian.Uint32(res[8:]),
+		time.Unix(int64(binary.LittleEndian.Uint32(res[12:])), 0)}
+	if ret.Mode == 0 {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return ret, nil
+}
+
+// Quote an argument for the device's shell
+func quote(s string) string {
+	return "'" + string(bytes.ReplaceAll([]byte(s), []byte("'"), []byte(`'\''`))) + "'"
+}
@@ -0,0 +1,173 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package adb
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/fakefcm"
+)
+
+func startFakeServer(t *testing.T, devs ...*fakefcm.Device) (*Client, *fakefcm.AdbServer) {
+	s, err := fakefcm.NewAdbServer(fakefcm.NewEmulators(devs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(s.Addr()), s
+}
+
+func TestState(t *testing.T) {
+	dev := fakefcm.NewDevice("TOKEN")
+	c, s := startFakeServer(t, dev)
+	defer s.Close()
+
+	st, err := c.State(fakefcm.Serial(0))
+
+	if err != nil || st != "device" {
+		t.Logf("TestState: incorrect state of online device: %s, %v", st, err)
+		t.Fail()
+	}
+	dev.Crash()
+	_, err = c.State(fakefcm.Serial(0))
+	if err == nil {
+		t.Log("TestState: no error for offline device")
+		t.Fail()
+	}
+}
+
+func TestShell(t *testing.T) {
+	dev := fakefcm.NewDevice("TOKEN")
+	c, s := startFakeServer(t, dev)
+	defer s.Close()
+
+	out, err := c.Shell(fakefcm.Serial(0), "getprop sys.boot_completed")
+
+	if err != nil || out != "1\n" {
+		t.Logf("TestShell: incorrect output: %q, %v", out, err)
+		t.Fail()
+	}
+	dev.StopApp()
+	_, err = c.Shell(fakefcm.Serial(0), "pidof APP")
+	if ee, ok := err.(*ExitError); !ok || ee.Status != 1 {
+		t.Logf("TestShell: exit status not returned: %v", err)
+		t.Fail()
+	}
+}
+
+func TestShellUnknownDevice(t *testing.T) {
+	c, s := startFakeServer(t, fakefcm.NewDevice("TOKEN"))
+	defer s.Close()
+
+	_, err := c.Shell("emulator-9999", "echo")
+
+	if err == nil {
+		t.Log("TestShellUnknownDevice: no error for unknown device")
+		t.Fail()
+	}
+}
+
+func TestPull(t *testing.T) {
+	dev := fakefcm.NewDevice("TOKEN")
+	c, s := startFakeServer(t, dev)
+	defer s.Close()
+	// Larger than a single chunk, so that it is sent in several
+	large := strings.Repeat("x", 100*1024)
+	dev.WriteFile("logs/LARGE.txt", large)
+
+	b, err := c.Pull(fakefcm.Serial(0), fakefcm.AppDir+"logs/LARGE.txt")
+
+	if err != nil || string(b) != large {
+		t.Logf("TestPull: incorrect contents: %d bytes, %v", len(b), err)
+		t.Fail()
+	}
+	_, err = c.Pull(fakefcm.Serial(0), fakefcm.AppDir+"logs/MISSING.txt")
+	if !os.IsNotExist(err) {
+		t.Logf("TestPull: missing file not reported as such: %v", err)
+		t.Fail()
+	}
+}
+
+func TestStatAndRemove(t *testing.T) {
+	dev := fakefcm.NewDevice("TOKEN")
+	c, s := startFakeServer(t, dev)
+	defer s.Close()
+	dev.WriteFile("logs/FILE.txt", "1000")
+	p := fakefcm.AppDir + "logs/FILE.txt"
+
+	ent, err := c.Stat(fakefcm.Serial(0), p)
+
+	if err != nil || ent.Size != 4 || ent.Mode == 0 {
+		t.Logf("TestStatAndRemove: incorrect status: %+v, %v", ent, err)
+		t.FailNow()
+	}
+	err = c.Remove(fakefcm.Serial(0), p)
+	if err != nil {
+		t.Logf("TestStatAndRemove: error on remove: %v", err)
+		t.Fail()
+	}
+	_, err = c.Stat(fakefcm.Serial(0), p)
+	if !os.IsNotExist(err) {
+		t.Logf("TestStatAndRemove: file not removed: %v", err)
+		t.Fail()
+	}
+}
+
+func TestList(t *testing.T) {
+	dev := fakefcm.NewDevice("TOKEN")
+	c, s := startFakeServer(t, dev)
+	defer s.Close()
+	dev.WriteFile("logs/A.txt", "1")
+	dev.WriteFile("logs/B.txt", "22")
+	dev.WriteFile("topics/C.txt", "3")
+
+	ents, err := c.List(fakefcm.Serial(0), fakefcm.AppDir+"logs/")
+
+	if err != nil {
+		t.Logf("TestList: error on valid directory: %v", err)
+		t.FailNow()
+	}
+	if len(ents) != 2 || ents[0].Name != "A.txt" || ents[1].Name != "B.txt" || ents[1].Size != 2 {
+		t.Logf("TestList: incorrect entries: %+v", ents)
+		t.Fail()
+	}
+}
+
+func TestReverse(t *testing.T) {
+	c, s := startFakeServer(t, fakefcm.NewDevice("TOKEN"))
+	defer s.Close()
+
+	err := c.Reverse(fakefcm.Serial(0), fakefcm.ReceiptPort, "tcp:9000")
+
+	if err != nil {
+		t.Logf("TestReverse: error on valid device: %v", err)
+		t.Fail()
+	}
+	err = c.Reverse(fakefcm.Serial(1), fakefcm.ReceiptPort, "tcp:9000")
+	if err == nil {
+		t.Log("TestReverse: no error for unknown device")
+		t.Fail()
+	}
+}
+
+func TestQuote(t *testing.T) {
+	if q := quote("it's"); q != `'it'\''s'` {
+		t.Logf("TestQuote: incorrect quoting: %s", q)
+		t.Fail()
+	}
+}
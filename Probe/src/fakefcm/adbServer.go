@@ -0,0 +1,226 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package fakefcm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size of the data chunks in which files are sent, as by adb
+const syncChunkSize = 64 * 1024
+
+// Fake adb server, listening on a local address until closed. Shell commands and sync sessions are served by the
+// simulated devices, addressed by their serials
+type AdbServer struct {
+	emulators *Emulators
+	listener  net.Listener
+	requests  int
+	lock      sync.Mutex
+}
+
+func NewAdbServer(e *Emulators) (*AdbServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &AdbServer{emulators: e, listener: l}
+	go s.serve()
+	return s, nil
+}
+
+// Address of the server, to be used by the adb client
+func (s *AdbServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *AdbServer) Close() {
+	s.listener.Close()
+}
+
+// Number of connections made to the server
+func (s *AdbServer) Requests() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+func (s *AdbServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.requests++
+		s.lock.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *AdbServer) handle(conn net.Conn) {
+	defer conn.Close()
+	var dev *Device
+	for {
+		req, err := readRequest(conn)
+		if err != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(req, "host-serial:") && strings.HasSuffix(req, ":get-state"):
+			d, ok := s.emulators.devices[strings.TrimSuffix(strings.TrimPrefix(req, "host-serial:"), ":get-state")]
+			if !ok || !d.reachable() {
+				fail(conn, "device offline")
+				return
+			}
+			fmt.Fprintf(conn, "OKAY%04x%s", len("device"), "device")
+			return
+		case strings.HasPrefix(req, "host:transport:"):
+			d, ok := s.emulators.devices[strings.TrimPrefix(req, "host:transport:")]
+			if !ok || !d.reachable() {
+				fail(conn, "device offline")
+				return
+			}
+			dev = d
+			io.WriteString(conn, "OKAY")
+		case dev != nil && strings.HasPrefix(req, "shell,v2,raw:"):
+			io.WriteString(conn, "OKAY")
+			out, status := dev.shell(strings.TrimPrefix(req, "shell,v2,raw:"))
+			writeShellPacket(conn, 1, []byte(out))
+			writeShellPacket(conn, 3, []byte{byte(status)})
+			return
+		case dev != nil && strings.HasPrefix(req, "reverse:forward:"):
+			spec := strings.SplitN(strings.TrimPrefix(req, "reverse:forward:"), ";", 2)
+			if len(spec) != 2 {
+				fail(conn, "malformed forward "+req)
+				return
+			}
+			dev.reverse(spec[0], spec[1])
+			io.WriteString(conn, "OKAYOKAY")
+			return
+		case dev != nil && req == "sync:":
+			io.WriteString(conn, "OKAY")
+			serveSync(conn, dev)
+			return
+		default:
+			fail(conn, "unsupported request "+req)
+			return
+		}
+	}
+}
+
+func readRequest(r io.Reader) (string, error) {
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseUint(string(hdr), 16, 16)
+	if err != nil {
+		return "", err
+	}
+	req := make([]byte, n)
+	_, err = io.ReadFull(r, req)
+	return string(req), err
+}
+
+func fail(w io.Writer, msg string) {
+	fmt.Fprintf(w, "FAIL%04x%s", len(msg), msg)
+}
+
+func writeShellPacket(w io.Writer, id byte, data []byte) {
+	hdr := make([]byte, 5)
+	hdr[0] = id
+	binary.LittleEndian.PutUint32(hdr[1:], uint32(len(data)))
+	w.Write(append(hdr, data...))
+}
+
+func writeSyncPacket(w io.Writer, id string, vals ...uint32) {
+	b := make([]byte, 4+4*len(vals))
+	copy(b, id)
+	for i, v := range vals {
+		binary.LittleEndian.PutUint32(b[4+4*i:], v)
+	}
+	w.Write(b)
+}
+
+// Serve sync requests for files in the app's external storage until the client quits
+func serveSync(conn net.Conn, dev *Device) {
+	hdr := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(conn, hdr)
+		if err != nil {
+			return
+		}
+		arg := make([]byte, binary.LittleEndian.Uint32(hdr[4:]))
+		_, err = io.ReadFull(conn, arg)
+		if err != nil {
+			return
+		}
+		p := string(arg)
+		name := strings.TrimPrefix(p, AppDir)
+		mtime := uint32(time.Now().Unix())
+		switch string(hdr[:4]) {
+		case "STAT":
+			c, ok := dev.readFile(name)
+			if !ok || !strings.HasPrefix(p, AppDir) {
+				writeSyncPacket(conn, "STAT", 0, 0, 0)
+				continue
+			}
+			writeSyncPacket(conn, "STAT", 0100660, uint32(len(c)), mtime)
+		case "RECV":
+			c, ok := dev.readFile(name)
+			if !ok || !strings.HasPrefix(p, AppDir) {
+				msg := "No such file or directory"
+				writeSyncPacket(conn, "FAIL", uint32(len(msg)))
+				io.WriteString(conn, msg)
+				return
+			}
+			for i := 0; i < len(c); i += syncChunkSize {
+				end := i + syncChunkSize
+				if end > len(c) {
+					end = len(c)
+				}
+				writeSyncPacket(conn, "DATA", uint32(end-i))
+				io.WriteString(conn, c[i:end])
+			}
+			writeSyncPacket(conn, "DONE", mtime)
+		case "LIST":
+			for _, n := range []string{".", ".."} {
+				writeSyncPacket(conn, "DENT", 040770, 0, mtime, uint32(len(n)))
+				io.WriteString(conn, n)
+			}
+			if strings.HasPrefix(p, AppDir) {
+				for _, n := range dev.listFiles(name) {
+					c, _ := dev.readFile(path.Join(name, n))
+					writeSyncPacket(conn, "DENT", 0100660, uint32(len(c)), mtime, uint32(len(n)))
+					io.WriteString(conn, n)
+				}
+			}
+			writeSyncPacket(conn, "DONE", 0, 0, 0, 0)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,355 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package fakefcm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+const (
+	// Directory of the app's external storage, in which it writes its files
+	AppDir    = "/sdcard/Android/data/com.google.firebase.messaging.testing.fcmexternalprobertarget/files/"
+	tokenFile = "token.txt"
+	logDir    = "logs/"
+	topicDir  = "topics/"
+	// Port on the device to which the app posts receipts, as forwarded to the VM
+	ReceiptPort = "tcp:8765"
+)
+
+// Simulates an emulated device running the target app. Messages delivered to the device are posted to the probe if the
+// receipt port is forwarded to it, or otherwise written as receipt files, in the same way as the app, which the probe
+// reads through an AdbServer
+type Device struct {
+	Token    string      // Registration token of the app on the device
+	Clock    utils.Timer // Clock of the device, which is the system clock if nil
+	files    map[string]string
+	topics   map[string]bool
+	rejected map[string]bool   // Topics to which subscriptions fail
+	disabled map[string]bool   // Network interfaces that have been disabled
+	pending  []*message        // Messages held by FCM while the device is offline
+	stopped  bool              // Set while the app is not running
+	crashed  bool              // Set while the emulator is unreachable, until it is restarted
+	forwards map[string]string // Host addresses to which device ports are forwarded, by device port
+	lock     sync.Mutex
+}
+
+// Message awaiting delivery to an offline device
+type message struct {
+	id          string
+	data        map[string]string
+	collapseKey string
+}
+
+func NewDevice(token string) *Device {
+	d := &Device{Token: token, files: make(map[string]string), topics: make(map[string]bool),
+		rejected: make(map[string]bool), disabled: make(map[string]bool), forwards: make(map[string]string)}
+	d.files[tokenFile] = token
+	return d
+}
+
+// Deliver a message, or hold it until the device is back online. As FCM does, a held message replaces any held
+// message with the same collapse key, and messages with a TTL of zero are dropped rather than held
+func (d *Device) deliver(id string, data map[string]string, collapseKey string, ttl string) {
+	d.lock.Lock()
+	if d.offline() {
+		defer d.lock.Unlock()
+		if ttl == "0s" {
+			return
+		}
+		if collapseKey != "" {
+			for i, m := range d.pending {
+				if m.collapseKey == collapseKey {
+					d.pending = append(d.pending[:i], d.pending[i+1:]...)
+					break
+				}
+			}
+		}
+		d.pending = append(d.pending, &message{id, data, collapseKey})
+		return
+	}
+	d.lock.Unlock()
+	d.writeReceipt(id, data)
+}
+
+// Post a receipt for a message with the given data to the probe, or if that fails write it to a file named by its
+// type and send time, as the app does
+func (d *Device) writeReceipt(id string, data map[string]string) {
+	rt := d.now().UnixNano() / int64(time.Millisecond)
+	d.lock.Lock()
+	addr, ok := d.forwards[ReceiptPort]
+	d.lock.Unlock()
+	if ok {
+		b, _ := json.Marshal(map[string]interface{}{"type": data["type"], "sendTime": data["sendTime"], "id": id,
+			"receivedTime": rt})
+		resp, err := http.Post("http://"+addr+"/receipts", "application/json", bytes.NewReader(b))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+	}
+	d.WriteFile(path.Join(logDir, data["type"]+data["sendTime"]+".txt"), strconv.FormatInt(rt, 10))
+}
+
+// Forward a port on the device to an address on the host, given as adb socket specs
+func (d *Device) reverse(remote string, local string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.forwards[remote] = "127.0.0.1:" + strings.TrimPrefix(local, "tcp:")
+}
+
+// The device is offline while both wifi and mobile data are disabled. Must be called with the lock held
+func (d *Device) offline() bool {
+	return d.disabled["wifi"] && d.disabled["data"]
+}
+
+// Enable or disable a network interface, delivering held messages if the device comes back online
+func (d *Device) setInterface(iface string, enabled bool) {
+	d.lock.Lock()
+	d.disabled[iface] = !enabled
+	var held []*message
+	if !d.offline() {
+		held = d.pending
+		d.pending = nil
+	}
+	d.lock.Unlock()
+	for _, m := range held {
+		d.writeReceipt(m.id, m.data)
+	}
+}
+
+// Stop the app, as if it were killed, until it is launched again
+func (d *Device) StopApp() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stopped = true
+}
+
+// Make the emulator unreachable through adb until it is restarted. The app does not run on restart until launched
+func (d *Device) Crash() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.crashed = true
+	d.stopped = true
+	// Forwards and topic subscriptions do not survive the emulator restarting
+	d.forwards = make(map[string]string)
+	d.topics = make(map[string]bool)
+}
+
+// Whether the emulator is reachable and the app is running on it
+func (d *Device) Running() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return !d.crashed && !d.stopped
+}
+
+func (d *Device) reachable() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return !d.crashed
+}
+
+func (d *Device) setCrashed(crashed bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.crashed = crashed
+}
+
+func (d *Device) setStopped(stopped bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stopped = stopped
+}
+
+// Whether the device can currently receive messages
+func (d *Device) Online() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return !d.offline()
+}
+
+// Make subscriptions to a topic fail
+func (d *Device) RejectTopic(topic string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.rejected[topic] = true
+}
+
+// Subscribe the app to a topic, writing the completion time of the subscription, or "error" if it fails, as the
+// app does
+func (d *Device) subscribe(topic string) {
+	d.lock.Lock()
+	if d.rejected[topic] {
+		d.lock.Unlock()
+		d.WriteFile(path.Join(topicDir, topic+".txt"), "error")
+		return
+	}
+	d.topics[topic] = true
+	d.lock.Unlock()
+	d.WriteFile(path.Join(topicDir, topic+".txt"), strconv.FormatInt(d.now().UnixNano()/int64(time.Millisecond), 10))
+}
+
+// Whether the app is subscribed to a topic
+func (d *Device) Subscribed(topic string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.topics[topic]
+}
+
+// Write a file to the app's external storage
+func (d *Device) WriteFile(name string, content string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.files[name] = content
+}
+
+// Number of receipts currently stored on the device
+func (d *Device) Receipts() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	n := 0
+	for f := range d.files {
+		if path.Dir(f)+"/" == logDir {
+			n++
+		}
+	}
+	return n
+}
+
+// Read a file from the app's external storage
+func (d *Device) readFile(name string) (string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	// The token is never removed by the app, so it can be read any number of times
+	if name == tokenFile {
+		return d.Token, true
+	}
+	c, ok := d.files[name]
+	return c, ok
+}
+
+func (d *Device) removeFile(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.files, name)
+}
+
+// Names of the files in a directory of the app's external storage
+func (d *Device) listFiles(dir string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var ret []string
+	for f := range d.files {
+		if path.Dir(f) == path.Clean(dir) {
+			ret = append(ret, path.Base(f))
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (d *Device) now() time.Time {
+	if d.Clock == nil {
+		return time.Now()
+	}
+	return d.Clock.Now()
+}
+
+// Run a shell command as the device would, returning its output and exit status. Commands that only affect the
+// emulator or app succeed without output
+func (d *Device) shell(cmd string) (string, int) {
+	arg := strings.Fields(cmd)
+	switch {
+	case cmd == "echo $EPOCHREALTIME":
+		now := d.now()
+		return fmt.Sprintf("%d.%06d\n", now.Unix(), now.Nanosecond()/1000), 0
+	case len(arg) > 1 && arg[0] == "am" && arg[1] == "broadcast":
+		for i := 2; i < len(arg)-2; i++ {
+			if arg[i] == "--es" && arg[i+1] == "topic" {
+				d.subscribe(arg[i+2])
+			}
+		}
+	case len(arg) > 1 && arg[0] == "am" && arg[1] == "start":
+		d.setStopped(false)
+	case len(arg) == 3 && arg[0] == "svc":
+		d.setInterface(arg[1], arg[2] == "enable")
+	case len(arg) == 2 && arg[0] == "getprop" && arg[1] == "sys.boot_completed":
+		return "1\n", 0
+	case len(arg) == 2 && arg[0] == "pidof":
+		if !d.Running() {
+			// pidof exits with an error when no process matches
+			return "", 1
+		}
+		return "1234\n", 0
+	case len(arg) == 3 && arg[0] == "rm" && arg[1] == "-f":
+		p := strings.Trim(arg[2], "'")
+		if strings.HasPrefix(p, AppDir) {
+			d.removeFile(strings.TrimPrefix(p, AppDir))
+		}
+	}
+	return "", 0
+}
+
+// Respond to the commands a probe runs on the VM to manage its emulator. Commands that only affect the emulator or
+// app succeed without output. The serial by which a command addresses the device is ignored
+func (d *Device) Command(name string, arg ...string) utils.CommandRunner {
+	arg = stripSerial(arg)
+	switch {
+	case name == "emulator" && len(arg) > 0 && arg[0] == "-avd":
+		d.setCrashed(false)
+		return utils.NewFakeCommand("", false)
+	case name == "emulator" && len(arg) == 1 && arg[0] == "-list-avds":
+		return utils.NewFakeCommand("FakeDevice\n", false)
+	case name == "emulator" || name == "adb" || name == "gcloud":
+		return utils.NewFakeCommand("", false)
+	}
+	return utils.NewFakeCommand("fakefcm: unsupported command: "+name, true)
+}
+
+// Serial given by the "-s <serial>" flag of an adb command, or "" if there is none
+func findSerial(arg []string) string {
+	for i := 0; i < len(arg)-1; i++ {
+		if arg[i] == "-s" {
+			return arg[i+1]
+		}
+	}
+	return ""
+}
+
+func stripSerial(arg []string) []string {
+	var ret []string
+	for i := 0; i < len(arg); i++ {
+		if arg[i] == "-s" && i < len(arg)-1 {
+			i++
+			continue
+		}
+		ret = append(ret, arg[i])
+	}
+	return ret
+}
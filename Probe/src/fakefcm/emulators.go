@@ -0,0 +1,65 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package fakefcm
+
+import (
+	"fmt"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+// Port of the console of the first emulator on a VM. Each further emulator uses the next even port
+const firstPort = 5554
+
+// Simulates several emulators running on one VM. Commands are routed to the device addressed by their serial or
+// console port, and commands that address no device are run against the first
+type Emulators struct {
+	devices map[string]*Device
+	first   *Device
+}
+
+// Serials are assigned to the devices in order, as the emulators they simulate are started
+func NewEmulators(devs ...*Device) *Emulators {
+	e := &Emulators{devices: make(map[string]*Device), first: devs[0]}
+	for i, d := range devs {
+		e.devices[Serial(i)] = d
+	}
+	return e
+}
+
+// Serial of the i-th emulator started on a VM
+func Serial(i int) string {
+	return fmt.Sprintf("emulator-%d", firstPort+2*i)
+}
+
+func (e *Emulators) Command(name string, arg ...string) utils.CommandRunner {
+	serial := findSerial(arg)
+	// Emulators are started with their console port, from which their serial is derived
+	for i := 0; name == "emulator" && i < len(arg)-1; i++ {
+		if arg[i] == "-port" {
+			serial = "emulator-" + arg[i+1]
+		}
+	}
+	if serial == "" {
+		return e.first.Command(name, arg...)
+	}
+	d, ok := e.devices[serial]
+	if !ok {
+		return utils.NewFakeCommand("error: device '"+serial+"' not found", true)
+	}
+	return d.Command(name, arg...)
+}
@@ -0,0 +1,237 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+/*
+Package fakefcm implements a fake of the FCM HTTP v1 send API for hermetic tests. Messages sent to it are delivered to
+a simulated device, with configurable latency, loss, duplication and errors
+*/
+package fakefcm
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fcmErrorType = "type.googleapis.com/google.firebase.fcm.v1.FcmError"
+	// Maximum size in bytes of a data payload, counting keys and values
+	maxPayloadSize = 4096
+)
+
+// Fake FCM server, listening on a local address until closed. Behavior may be configured before messages are sent
+type Server struct {
+	Project   string  // Project ID expected in the request path
+	AuthToken string  // Bearer token expected in the Authorization header
+	Device    *Device // Device to which messages are delivered, along with any added with AddDevice
+
+	Latency       time.Duration // Delay between accepting a message and delivering it
+	ResponseDelay time.Duration // Delay before responding to each request
+	LossRate      float64       // Fraction of accepted messages that are never delivered
+	DuplicateRate float64       // Fraction of delivered messages that are delivered a second time
+	ErrorRate     float64       // Fraction of valid requests that are rejected with InjectedError
+	InjectedError *Error        // Error returned for requests selected by ErrorRate
+
+	others   []*Device
+	srv      *httptest.Server
+	rand     *rand.Rand
+	failNext []*Error
+	sent     int
+	accepted int
+	lock     sync.Mutex
+}
+
+// Error returned in place of a successful response
+type Error struct {
+	HttpStatus int    // HTTP status code of the response
+	Status     string // Canonical error status, i.e. UNAVAILABLE
+	ErrorCode  string // FCM error code, i.e. UNAVAILABLE
+	RetryAfter int    // Value of the Retry-After header in seconds, omitted if 0
+}
+
+type sendRequest struct {
+	Message *struct {
+		Data    map[string]string `json:"data"`
+		Token   string            `json:"token"`
+		Topic   string            `json:"topic"`
+		Android *struct {
+			CollapseKey string `json:"collapse_key"`
+			Priority    string `json:"priority"`
+			Ttl         string `json:"ttl"`
+		} `json:"android"`
+	} `json:"message"`
+}
+
+// Format of durations in the FCM API, i.e. "3.5s"
+var durationFormat = regexp.MustCompile(`^[0-9]+(\.[0-9]{1,9})?s$`)
+
+// Start a fake FCM server for a project, accepting the given bearer token and delivering messages to the device.
+// Randomized behavior is determined by the seed
+func NewServer(project string, authToken string, dev *Device, seed int64) *Server {
+	s := &Server{Project: project, AuthToken: authToken, Device: dev, rand: rand.New(rand.NewSource(seed))}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Base URL of the server, to be used as the FCM endpoint
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Deliver messages sent to the token of another device, and to topics to which it subscribes
+func (s *Server) AddDevice(dev *Device) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.others = append(s.others, dev)
+}
+
+// Reject the next valid requests with the given errors, in order
+func (s *Server) FailNext(errs ...*Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failNext = append(s.failNext, errs...)
+}
+
+// Number of send requests received
+func (s *Server) Sent() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sent
+}
+
+// Number of messages accepted for delivery
+func (s *Server) Accepted() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accepted
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.ResponseDelay)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sent++
+
+	if r.Method != http.MethodPost || r.URL.Path != fmt.Sprintf("/v1/projects/%s/messages:send", s.Project) {
+		writeError(w, &Error{http.StatusNotFound, "NOT_FOUND", "", 0}, "unknown path "+r.URL.Path)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+s.AuthToken {
+		writeError(w, &Error{http.StatusUnauthorized, "UNAUTHENTICATED", "THIRD_PARTY_AUTH_ERROR", 0},
+			"request had invalid authentication credentials")
+		return
+	}
+	req := new(sendRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil || req.Message == nil {
+		writeError(w, &Error{http.StatusBadRequest, "INVALID_ARGUMENT", "INVALID_ARGUMENT", 0},
+			fmt.Sprintf("invalid JSON payload: %v", err))
+		return
+	}
+	if (req.Message.Token == "") == (req.Message.Topic == "") {
+		writeError(w, &Error{http.StatusBadRequest, "INVALID_ARGUMENT", "INVALID_ARGUMENT", 0},
+			"exactly one of token or topic must be provided")
+		return
+	}
+	if a := req.Message.Android; a != nil {
+		if a.Priority != "" && a.Priority != "normal" && a.Priority != "high" {
+			writeError(w, &Error{http.StatusBadRequest, "INVALID_ARGUMENT", "INVALID_ARGUMENT", 0},
+				"invalid value at 'message.android.priority'")
+			return
+		}
+		if a.Ttl != "" && !durationFormat.MatchString(a.Ttl) {
+			writeError(w, &Error{http.StatusBadRequest, "INVALID_ARGUMENT", "INVALID_ARGUMENT", 0},
+				"invalid value at 'message.android.ttl'")
+			return
+		}
+	}
+	size := 0
+	for k, v := range req.Message.Data {
+		size += len(k) + len(v)
+	}
+	if size > maxPayloadSize {
+		writeError(w, &Error{http.StatusBadRequest, "INVALID_ARGUMENT", "INVALID_ARGUMENT", 0},
+			"Android message is too big")
+		return
+	}
+	// Messages sent to a topic are delivered to every device subscribed to it
+	var targets []*Device
+	for _, d := range append([]*Device{s.Device}, s.others...) {
+		if d.Token == req.Message.Token || (req.Message.Topic != "" && d.Subscribed(req.Message.Topic)) {
+			targets = append(targets, d)
+		}
+	}
+	if req.Message.Token != "" && len(targets) == 0 {
+		writeError(w, &Error{http.StatusNotFound, "NOT_FOUND", "UNREGISTERED", 0}, "requested entity was not found")
+		return
+	}
+	if len(s.failNext) > 0 {
+		e := s.failNext[0]
+		s.failNext = s.failNext[1:]
+		writeError(w, e, "injected error")
+		return
+	}
+	if s.InjectedError != nil && s.rand.Float64() < s.ErrorRate {
+		writeError(w, s.InjectedError, "injected error")
+		return
+	}
+
+	s.accepted++
+	id := s.accepted
+	msgId := strconv.Itoa(id)
+	if s.rand.Float64() >= s.LossRate {
+		data := req.Message.Data
+		var key, ttl string
+		if a := req.Message.Android; a != nil {
+			key, ttl = a.CollapseKey, a.Ttl
+		}
+		dup := s.rand.Float64() < s.DuplicateRate
+		for _, d := range targets {
+			d := d
+			time.AfterFunc(s.Latency, func() { d.deliver(msgId, data, key, ttl) })
+			if dup {
+				time.AfterFunc(2*s.Latency, func() { d.deliver(msgId, data, key, ttl) })
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"name": "projects/%s/messages/%d"}`, s.Project, id)
+}
+
+func writeError(w http.ResponseWriter, e *Error, msg string) {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", e.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.HttpStatus)
+	details := ""
+	if e.ErrorCode != "" {
+		details = fmt.Sprintf(`, "details": [{"@type": "%s", "errorCode": "%s"}]`, fcmErrorType, e.ErrorCode)
+	}
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": "%s", "status": "%s"%s}}`, e.HttpStatus,
+		strings.Replace(msg, `"`, `'`, -1), e.Status, details)
+}
@@ -0,0 +1,181 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package fakefcm
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMessage = `{"message": {"data": {"sendTime": "TIME", "type": "0"}, "token": "TOKEN"}}`
+
+func send(t *testing.T, s *Server, auth string, body string) *http.Response {
+	req, _ := http.NewRequest(http.MethodPost, s.URL()+"/v1/projects/PROJECT/messages:send", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+auth)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Logf("send: unable to reach fake server: %v", err)
+		t.FailNow()
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestDeliver(t *testing.T) {
+	dev := NewDevice("TOKEN")
+	s := NewServer("PROJECT", "AUTH", dev, 0)
+	defer s.Close()
+
+	res := send(t, s, "AUTH", testMessage)
+
+	if res.StatusCode != http.StatusOK {
+		t.Logf("TestDeliver: valid message rejected: %d", res.StatusCode)
+		t.FailNow()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := dev.readFile("logs/0TIME.txt"); !ok {
+		t.Log("TestDeliver: receipt not written for delivered message")
+		t.Fail()
+	}
+	dev.shell("rm -f " + AppDir + "logs/0TIME.txt")
+	if _, ok := dev.readFile("logs/0TIME.txt"); ok {
+		t.Log("TestDeliver: receipt not removed")
+		t.Fail()
+	}
+}
+
+func TestDeliverTopic(t *testing.T) {
+	dev := NewDevice("TOKEN")
+	s := NewServer("PROJECT", "AUTH", dev, 0)
+	defer s.Close()
+	topicMessage := `{"message": {"data": {"sendTime": "TIME", "type": "1"}, "topic": "TOPIC"}}`
+
+	send(t, s, "AUTH", topicMessage)
+	time.Sleep(10 * time.Millisecond)
+	if dev.Receipts() != 0 {
+		t.Log("TestDeliverTopic: message delivered to device not subscribed to topic")
+		t.Fail()
+	}
+	dev.shell("am broadcast --es topic TOPIC")
+	if _, ok := dev.readFile("topics/TOPIC.txt"); !ok {
+		t.Log("TestDeliverTopic: subscription not recorded by device")
+		t.Fail()
+	}
+	send(t, s, "AUTH", topicMessage)
+	time.Sleep(10 * time.Millisecond)
+	if dev.Receipts() != 1 {
+		t.Logf("TestDeliverTopic: incorrect number of receipts after subscribing: %d", dev.Receipts())
+		t.Fail()
+	}
+}
+
+func TestDeliverOffline(t *testing.T) {
+	dev := NewDevice("TOKEN")
+	s := NewServer("PROJECT", "AUTH", dev, 0)
+	defer s.Close()
+	dev.shell("svc wifi disable")
+	dev.shell("svc data disable")
+
+	send(t, s, "AUTH", `{"message": {"data": {"sendTime": "1", "type": "2"}, "token": "TOKEN", "android": {"collapse_key": "KEY"}}}`)
+	send(t, s, "AUTH", `{"message": {"data": {"sendTime": "2", "type": "2"}, "token": "TOKEN", "android": {"collapse_key": "KEY"}}}`)
+	send(t, s, "AUTH", `{"message": {"data": {"sendTime": "3", "type": "0"}, "token": "TOKEN", "android": {"ttl": "0s"}}}`)
+	time.Sleep(10 * time.Millisecond)
+	if dev.Receipts() != 0 {
+		t.Log("TestDeliverOffline: message delivered to offline device")
+		t.Fail()
+	}
+	dev.shell("svc data enable")
+
+	if dev.Receipts() != 1 {
+		t.Logf("TestDeliverOffline: incorrect number of receipts once online: actual: %d, expected: 1", dev.Receipts())
+		t.FailNow()
+	}
+	if _, ok := dev.readFile("logs/22.txt"); !ok {
+		t.Log("TestDeliverOffline: latest message with collapse key not delivered")
+		t.Fail()
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	s := NewServer("PROJECT", "AUTH", NewDevice("TOKEN"), 0)
+	defer s.Close()
+	tests := []struct {
+		auth     string
+		body     string
+		expected int
+	}{
+		{"WRONG_AUTH", testMessage, http.StatusUnauthorized},
+		{"AUTH", "INVALID_JSON", http.StatusBadRequest},
+		{"AUTH", `{"message": {"data": {"sendTime": 1}, "token": "TOKEN"}}`, http.StatusBadRequest},
+		{"AUTH", `{"message": {"data": {}}}`, http.StatusBadRequest},
+		{"AUTH", `{"message": {"token": "OTHER_TOKEN"}}`, http.StatusNotFound},
+		{"AUTH", `{"message": {"token": "TOKEN", "android": {"priority": "urgent"}}}`, http.StatusBadRequest},
+		{"AUTH", `{"message": {"token": "TOKEN", "android": {"ttl": "60"}}}`, http.StatusBadRequest},
+		{"AUTH", `{"message": {"token": "TOKEN", "data": {"padding": "` + strings.Repeat("x", 4090) + `"}}}`,
+			http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		res := send(t, s, tc.auth, tc.body)
+		if res.StatusCode != tc.expected {
+			t.Logf("TestInvalidRequests: incorrect status for %s: actual: %d, expected: %d", tc.body, res.StatusCode, tc.expected)
+			t.Fail()
+		}
+	}
+	if s.Accepted() != 0 {
+		t.Log("TestInvalidRequests: invalid request accepted")
+		t.Fail()
+	}
+}
+
+func TestLoss(t *testing.T) {
+	dev := NewDevice("TOKEN")
+	s := NewServer("PROJECT", "AUTH", dev, 0)
+	defer s.Close()
+	s.LossRate = 1
+
+	res := send(t, s, "AUTH", testMessage)
+	time.Sleep(10 * time.Millisecond)
+
+	if res.StatusCode != http.StatusOK || s.Accepted() != 1 {
+		t.Log("TestLoss: lost message not accepted")
+		t.Fail()
+	}
+	if dev.Receipts() != 0 {
+		t.Log("TestLoss: lost message delivered")
+		t.Fail()
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	s := NewServer("PROJECT", "AUTH", NewDevice("TOKEN"), 0)
+	defer s.Close()
+	s.FailNext(&Error{http.StatusServiceUnavailable, "UNAVAILABLE", "UNAVAILABLE", 1})
+
+	res := send(t, s, "AUTH", testMessage)
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") != "1" {
+		t.Logf("TestFailNext: injected error not returned: %d", res.StatusCode)
+		t.Fail()
+	}
+	res = send(t, s, "AUTH", testMessage)
+	if res.StatusCode != http.StatusOK {
+		t.Logf("TestFailNext: error returned after injected errors were exhausted: %d", res.StatusCode)
+		t.Fail()
+	}
+}
@@ -0,0 +1,305 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package logsink
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults for batching and spooling, used for settings that are not positive
+	DefaultLogBatchSize     = 100
+	DefaultLogFlushInterval = 5 * time.Second
+	DefaultLogRetries       = 3
+	DefaultLogSpoolSize     = 100 << 20
+	// Backoff before the first retry of a failed write, doubled for each retry
+	defaultLogBackoff = 1 * time.Second
+	// Entries held in memory for each sink, beyond which further entries are spooled directly
+	logQueueSize = 10000
+)
+
+// Settings of a batched sink. Settings that are not positive take their defaults
+type BatchConfig struct {
+	BatchSize int           // Entries written to the sink at once
+	Interval  time.Duration // Time after which entries are written even if a batch has not filled
+	Retries   int           // Times a failed write is retried before its entries are spooled
+	MaxSpool  int64         // Maximum size in bytes of the spool, beyond which further entries are dropped
+}
+
+// Writes entries to a sink in batches on its own goroutine, so that slow or failing sinks do not delay the caller.
+// Batches are written once they fill or the flush interval passes. A failed write is retried with exponential
+// backoff, resending only the entries the sink did not write, after which those entries are appended to a spool file
+// on disk. The spool is replayed, oldest entries first, before each batch is written, and new entries are spooled
+// after it while it cannot be replayed. It is left in place across restarts so that it is replayed by the next run
+type BatchedSink struct {
+	sink      Sink
+	spool     string // Path of the spool file
+	batchSize int
+	interval  time.Duration
+	retries   int
+	backoff   time.Duration
+	maxSpool  int64
+	entries   chan []byte
+	done      chan struct{}
+	closed    bool
+	lock      sync.Mutex // Guards closed and sends on entries
+	spoolLock sync.Mutex
+	// Sink to which batches that fail are also written before they are spooled, if set
+	report Sink
+}
+
+// Start writing to the sink in batches, spooling to the given path. Batches that fail are also written to report
+// before they are spooled, if it is not nil
+func NewBatchedSink(sink Sink, report Sink, spool string, cfg BatchConfig) *BatchedSink {
+	b := &BatchedSink{sink: sink, report: report, spool: spool, batchSize: cfg.BatchSize, interval: cfg.Interval,
+		retries: cfg.Retries, backoff: defaultLogBackoff, maxSpool: cfg.MaxSpool,
+		entries: make(chan []byte, logQueueSize), done: make(chan struct{})}
+	if b.batchSize <= 0 {
+		b.batchSize = DefaultLogBatchSize
+	}
+	if b.interval <= 0 {
+		b.interval = DefaultLogFlushInterval
+	}
+	if b.retries <= 0 {
+		b.retries = DefaultLogRetries
+	}
+	if b.maxSpool <= 0 {
+		b.maxSpool = DefaultLogSpoolSize
+	}
+	go b.run()
+	return b
+}
+
+// Sink to which entries are written
+func (b *BatchedSink) Sink() Sink {
+	return b.sink
+}
+
+// Sink to which failed batches are reported, or nil
+func (b *BatchedSink) Report() Sink {
+	return b.report
+}
+
+// Queue entries to be written. Entries that do not fit in the queue are spooled, and entries written after the sink
+// is closed are written directly
+func (b *BatchedSink) Write(entries [][]byte) error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return b.sink.Write(entries)
+	}
+	var overflow [][]byte
+	for _, e := range entries {
+		select {
+		case b.entries <- e:
+		default:
+			overflow = append(overflow, e)
+		}
+	}
+	b.lock.Unlock()
+	if len(overflow) > 0 {
+		b.spoolEntries(overflow)
+	}
+	return nil
+}
+
+// Write the entries that are queued, then close the sink. Entries that cannot be written remain in the spool
+func (b *BatchedSink) Close() error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.entries)
+	b.lock.Unlock()
+	<-b.done
+	return b.sink.Close()
+}
+
+func (b *BatchedSink) run() {
+	defer close(b.done)
+	tick := time.NewTicker(b.interval)
+	defer tick.Stop()
+	var batch [][]byte
+	for {
+		select {
+		case e, ok := <-b.entries:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= b.batchSize {
+				b.flush(batch)
+				batch = nil
+			}
+		case <-tick.C:
+			b.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// Replay the spool, then write a batch, spooling the entries that could not be written
+func (b *BatchedSink) flush(batch [][]byte) {
+	err := b.replay()
+	if len(batch) == 0 {
+		return
+	}
+	if err == nil {
+		// Entries are only written directly once the spool, which holds older entries, is empty
+		batch, err = b.send(batch)
+		if err == nil {
+			return
+		}
+	}
+	log.Printf("Unable to write logs, spooling %d entries: %v", len(batch), err)
+	if b.report != nil {
+		err = b.report.Write(batch)
+		if err != nil {
+			log.Printf("Unable to report logs: %v", err)
+		}
+	}
+	b.spoolEntries(batch)
+}
+
+// Write a batch to the sink, retrying with exponential backoff. Returns the entries that were not written
+func (b *BatchedSink) send(batch [][]byte) ([][]byte, error) {
+	backoff := b.backoff
+	for i := 0; ; i++ {
+		err := b.sink.Write(batch)
+		if err == nil {
+			return nil, nil
+		}
+		batch = batch[WrittenBefore(err):]
+		if i >= b.retries {
+			return batch, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Append entries to the spool, dropping those that would grow it beyond its maximum size
+func (b *BatchedSink) spoolEntries(entries [][]byte) {
+	b.spoolLock.Lock()
+	defer b.spoolLock.Unlock()
+	err := os.MkdirAll(filepath.Dir(b.spool), 0755)
+	if err != nil {
+		log.Printf("Unable to spool logs, dropping %d entries: %v", len(entries), err)
+		return
+	}
+	f, err := os.OpenFile(b.spool, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Unable to spool logs, dropping %d entries: %v", len(entries), err)
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		log.Printf("Unable to spool logs, dropping %d entries: %v", len(entries), err)
+		return
+	}
+	size := st.Size()
+	w := bufio.NewWriter(f)
+	dropped := 0
+	for _, e := range entries {
+		if size+int64(len(e))+1 > b.maxSpool {
+			dropped++
+			continue
+		}
+		w.Write(e)
+		w.WriteByte('\n')
+		size += int64(len(e)) + 1
+	}
+	err = w.Flush()
+	if err != nil {
+		log.Printf("Unable to spool logs: %v", err)
+	}
+	if dropped > 0 {
+		log.Printf("Log spool %s full, dropping %d entries", b.spool, dropped)
+	}
+}
+
+// Write the spooled entries to the sink in batches, removing the spool once all are written. If a batch fails, the
+// entries the sink did not write are kept for the next replay. Returns an error if entries remain in the spool
+func (b *BatchedSink) replay() error {
+	b.spoolLock.Lock()
+	defer b.spoolLock.Unlock()
+	f, err := os.Open(b.spool)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries [][]byte
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, int(b.maxSpool))
+	for sc.Scan() {
+		entries = append(entries, append([]byte(nil), sc.Bytes()...))
+	}
+	f.Close()
+	for len(entries) > 0 {
+		n := b.batchSize
+		if n > len(entries) {
+			n = len(entries)
+		}
+		err = b.sink.Write(entries[:n])
+		if err != nil {
+			entries = entries[WrittenBefore(err):]
+			break
+		}
+		entries = entries[n:]
+	}
+	if len(entries) == 0 {
+		os.Remove(b.spool)
+		return nil
+	}
+	werr := rewriteSpool(b.spool, entries)
+	if werr != nil {
+		log.Printf("Unable to rewrite log spool %s: %v", b.spool, werr)
+	}
+	return err
+}
+
+// Replace the spool with the given entries, atomically so that a crash does not lose them
+func rewriteSpool(path string, entries [][]byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range entries {
+		w.Write(e)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
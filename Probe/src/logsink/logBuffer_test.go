@@ -0,0 +1,237 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package logsink
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Sink that records the batches written to it, failing while failing is set. If partial is set, the next write
+// writes only that many entries before failing
+type fakeSink struct {
+	batches [][]string
+	failing bool
+	partial int
+	writes  int
+	lock    sync.Mutex
+}
+
+func (f *fakeSink) Write(entries [][]byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.writes++
+	if f.failing {
+		return errors.New("sink unavailable")
+	}
+	var err error
+	if f.partial > 0 && f.partial < len(entries) {
+		entries = entries[:f.partial]
+		err = PartialWrite(f.partial, errors.New("sink interrupted"))
+		f.partial = 0
+	}
+	var batch []string
+	for _, e := range entries {
+		batch = append(batch, string(e))
+	}
+	f.batches = append(f.batches, batch)
+	return err
+}
+
+func (f *fakeSink) Close() error {
+	return nil
+}
+
+func (f *fakeSink) written() [][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.batches
+}
+
+// Start a batched sink with a short backoff and a spool in a new directory, removed by the returned function
+func startBatchedSink(t *testing.T, sink Sink, batchSize int, maxSpool int64) (*BatchedSink, func()) {
+	dir, err := ioutil.TempDir("", "logBuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &BatchedSink{sink: sink, spool: filepath.Join(dir, "spool", "probes-0.spool"), batchSize: batchSize,
+		interval: time.Hour, retries: 1, backoff: time.Millisecond, maxSpool: maxSpool,
+		entries: make(chan []byte, logQueueSize), done: make(chan struct{})}
+	go b.run()
+	return b, func() { os.RemoveAll(dir) }
+}
+
+func TestBatchedSink(t *testing.T) {
+	fs := new(fakeSink)
+	b, cleanup := startBatchedSink(t, fs, 2, DefaultLogSpoolSize)
+	defer cleanup()
+
+	b.Write([][]byte{[]byte("1"), []byte("2"), []byte("3")})
+	for start := time.Now(); len(fs.written()) == 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	if w := fs.written(); len(w) != 1 || strings.Join(w[0], ",") != "1,2" {
+		t.Logf("TestBatchedSink: full batch not written: %v", w)
+		t.Fail()
+	}
+	b.Close()
+
+	if w := fs.written(); len(w) != 2 || strings.Join(w[1], ",") != "3" {
+		t.Logf("TestBatchedSink: queued entries not flushed on close: %v", w)
+		t.Fail()
+	}
+}
+
+func TestBatchedSinkSpool(t *testing.T) {
+	fs := &fakeSink{failing: true}
+	b, cleanup := startBatchedSink(t, fs, 10, DefaultLogSpoolSize)
+	defer cleanup()
+
+	b.Write([][]byte{[]byte("1"), []byte("2")})
+	b.Close()
+
+	if fs.writes != 2 {
+		t.Logf("TestBatchedSinkSpool: failed write not retried: %d writes", fs.writes)
+		t.Fail()
+	}
+	c, err := ioutil.ReadFile(b.spool)
+	if err != nil || string(c) != "1\n2\n" {
+		t.Logf("TestBatchedSinkSpool: failed batch not spooled: %q %v", c, err)
+		t.FailNow()
+	}
+
+	// The next run replays the spool before writing new entries once the sink recovers
+	fs.failing = false
+	next := &BatchedSink{sink: fs, spool: b.spool, batchSize: 10, interval: time.Hour, backoff: time.Millisecond,
+		maxSpool: DefaultLogSpoolSize, entries: make(chan []byte, logQueueSize), done: make(chan struct{})}
+	go next.run()
+	next.Write([][]byte{[]byte("3")})
+	next.Close()
+
+	if w := fs.written(); len(w) != 2 || strings.Join(w[0], ",") != "1,2" || strings.Join(w[1], ",") != "3" {
+		t.Logf("TestBatchedSinkSpool: spool not replayed after recovery: %v", w)
+		t.Fail()
+	}
+	if _, err := os.Stat(b.spool); !os.IsNotExist(err) {
+		t.Log("TestBatchedSinkSpool: spool not removed after replay")
+		t.Fail()
+	}
+}
+
+func TestBatchedSinkPartialWrite(t *testing.T) {
+	fs := &fakeSink{partial: 1}
+	b, cleanup := startBatchedSink(t, fs, 10, DefaultLogSpoolSize)
+	defer cleanup()
+
+	b.Write([][]byte{[]byte("1"), []byte("2"), []byte("3")})
+	b.Close()
+
+	if w := fs.written(); len(w) != 2 || strings.Join(w[0], ",") != "1" || strings.Join(w[1], ",") != "2,3" {
+		t.Logf("TestBatchedSinkPartialWrite: written entries not excluded from retry: %v", w)
+		t.Fail()
+	}
+}
+
+func TestBatchedSinkSpoolBehind(t *testing.T) {
+	fs := new(fakeSink)
+	b, cleanup := startBatchedSink(t, fs, 10, DefaultLogSpoolSize)
+	defer cleanup()
+	b.spoolEntries([][]byte{[]byte("1")})
+	fs.failing = true
+
+	b.flush([][]byte{[]byte("2")})
+	fs.failing = false
+	b.Close()
+
+	if w := fs.written(); len(w) != 1 || strings.Join(w[0], ",") != "1,2" {
+		t.Logf("TestBatchedSinkSpoolBehind: new entries not spooled after older ones: %v", w)
+		t.Fail()
+	}
+}
+
+func TestBatchedSinkReport(t *testing.T) {
+	fs := &fakeSink{failing: true}
+	report := new(fakeSink)
+	b, cleanup := startBatchedSink(t, fs, 10, DefaultLogSpoolSize)
+	defer cleanup()
+	b.report = report
+
+	b.Write([][]byte{[]byte("1"), []byte("2")})
+	b.Close()
+
+	if w := report.written(); len(w) != 1 || strings.Join(w[0], ",") != "1,2" {
+		t.Logf("TestBatchedSinkReport: failed batch not reported: %v", w)
+		t.Fail()
+	}
+	c, _ := ioutil.ReadFile(b.spool)
+	if string(c) != "1\n2\n" {
+		t.Logf("TestBatchedSinkReport: reported batch not spooled: %q", c)
+		t.Fail()
+	}
+}
+
+func TestBatchedSinkSpoolFull(t *testing.T) {
+	fs := &fakeSink{failing: true}
+	b, cleanup := startBatchedSink(t, fs, 10, 4)
+	defer cleanup()
+
+	b.Write([][]byte{[]byte("1"), []byte("2"), []byte("3")})
+	b.Close()
+
+	c, _ := ioutil.ReadFile(b.spool)
+	if string(c) != "1\n2\n" {
+		t.Logf("TestBatchedSinkSpoolFull: spool grew beyond its maximum size: %q", c)
+		t.Fail()
+	}
+}
+
+func TestBatchedSinkReplayFailure(t *testing.T) {
+	fs := new(fakeSink)
+	b, cleanup := startBatchedSink(t, fs, 2, DefaultLogSpoolSize)
+	defer cleanup()
+	b.spoolEntries([][]byte{[]byte("1"), []byte("2"), []byte("3")})
+	fs.failing = true
+
+	b.replay()
+	b.Close()
+
+	c, _ := ioutil.ReadFile(b.spool)
+	if string(c) != "1\n2\n3\n" {
+		t.Logf("TestBatchedSinkReplayFailure: spooled entries lost on failed replay: %q", c)
+		t.Fail()
+	}
+}
+
+func TestBatchedSinkClosed(t *testing.T) {
+	fs := new(fakeSink)
+	b, cleanup := startBatchedSink(t, fs, 10, DefaultLogSpoolSize)
+	defer cleanup()
+	b.Close()
+
+	err := b.Write([][]byte{[]byte("1")})
+
+	if w := fs.written(); err != nil || len(w) != 1 {
+		t.Logf("TestBatchedSinkClosed: entry written after closing not written directly: %v %v", w, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,261 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package logsink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+const (
+	// Defaults for FILE sinks
+	DefaultMaxLogSize  = 100 << 20
+	DefaultMaxLogAge   = 24 * 60 * 60 // Seconds
+	DefaultMaxLogFiles = 5
+	// Timeout of each write to an HTTP endpoint
+	SinkTimeout = 30 * time.Second
+)
+
+// Destination to which logs are written. Each entry is a JSON object. Entries are written in order, and a sink that
+// fails after writing some of them returns a *PartialWriteError, so that only the rest are written again
+type Sink interface {
+	Write(entries [][]byte) error
+	Close() error
+}
+
+// Error from a sink that wrote the first entries of a batch before failing
+type PartialWriteError struct {
+	Written int
+	Err     error
+}
+
+func (p *PartialWriteError) Error() string {
+	return fmt.Sprintf("wrote %d entries before failing: %v", p.Written, p.Err)
+}
+
+// Error from a sink that failed after writing n entries
+func PartialWrite(n int, err error) error {
+	if n == 0 {
+		return err
+	}
+	return &PartialWriteError{n, err}
+}
+
+// Number of entries a sink wrote before the write failed with err
+func WrittenBefore(err error) int {
+	if p, ok := err.(*PartialWriteError); ok {
+		return p.Written
+	}
+	return 0
+}
+
+// Copy of an entry terminated with a newline. Entries are shared between sinks writing on separate goroutines, so a
+// newline is never appended in place
+func line(e []byte) []byte {
+	l := make([]byte, len(e)+1)
+	copy(l, e)
+	l[len(e)] = '\n'
+	return l
+}
+
+// Writes each entry to Cloud Logging with the gcloud CLI
+type GcloudSink struct {
+	Maker utils.CommandMaker
+	Dest  string
+}
+
+func (g *GcloudSink) Write(entries [][]byte) error {
+	for i, e := range entries {
+		err := g.Maker.Command("gcloud", "logging", "write", "--payload-type=json", g.Dest, string(e)).Run()
+		if err != nil {
+			return PartialWrite(i, err)
+		}
+	}
+	return nil
+}
+
+func (g *GcloudSink) Close() error {
+	return nil
+}
+
+// Writes entries as JSON lines
+type WriterSink struct {
+	W io.Writer
+}
+
+func (s *WriterSink) Write(entries [][]byte) error {
+	for i, e := range entries {
+		_, err := s.W.Write(line(e))
+		if err != nil {
+			return PartialWrite(i, err)
+		}
+	}
+	return nil
+}
+
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// Writes entries as JSON lines to a file, which is rotated once it reaches its maximum size or age. Rotated files are
+// renamed with increasing numeric suffixes, i.e. probe.log.1, the oldest of which is removed beyond the maximum number
+type FileSink struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	file     *os.File
+	size     int64
+	opened   time.Time // Time at which the current file was started
+}
+
+// Open a file sink at path. Maximums that are not positive are replaced with their defaults
+func NewFileSink(path string, maxSize int64, maxAge time.Duration, maxFiles int) (*FileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("NewFileSink: FILE sink without a path")
+	}
+	ret := &FileSink{path: path, maxSize: maxSize, maxAge: maxAge, maxFiles: maxFiles}
+	if ret.maxSize <= 0 {
+		ret.maxSize = DefaultMaxLogSize
+	}
+	if ret.maxAge <= 0 {
+		ret.maxAge = DefaultMaxLogAge * time.Second
+	}
+	if ret.maxFiles <= 0 {
+		ret.maxFiles = DefaultMaxLogFiles
+	}
+	return ret, ret.open()
+}
+
+// Open the file for appending, continuing an existing file
+func (f *FileSink) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = st.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *FileSink) Write(entries [][]byte) error {
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return err
+		}
+	}
+	for i, e := range entries {
+		l := line(e)
+		if f.size > 0 && (f.size+int64(len(l)) > f.maxSize || time.Since(f.opened) >= f.maxAge) {
+			err := f.rotate()
+			if err != nil {
+				return PartialWrite(i, err)
+			}
+		}
+		n, err := f.file.Write(l)
+		f.size += int64(n)
+		if err != nil {
+			return PartialWrite(i, err)
+		}
+	}
+	return nil
+}
+
+// Shift the rotated files up by one, replacing the oldest, move the current file to the first, and start a new file
+func (f *FileSink) rotate() error {
+	f.file.Close()
+	f.file = nil
+	for i := f.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := os.Rename(f.path, f.path+".1")
+	if err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *FileSink) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Posts entries to an HTTP endpoint as a JSON array
+type HttpSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewHttpSink(url string) (*HttpSink, error) {
+	if url == "" {
+		return nil, fmt.Errorf("NewHttpSink: HTTP sink without a URL")
+	}
+	return &HttpSink{url, &http.Client{Timeout: SinkTimeout}}, nil
+}
+
+func (h *HttpSink) Write(entries [][]byte) error {
+	body := append([]byte{'['}, bytes.Join(entries, []byte{','})...)
+	return PostJson(h.client, h.url, "", append(body, ']'))
+}
+
+func (h *HttpSink) Close() error {
+	return nil
+}
+
+// Post a JSON body, with a bearer token if auth is not empty, returning an error unless the response is successful
+func PostJson(client *http.Client, url string, auth string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	rb, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("PostJson: %s returned %d: %s", url, res.StatusCode, strings.TrimSpace(string(rb)))
+	}
+	return nil
+}
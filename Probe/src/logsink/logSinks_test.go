@@ -0,0 +1,146 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package logsink
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+func TestGcloudSinkPartialWrite(t *testing.T) {
+	s := &GcloudSink{utils.NewFakeCommandMaker([]string{"", "ERROR"}, []bool{false, true}, false), "DEST"}
+
+	err := s.Write([][]byte{[]byte(`"first"`), []byte(`"second"`), []byte(`"third"`)})
+
+	if err == nil || WrittenBefore(err) != 1 {
+		t.Logf("TestGcloudSinkPartialWrite: incorrect entries written before failure: %d %v", WrittenBefore(err), err)
+		t.Fail()
+	}
+}
+
+func TestWriterSinkShared(t *testing.T) {
+	b := new(bytes.Buffer)
+	// An entry with spare capacity, as when it is shared with other sinks
+	e := append(make([]byte, 0, 10), `"first"`...)
+
+	err := (&WriterSink{b}).Write([][]byte{e})
+
+	if err != nil || b.String() != "\"first\"\n" || e[:cap(e)][len(e)] != 0 {
+		t.Logf("TestWriterSinkShared: entry modified while written: %q %v", e[:cap(e)], err)
+		t.Fail()
+	}
+}
+
+func TestFileSinkRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileSink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "probe.log")
+	// Each entry fills a file, so that every later entry rotates it
+	fs, err := NewFileSink(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	for _, e := range []string{`"first"`, `"second"`, `"third"`, `"fourth"`} {
+		err = fs.Write([][]byte{[]byte(e)})
+		if err != nil {
+			t.Logf("TestFileSinkRotate: error on valid write: %v", err)
+			t.FailNow()
+		}
+	}
+
+	for suffix, expected := range map[string]string{"": `"fourth"`, ".1": `"third"`, ".2": `"second"`} {
+		b, err := ioutil.ReadFile(path + suffix)
+		if err != nil || string(b) != expected+"\n" {
+			t.Logf("TestFileSinkRotate: incorrect contents of probe.log%s: %q %v", suffix, b, err)
+			t.Fail()
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Log("TestFileSinkRotate: more rotated files kept than the maximum")
+		t.Fail()
+	}
+}
+
+func TestFileSinkRotateAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileSink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "probe.log")
+	fs, err := NewFileSink(path, 0, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	fs.Write([][]byte{[]byte(`"old"`)})
+	fs.opened = time.Now().Add(-time.Minute)
+
+	fs.Write([][]byte{[]byte(`"new"`)})
+
+	b, _ := ioutil.ReadFile(path + ".1")
+	if string(b) != "\"old\"\n" {
+		t.Logf("TestFileSinkRotateAge: file not rotated after its maximum age: %q", b)
+		t.Fail()
+	}
+}
+
+func TestHttpSink(t *testing.T) {
+	var got []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+	s, _ := NewHttpSink(srv.URL)
+
+	err := s.Write([][]byte{[]byte(`{"state":"resolved"}`), []byte(`{"state":"late"}`)})
+
+	if err != nil || len(got) != 2 || got[1]["state"] != "late" {
+		t.Logf("TestHttpSink: entries not posted as an array: %v %v", got, err)
+		t.Fail()
+	}
+}
+
+func TestHttpSinkError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	s, _ := NewHttpSink(srv.URL)
+
+	err := s.Write([][]byte{[]byte(`{}`)})
+
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Logf("TestHttpSinkError: incorrect error on failed write: %v", err)
+		t.Fail()
+	}
+}
@@ -17,13 +17,60 @@
 package main
 
 import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
 	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/probe"
 	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+	"github.com/golang/protobuf/proto"
 )
 
 func main() {
+	cf := flag.String("config", "", "text file in which a StandaloneConfig protobuf is located. "+
+		"If provided, probes run without a controller or GCP metadata server")
+	host := flag.String("hostname", "", "name identifying this machine in standalone mode, defaults to the OS hostname")
+	region := flag.String("region", "", "region logged with probes in standalone mode, defaults to the hostname")
+	sink := flag.String("log", "cloud", "destination of probe and error logs in standalone mode: cloud or stdout")
+	flag.Parse()
+
 	m := new(utils.CmdMaker)
 	c := new(utils.ProbeClock)
-	l := new(probe.CloudLogger)
-	probe.Control(m, c, l)
+	if *cf == "" {
+		l := new(probe.CloudLogger)
+		probe.Control(m, c, l)
+		return
+	}
+
+	b, err := ioutil.ReadFile(*cf)
+	if err != nil {
+		log.Fatalf("Main: could not read from specified config file: %s", err.Error())
+	}
+	cfg := new(controller.StandaloneConfig)
+	err = proto.UnmarshalText(string(b), cfg)
+	if err != nil {
+		log.Fatalf("Main: invalid configuration: %s", err.Error())
+	}
+	if *host == "" {
+		*host, err = os.Hostname()
+		if err != nil {
+			log.Fatalf("Main: unable to determine hostname: %s", err.Error())
+		}
+	}
+	if *region == "" {
+		*region = *host
+	}
+
+	var l probe.Logger
+	switch *sink {
+	case "cloud":
+		l = probe.NewCloudLogger()
+	case "stdout":
+		l = new(probe.StdoutLogger)
+	default:
+		log.Fatalf("Main: unsupported log destination: %s", *sink)
+	}
+	probe.ControlStandalone(m, c, l, cfg, *host, *region)
 }
@@ -18,123 +18,254 @@ package probe
 
 import (
 	"errors"
+	"fmt"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/adb"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
 )
 
-func findDevice() (string, error) {
-	// Assumes the first AVD on the list is the one to be used
-	out, err := maker.Command("emulator", "-list-avds").Output()
+const (
+	subscribeRetries       = 60
+	subscribeRetryInterval = 1 * time.Second
+	// Console port of the first emulator. Each emulator uses a console port and the adb port after it, so further
+	// emulators use successive even ports
+	firstEmulatorPort = 5554
+	appPackage        = "com.google.firebase.messaging.testing.fcmexternalprobertarget"
+	// Directory of the app's external storage, in which it writes its token and receipts
+	appFilesDir = "/sdcard/Android/data/" + appPackage + "/files/"
+	// Returned in place of the contents of a file the app has not written
+	notFound = "nf"
+)
+
+// Names FCM accepts for topics, which are also safe to pass to the device's shell and use in file names
+var topicPattern = regexp.MustCompile(`^[a-zA-Z0-9-_.~%]+$`)
+
+// An emulator running the target app, addressed by its serial through adb
+type emulator struct {
+	serial      string
+	avd         string
+	port        int
+	shared      bool             // Whether other emulators run the same AVD, in which case it is started read-only
+	token       string           // Registration token of the app on the emulator
+	clocks      []*clockEstimate // Recent estimates of the emulator's clock offset, oldest first
+	clockReset  int              // Version of the last estimate discarded when the emulator was restarted
+	unavailable bool             // Set while the emulator is being recovered by the watchdog
+	offline     bool             // Set while a COLLAPSE probe holds the device offline
+	outages     int              // Number of times the emulator has become unavailable or been taken offline
+	listener    *receiptListener // Listener to which the app pushes receipts, if one was started
+	forwarded   bool             // Whether the app's receipt port is forwarded to the listener
+	listed      time.Time        // Time at which receipt files were last listed. Accessed only by the resolver
+	topics      []string         // Topics to which the app is subscribed for TOPIC probes, set before probing starts
+	lock        sync.Mutex
+}
+
+func newEmulator(i int, avd string) *emulator {
+	port := firstEmulatorPort + 2*i
+	return &emulator{serial: fmt.Sprintf("emulator-%d", port), avd: avd, port: port}
+}
+
+// Registration token of the app, which changes if the app is reinstalled
+func (e *emulator) registration() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.token
+}
+
+// Run an adb command on the VM. Used only for operations the adb server does not provide, such as installing apps
+func (e *emulator) adb(arg ...string) utils.CommandRunner {
+	return maker.Command("adb", append([]string{"-s", e.serial}, arg...)...)
+}
+
+func (e *emulator) shell(cmd string) (string, error) {
+	return bridge.Shell(e.serial, cmd)
+}
+
+// Read a file from the app's external storage, or notFound if it does not exist
+func (e *emulator) readFile(name string) (string, error) {
+	b, err := bridge.Pull(e.serial, appFilesDir+name)
+	if os.IsNotExist(err) {
+		return notFound, nil
+	}
 	if err != nil {
 		return "", err
 	}
-	dev := strings.Split(string(out), "\n")
-	return dev[0], nil
+	return string(b), nil
 }
 
-func startEmulator() error {
-	dev, err := findDevice()
-	if err != nil {
-		return err
+// Read and delete a file from the app's external storage, or return notFound if it does not exist
+func (e *emulator) receive(name string) (string, error) {
+	c, err := e.readFile(name)
+	if err != nil || c == notFound {
+		return c, err
 	}
-	err = maker.Command("emulator", "-avd", dev, "-no-snapshot", "-no-window", "-no-audio", "-delay-adb").Start()
+	return c, bridge.Remove(e.serial, appFilesDir+name)
+}
+
+// List the AVDs available on the VM
+func findDevices() ([]string, error) {
+	out, err := maker.Command("emulator", "-list-avds").Output()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = maker.Command("adb", "wait-for-device").Run()
+	var ret []string
+	for _, d := range strings.Split(string(out), "\n") {
+		if d != "" {
+			ret = append(ret, d)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("findDevices: no AVDs available")
+	}
+	return ret, nil
+}
+
+// Start n emulators on distinct ports, assigning the available AVDs to them in turn, and wait for all of them to be
+// reachable through adb
+func startEmulators(n int) ([]*emulator, error) {
+	avds, err := findDevices()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	var ret []*emulator
+	for i := 0; i < n; i++ {
+		e := newEmulator(i, avds[i%len(avds)])
+		e.shared = n > 1
+		err = e.start(e.shared)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, e)
+	}
+	for _, e := range ret {
+		err = e.adb("wait-for-device").Run()
+		if err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+// Start the emulator without waiting for it to boot. Emulators that share an AVD must not write to it
+func (e *emulator) start(shared bool) error {
+	arg := []string{"-avd", e.avd, "-port", strconv.Itoa(e.port)}
+	if shared {
+		arg = append(arg, "-read-only")
+	}
+	arg = append(arg, "-no-snapshot", "-no-window", "-no-audio", "-delay-adb")
+	return maker.Command("emulator", arg...).Start()
 }
 
-func startApp() error {
-	err := maker.Command("adb", "install",
-		"../../FCMExternalProberTarget/app/build/outputs/apk/debug/app-debug.apk").Run()
+func (e *emulator) startApp() error {
+	// Replace any existing installation, so that the app can be reinstalled during recovery
+	err := e.adb("install", "-r", "../../FCMExternalProberTarget/app/build/outputs/apk/debug/app-debug.apk").Run()
 	if err != nil {
 		return err
 	}
-	err = maker.Command("adb", "shell", "am", "start", "-n",
-		"com.google.firebase.messaging.testing.fcmexternalprobertarget/"+
-			"com.google.firebase.messaging.testing.fcmexternalprobertarget.MainActivity").Run()
+	_, err = e.shell("am start -n " + appPackage + "/" + appPackage + ".MainActivity")
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func getToken() (string, error) {
+func (e *emulator) getToken() (string, error) {
 	for i := 0; i < int(metadata.GetTokenRetries()); i++ {
-		tok, err := maker.Command("bash", "receive", "token.txt").Output()
+		// The token is left in place, so that it can be read again after the app is relaunched
+		tok, err := e.readFile("token.txt")
 		if err != nil {
 			return "", err
 		}
-		if string(tok) != "nf" {
-			return string(tok), nil
+		if tok != notFound {
+			return tok, nil
 		}
 		time.Sleep(10 * time.Second)
 	}
 	return "", errors.New("timed out on token generation")
 }
 
-func getMessage(fn string) (string, error) {
-	msg, err := maker.Command("bash", "receive", fn+".txt", "-p", "logs/").Output()
-	if err != nil {
-		return "", err
+// Read and remove a receipt, pushed by the app or written to a file, or return notFound if there is none
+func (e *emulator) getMessage(fn string) (string, error) {
+	if rt, ok := e.takePushed(fn); ok {
+		return rt, nil
 	}
-	return string(msg), nil
+	return e.receive(receiptDir + fn + ".txt")
 }
 
-func uninstallApp() error {
-	err := maker.Command("adb", "uninstall",
-		"com.google.firebase.messaging.testing.fcmexternalprobertarget").Run()
-	if err != nil {
-		return err
+// Remove a receipt without reading it
+func (e *emulator) discardReceipt(fn string) error {
+	if _, ok := e.takePushed(fn); ok {
+		return nil
 	}
-	return nil
+	return bridge.Remove(e.serial, appFilesDir+receiptDir+fn+".txt")
 }
 
-func killEmulator() error {
-	err := maker.Command("adb", "emu", "kill").Run()
-	if err != nil {
-		return err
-	}
-	return nil
+// List the receipts written by the app that have not yet been read
+func (e *emulator) listReceipts() ([]adb.Entry, error) {
+	return bridge.List(e.serial, appFilesDir+receiptDir)
 }
 
-func findTimeOffset() (int, error) {
-	cmd := maker.Command("adb", "shell", "echo $EPOCHREALTIME")
-	bef := clock.Now()
-	out, err := cmd.Output()
-	aft := clock.Now()
-
-	if err != nil {
-		return 0, err
+// Request that the app subscribe to a topic. Returns the time at which the request was made and the device time at
+// which the subscription completed
+func (e *emulator) subscribeTopic(topic string) (time.Time, string, error) {
+	start := clock.Now()
+	if !topicPattern.MatchString(topic) {
+		return start, "", errors.New("subscribeTopic: invalid topic name " + strconv.Quote(topic))
 	}
-	devt, err := convertTime(strings.TrimSuffix(string(out), "\n"))
+	_, err := e.shell("am broadcast -a " + appPackage + ".SUBSCRIBE -n " + appPackage + "/" + appPackage +
+		".SubscribeReceiver --es topic " + topic)
 	if err != nil {
-		return 0, err
+		return start, "", err
+	}
+	for i := 0; i < subscribeRetries; i++ {
+		res, err := e.receive("topics/" + topic + ".txt")
+		if err != nil {
+			return start, "", err
+		}
+		switch res {
+		case notFound:
+			time.Sleep(subscribeRetryInterval)
+		case "error":
+			return start, "", errors.New("subscribeTopic: app failed to subscribe to topic " + topic)
+		default:
+			return start, res, nil
+		}
 	}
-	// approximate VM time at the moment the command is run on the android device as half of the rtt
-	hrtt := aft.Sub(bef).Milliseconds() / 2
-	offs := aft.Sub(*devt).Milliseconds() - hrtt
-	return int(offs), nil
+	return start, "", errors.New("subscribeTopic: timed out on subscription to topic " + topic)
 }
 
-func convertTime(t string) (*time.Time, error) {
-	times := strings.Split(t, ".")
-	if len(times) != 2 {
-		return nil, errors.New("findTimeOffset: time returned from device formatted incorrectly")
+// Connect the device to or disconnect it from the network, by enabling or disabling both wifi and mobile data
+func (e *emulator) setOnline(online bool) error {
+	state := "disable"
+	if online {
+		state = "enable"
 	}
-	sec, err := strconv.ParseInt(times[0], 10, 64)
+	for _, iface := range []string{"wifi", "data"} {
+		_, err := e.shell("svc " + iface + " " + state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *emulator) uninstallApp() error {
+	_, err := e.shell("pm uninstall " + appPackage)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	micro, err := strconv.ParseInt(times[1], 10, 64)
+	return nil
+}
+
+func (e *emulator) kill() error {
+	err := e.adb("emu", "kill").Run()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	devt := time.Unix(sec, micro*1000)
-	return &devt, nil
+	return nil
 }
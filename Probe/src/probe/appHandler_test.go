@@ -20,55 +20,147 @@ import (
 	"testing"
 	"time"
 
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/adb"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/fakefcm"
 	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
 )
 
-func TestFindDevice(t *testing.T) {
-	maker = utils.NewFakeCommandMaker([]string{"TEST_DEVICE_1\nTEST_DEVICE_2\nTEST_DEVICE_3"}, []bool{false}, false)
+// Emulator on which probes under test run
+func newTestEmulator() *emulator {
+	e := newEmulator(0, "TEST_DEVICE")
+	e.token = "TEST_TOKEN"
+	return e
+}
+
+// Serve the devices through a fake adb server, as the first emulators on the VM
+func startFakeAdb(t *testing.T, devs ...*fakefcm.Device) *fakefcm.AdbServer {
+	s, err := fakefcm.NewAdbServer(fakefcm.NewEmulators(devs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge = adb.NewClient(s.Addr())
+	return s
+}
+
+func TestFindDevices(t *testing.T) {
+	maker = utils.NewFakeCommandMaker([]string{"TEST_DEVICE_1\nTEST_DEVICE_2\nTEST_DEVICE_3\n"}, []bool{false}, false)
 
-	str, err := findDevice()
+	devs, err := findDevices()
 
 	if err != nil {
-		t.Log("TestFindDevice: error on valid input")
+		t.Log("TestFindDevices: error on valid input")
+		t.FailNow()
+	}
+	if len(devs) != 3 || devs[0] != "TEST_DEVICE_1" || devs[2] != "TEST_DEVICE_3" {
+		t.Logf("TestFindDevices: incorrect devices found: %v", devs)
 		t.Fail()
 	}
-	if str != "TEST_DEVICE_1" {
-		t.Log("TestFindDevice: incorrect device found")
+}
+
+func TestFindDevicesNone(t *testing.T) {
+	maker = utils.NewFakeCommandMaker([]string{"\n"}, []bool{false}, false)
+
+	_, err := findDevices()
+
+	if err == nil {
+		t.Log("TestFindDevicesNone: no error when no AVDs are available")
 		t.Fail()
 	}
 }
 
-func TestConvertTimeExpected(t *testing.T) {
-	tim, err := convertTime("123.456000")
+func TestStartEmulators(t *testing.T) {
+	testMaker := utils.NewFakeCommandMaker([]string{"AVD_1\nAVD_2\n"}, []bool{false}, true)
+	maker = testMaker
+
+	ems, err := startEmulators(3)
+
 	if err != nil {
-		t.Logf("TestConvertTimeExpected: returned error on valid input: %v", err)
+		t.Logf("TestStartEmulators: error on valid input: %v", err)
 		t.FailNow()
 	}
-	expected := time.Unix(123, 456000000)
-	if !tim.Equal(expected) {
-		t.Logf("TestConvertTimeExpected: incorrect time returned: actual: %v, expected %v", tim, expected)
+	if len(ems) != 3 {
+		t.Logf("TestStartEmulators: incorrect number of emulators: actual: %d, expected: 3", len(ems))
 		t.FailNow()
 	}
+	if ems[1].serial != "emulator-5556" || ems[1].port != 5556 || ems[1].avd != "AVD_2" || ems[2].avd != "AVD_1" {
+		t.Logf("TestStartEmulators: emulator not assigned a distinct port and AVD: %+v", ems[1])
+		t.Fail()
+	}
 }
 
-func TestConvertTimeError(t *testing.T) {
-	_, err := convertTime("1.1.1.1")
-	if err == nil {
-		t.Logf("TestConvertTimeExpected: no error returned on invalid input")
+func TestGetMessage(t *testing.T) {
+	dev := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, dev).Close()
+	dev.WriteFile("logs/RECEIPT.txt", "1000")
+	e := newTestEmulator()
+
+	msg, err := e.getMessage("RECEIPT")
+
+	if err != nil || msg != "1000" {
+		t.Logf("TestGetMessage: incorrect receipt: %s, %v", msg, err)
+		t.FailNow()
+	}
+	if dev.Receipts() != 0 {
+		t.Log("TestGetMessage: receipt not removed from device")
+		t.Fail()
+	}
+	msg, err = e.getMessage("RECEIPT")
+	if err != nil || msg != notFound {
+		t.Logf("TestGetMessage: removed receipt read again: %s, %v", msg, err)
 		t.Fail()
 	}
 }
 
-func TestFindTimeOffset(t *testing.T) {
-	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0), time.Unix(1, 0)}, false)
-	maker = utils.NewFakeCommandMaker([]string{"000.500000"}, []bool{false}, false)
-	offset, err := findTimeOffset()
+func TestSubscribeTopic(t *testing.T) {
+	tTime := time.Unix(100, 0)
+	clock = utils.NewFakeClock([]time.Time{tTime}, false)
+	dev := fakefcm.NewDevice("TEST_TOKEN")
+	dev.Clock = utils.NewFakeClock([]time.Time{time.Unix(100, 500000000)}, true)
+	defer startFakeAdb(t, dev).Close()
+
+	start, rt, err := newTestEmulator().subscribeTopic("TOPIC")
+
 	if err != nil {
-		t.Logf("TestFindTimeOffset: error returned on valid input: %v", err)
+		t.Logf("TestSubscribeTopic: error returned on valid input: %v", err)
 		t.FailNow()
 	}
-	if offset != 0 {
-		t.Logf("TestFindTimeOffset: incorrect time offset: actual: %d, expected: 0", offset)
+	if !start.Equal(tTime) || rt != "100500" {
+		t.Logf("TestSubscribeTopic: incorrect subscription times: %v, %s", start, rt)
+		t.Fail()
+	}
+	if !dev.Subscribed("TOPIC") {
+		t.Log("TestSubscribeTopic: app not subscribed to topic")
+		t.Fail()
+	}
+}
+
+func TestSubscribeTopicError(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(100, 0)}, false)
+	dev := fakefcm.NewDevice("TEST_TOKEN")
+	dev.RejectTopic("TOPIC")
+	defer startFakeAdb(t, dev).Close()
+
+	_, _, err := newTestEmulator().subscribeTopic("TOPIC")
+
+	if err == nil {
+		t.Log("TestSubscribeTopicError: no error returned when app failed to subscribe")
+		t.Fail()
+	}
+}
+
+func TestSubscribeTopicInvalid(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(100, 0)}, false)
+	dev := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, dev).Close()
+
+	_, _, err := newTestEmulator().subscribeTopic("TOPIC; reboot")
+
+	if err == nil {
+		t.Log("TestSubscribeTopicInvalid: no error returned for topic outside FCM's topic pattern")
+		t.Fail()
+	}
+	if dev.Subscribed("TOPIC; reboot") {
+		t.Log("TestSubscribeTopicInvalid: app subscribed to invalid topic")
 		t.Fail()
 	}
 }
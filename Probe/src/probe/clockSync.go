@@ -0,0 +1,212 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Seconds between clock offset estimates, when not provided in metadata
+	defaultClockSyncInterval = 60
+	// Round trips sampled for each estimate, when not provided in metadata
+	defaultClockSyncSamples = 5
+	// Milliseconds by which the offset may change between estimates before results are flagged, when not provided in
+	// metadata
+	defaultDriftThreshold = 50
+	// Number of estimates kept for each emulator, so that receipts found long after they were written are still
+	// matched with the estimate in effect when the message was received
+	clockHistory = 32
+)
+
+// An estimate of the offset between the VM's clock and an emulator's
+type clockEstimate struct {
+	version     int   // Number of the estimate among the emulator's estimates, starting from 1
+	offset      int   // Milliseconds by which the VM's clock is ahead of the emulator's
+	uncertainty int   // Maximum error of the offset in milliseconds, half the round trip of the sample it was taken from
+	drift       int   // Change in offset in milliseconds since the previous estimate
+	devTime     int64 // Emulator time in milliseconds at which the estimate was taken
+}
+
+// A single round trip to read the emulator's clock
+type clockSample struct {
+	offset  int   // Milliseconds by which the VM's clock is ahead of the emulator's
+	rtt     int   // Round trip time of the sample in milliseconds
+	devTime int64 // Emulator time in milliseconds at which its clock was read
+}
+
+// Periodically re-estimate the clock offset of every available emulator, until stop is closed
+func syncClocks(stop chan struct{}, cwg *sync.WaitGroup) {
+	defer cwg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(getClockSyncInterval()):
+		}
+		for _, e := range emulators {
+			if !e.isAvailable() {
+				// The watchdog re-estimates the offset once the emulator recovers
+				continue
+			}
+			err := e.syncClock()
+			if err != nil {
+				logger.LogErrorf("syncClocks: unable to estimate clock offset of %s: %v", e.serial, err)
+			}
+		}
+	}
+}
+
+// Estimate the emulator's clock offset from several round trips, NTP style, keeping the sample with the shortest
+// round trip since it bounds the offset most tightly. The estimate is added to the emulator's history, and a change
+// in offset beyond the drift threshold since the previous estimate is logged
+func (e *emulator) syncClock() error {
+	var best *clockSample
+	var err error
+	for i := 0; i < getClockSyncSamples(); i++ {
+		var s *clockSample
+		s, err = e.sampleClock()
+		if err != nil {
+			continue
+		}
+		if best == nil || s.rtt < best.rtt {
+			best = s
+		}
+	}
+	if best == nil {
+		return err
+	}
+
+	e.lock.Lock()
+	est := &clockEstimate{version: 1, offset: best.offset, uncertainty: best.rtt / 2, devTime: best.devTime}
+	if n := len(e.clocks); n > 0 {
+		prev := e.clocks[n-1]
+		est.version = prev.version + 1
+		est.drift = est.offset - prev.offset
+	} else {
+		est.version = e.clockReset + 1
+	}
+	e.clocks = append(e.clocks, est)
+	if len(e.clocks) > clockHistory {
+		e.clocks = e.clocks[len(e.clocks)-clockHistory:]
+	}
+	e.lock.Unlock()
+
+	if est.drifted() {
+		logger.LogErrorf("syncClock: clock offset of %s changed by %d ms since the previous estimate", e.serial, est.drift)
+	}
+	return nil
+}
+
+// Discard the estimates of the emulator's clock, whose offsets no longer apply once the emulator is restarted, so
+// that the next estimate is not compared with them. Versions continue from the discarded estimates
+func (e *emulator) resetClock() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if n := len(e.clocks); n > 0 {
+		e.clockReset = e.clocks[n-1].version
+	}
+	e.clocks = nil
+}
+
+// Read the emulator's clock once, approximating the VM time at which it was read as the middle of the round trip
+func (e *emulator) sampleClock() (*clockSample, error) {
+	bef := clock.Now()
+	out, err := e.shell("echo $EPOCHREALTIME")
+	aft := clock.Now()
+
+	if err != nil {
+		return nil, err
+	}
+	devt, err := convertTime(strings.TrimSuffix(out, "\n"))
+	if err != nil {
+		return nil, err
+	}
+	rtt := aft.Sub(bef).Milliseconds()
+	offs := aft.Sub(*devt).Milliseconds() - rtt/2
+	return &clockSample{int(offs), int(rtt), devt.UnixNano() / 1000000}, nil
+}
+
+// Estimate in effect at emulator time rt in milliseconds, which is the latest taken at or before rt, or the earliest
+// kept if all were taken after it. Returns nil if the offset has not been estimated
+func (e *emulator) clockAt(rt int64) *clockEstimate {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.clocks) == 0 {
+		return nil
+	}
+	ret := e.clocks[0]
+	for _, c := range e.clocks[1:] {
+		if c.devTime > rt {
+			break
+		}
+		ret = c
+	}
+	return ret
+}
+
+// Whether the offset changed by more than the drift threshold since the previous estimate, in which case latencies
+// using the estimate may be off by up to the drift
+func (c *clockEstimate) drifted() bool {
+	d := c.drift
+	if d < 0 {
+		d = -d
+	}
+	return d > getDriftThreshold()
+}
+
+func convertTime(t string) (*time.Time, error) {
+	times := strings.Split(t, ".")
+	if len(times) != 2 {
+		return nil, errors.New("convertTime: time returned from device formatted incorrectly")
+	}
+	sec, err := strconv.ParseInt(times[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	micro, err := strconv.ParseInt(times[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	devt := time.Unix(sec, micro*1000)
+	return &devt, nil
+}
+
+func getClockSyncInterval() time.Duration {
+	if metadata.GetClockSyncInterval() <= 0 {
+		return defaultClockSyncInterval * time.Second
+	}
+	return time.Duration(metadata.GetClockSyncInterval()) * time.Second
+}
+
+func getClockSyncSamples() int {
+	if metadata.GetClockSyncSamples() <= 0 {
+		return defaultClockSyncSamples
+	}
+	return int(metadata.GetClockSyncSamples())
+}
+
+func getDriftThreshold() int {
+	if metadata.GetDriftThreshold() <= 0 {
+		return defaultDriftThreshold
+	}
+	return int(metadata.GetDriftThreshold())
+}
@@ -0,0 +1,166 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/fakefcm"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+func TestConvertTimeExpected(t *testing.T) {
+	tim, err := convertTime("123.456000")
+	if err != nil {
+		t.Logf("TestConvertTimeExpected: returned error on valid input: %v", err)
+		t.FailNow()
+	}
+	expected := time.Unix(123, 456000000)
+	if !tim.Equal(expected) {
+		t.Logf("TestConvertTimeExpected: incorrect time returned: actual: %v, expected %v", tim, expected)
+		t.FailNow()
+	}
+}
+
+func TestConvertTimeError(t *testing.T) {
+	_, err := convertTime("1.1.1.1")
+	if err == nil {
+		t.Logf("TestConvertTimeExpected: no error returned on invalid input")
+		t.Fail()
+	}
+}
+
+func TestSampleClock(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0), time.Unix(1, 0)}, false)
+	dev := fakefcm.NewDevice("TEST_TOKEN")
+	dev.Clock = utils.NewFakeClock([]time.Time{time.Unix(0, 500000000)}, true)
+	defer startFakeAdb(t, dev).Close()
+
+	s, err := newTestEmulator().sampleClock()
+
+	if err != nil {
+		t.Logf("TestSampleClock: error returned on valid input: %v", err)
+		t.FailNow()
+	}
+	if s.offset != 0 || s.rtt != 1000 || s.devTime != 500 {
+		t.Logf("TestSampleClock: incorrect sample: %+v", s)
+		t.Fail()
+	}
+}
+
+func TestSyncClock(t *testing.T) {
+	metadata = &controller.MetadataConfig{ClockSyncSamples: 3, DriftThreshold: 100}
+	fakeLogger := new(fakeLogger)
+	logger = fakeLogger
+	// Round trips of 400, 100 and 300 ms, with the device clock 1s behind the VM's
+	clock = utils.NewFakeClock([]time.Time{time.Unix(10, 0), time.Unix(10, 400000000),
+		time.Unix(20, 0), time.Unix(20, 100000000), time.Unix(30, 0), time.Unix(30, 300000000)}, false)
+	dev := fakefcm.NewDevice("TEST_TOKEN")
+	dev.Clock = utils.NewFakeClock([]time.Time{time.Unix(9, 0), time.Unix(19, 50000000), time.Unix(29, 0)}, false)
+	defer startFakeAdb(t, dev).Close()
+	e := newTestEmulator()
+	e.clocks = []*clockEstimate{{version: 1, offset: 800}}
+
+	err := e.syncClock()
+
+	if err != nil {
+		t.Logf("TestSyncClock: error returned on valid input: %v", err)
+		t.FailNow()
+	}
+	// The fastest round trip is used
+	est := e.clocks[len(e.clocks)-1]
+	if len(e.clocks) != 2 || est.version != 2 || est.offset != 1000 || est.uncertainty != 50 || est.drift != 200 {
+		t.Logf("TestSyncClock: incorrect estimate: %+v", est)
+		t.FailNow()
+	}
+	if !est.drifted() || len(fakeLogger.errLogs) != 1 {
+		t.Log("TestSyncClock: drift beyond threshold not flagged")
+		t.Fail()
+	}
+}
+
+func TestSyncClockError(t *testing.T) {
+	metadata = &controller.MetadataConfig{ClockSyncSamples: 2}
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	dev := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, dev).Close()
+	dev.Crash()
+	e := newTestEmulator()
+
+	err := e.syncClock()
+
+	if err == nil || len(e.clocks) != 0 {
+		t.Log("TestSyncClockError: no error returned for unreachable emulator")
+		t.Fail()
+	}
+}
+
+func TestSyncClockHistory(t *testing.T) {
+	metadata = &controller.MetadataConfig{ClockSyncSamples: 1}
+	logger = new(fakeLogger)
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	defer startFakeAdb(t, fakefcm.NewDevice("TEST_TOKEN")).Close()
+	e := newTestEmulator()
+
+	for i := 0; i < clockHistory+2; i++ {
+		e.syncClock()
+	}
+
+	if len(e.clocks) != clockHistory || e.clocks[0].version != 3 {
+		t.Logf("TestSyncClockHistory: history not bounded: %d estimates, oldest %d", len(e.clocks), e.clocks[0].version)
+		t.Fail()
+	}
+}
+
+func TestClockAt(t *testing.T) {
+	e := newTestEmulator()
+	if e.clockAt(1000) != nil {
+		t.Log("TestClockAt: estimate returned before clock was synchronized")
+		t.Fail()
+	}
+	e.clocks = []*clockEstimate{{version: 1, devTime: 1000}, {version: 2, devTime: 2000}, {version: 3, devTime: 3000}}
+
+	if e.clockAt(500).version != 1 || e.clockAt(2000).version != 2 || e.clockAt(2999).version != 2 ||
+		e.clockAt(5000).version != 3 {
+		t.Log("TestClockAt: incorrect estimate in effect")
+		t.Fail()
+	}
+}
+
+func TestSyncClocks(t *testing.T) {
+	metadata = &controller.MetadataConfig{ClockSyncSamples: 1, ClockSyncInterval: 1}
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	defer startFakeAdb(t, fakefcm.NewDevice("TEST_TOKEN")).Close()
+	e := newTestEmulator()
+	emulators = []*emulator{e}
+	stop := make(chan struct{})
+	cwg := new(sync.WaitGroup)
+	cwg.Add(1)
+
+	go syncClocks(stop, cwg)
+	time.Sleep(1500 * time.Millisecond)
+	close(stop)
+	cwg.Wait()
+
+	if len(e.clocks) != 1 {
+		t.Logf("TestSyncClocks: incorrect number of estimates: actual: %d, expected: 1", len(e.clocks))
+		t.Fail()
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/adb"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/fakefcm"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+// Run probes against a fake FCM server until the given number of messages have been sent
+func runFakeProbes(s *fakefcm.Server, cfg *controller.ProbeConfig, messages int) *fakeLogger {
+	return runFakeEmulators(s, fakefcm.NewEmulators(s.Device), 1, []*controller.ProbeConfig{cfg}, messages)
+}
+
+// Run probes on n of the given emulators, reached through a fake adb server, until the given number of messages have
+// been sent
+func runFakeEmulators(s *fakefcm.Server, em *fakefcm.Emulators, n int, cfgs []*controller.ProbeConfig,
+	messages int) *fakeLogger {
+	as, err := fakefcm.NewAdbServer(em)
+	if err != nil {
+		panic(err)
+	}
+	defer as.Close()
+	dir, err := ioutil.TempDir("", "endToEnd")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	bridge = adb.NewClient(as.Addr())
+	maker = em
+	clock = new(utils.ProbeClock)
+	fl := new(fakeLogger)
+	logger = fl
+	probing = true
+	emulatorCount = n
+	probeConfigs = &controller.ProbeConfigs{Probe: cfgs}
+	metadata = &controller.MetadataConfig{
+		Account:      &controller.AccountInfo{GcpProject: s.Project},
+		TokenRetries: 1,
+		FcmEndpoint:  s.URL(),
+		InflightLog:  filepath.Join(dir, "inflight.log"),
+	}
+	fcmAuth = Auth{Token: s.AuthToken, deadline: time.Now().Add(time.Hour)}
+	// Probes send without an interval, so responses are delayed to keep the send times, by which the app names
+	// receipts, distinct
+	s.ResponseDelay = 2 * time.Millisecond
+
+	runProbes(func() error {
+		for s.Sent() < messages {
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	})
+	return fl
+}
+
+func countStates(logs []testLog) map[string]int {
+	ret := make(map[string]int)
+	for _, l := range logs {
+		ret[l.state]++
+	}
+	return ret
+}
+
+func TestEndToEnd(t *testing.T) {
+	s := fakefcm.NewServer("PROJECT", "AUTH", fakefcm.NewDevice("DEVICE_TOKEN"), 0)
+	defer s.Close()
+	s.Latency = 5 * time.Millisecond
+
+	fl := runFakeProbes(s, &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED, ReceiveTimeout: 10}, 5)
+
+	st := countStates(fl.testLogs)
+	if st["resolved"] != s.Accepted() || len(fl.testLogs) != s.Accepted() {
+		t.Logf("TestEndToEnd: incorrect outcomes: %v, expected %d resolved", st, s.Accepted())
+		t.Fail()
+	}
+	for _, l := range fl.testLogs {
+		if l.token != "DEVICE_TOKEN" {
+			t.Logf("TestEndToEnd: incorrect token logged: actual: %s, expected: DEVICE_TOKEN", l.token)
+			t.Fail()
+		}
+	}
+}
+
+func TestEndToEndLoss(t *testing.T) {
+	s := fakefcm.NewServer("PROJECT", "AUTH", fakefcm.NewDevice("DEVICE_TOKEN"), 1)
+	defer s.Close()
+	s.LossRate = 0.5
+
+	fl := runFakeProbes(s, &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED, ReceiveTimeout: 1}, 10)
+
+	st := countStates(fl.testLogs)
+	if st["resolved"]+st["timeout"] != s.Accepted() || len(fl.testLogs) != s.Accepted() {
+		t.Logf("TestEndToEndLoss: incorrect outcomes: %v, expected %d in total", st, s.Accepted())
+		t.Fail()
+	}
+	if st["timeout"] == 0 || st["resolved"] == 0 {
+		t.Logf("TestEndToEndLoss: lost messages not timed out: %v", st)
+		t.Fail()
+	}
+}
+
+func TestEndToEndTopic(t *testing.T) {
+	s := fakefcm.NewServer("PROJECT", "AUTH", fakefcm.NewDevice("DEVICE_TOKEN"), 0)
+	defer s.Close()
+
+	fl := runFakeProbes(s, &controller.ProbeConfig{Type: controller.ProbeType_TOPIC, Topic: "TOPIC", ReceiveTimeout: 10}, 5)
+
+	if !s.Device.Subscribed("TOPIC") {
+		t.Log("TestEndToEndTopic: device not subscribed to probe topic")
+		t.FailNow()
+	}
+	st := countStates(fl.testLogs)
+	if st["subscribed"] != 1 {
+		t.Logf("TestEndToEndTopic: subscription not logged once: %v", st)
+		t.Fail()
+	}
+	if st["resolved"] != s.Accepted() {
+		t.Logf("TestEndToEndTopic: incorrect outcomes: %v, expected %d resolved", st, s.Accepted())
+		t.Fail()
+	}
+}
+
+func TestEndToEndCollapse(t *testing.T) {
+	s := fakefcm.NewServer("PROJECT", "AUTH", fakefcm.NewDevice("DEVICE_TOKEN"), 0)
+	defer s.Close()
+
+	fl := runFakeProbes(s, &controller.ProbeConfig{Type: controller.ProbeType_COLLAPSE, BurstSize: 3,
+		OfflineDuration: 1, ReceiveTimeout: 1}, 3)
+
+	if !s.Device.Online() {
+		t.Log("TestEndToEndCollapse: device not brought back online")
+		t.Fail()
+	}
+	st := countStates(fl.testLogs)
+	if st["pass"] != 1 || len(fl.testLogs) != 1 {
+		t.Logf("TestEndToEndCollapse: incorrect outcomes: %v, expected 1 pass", st)
+		t.Fail()
+	}
+}
+
+func TestEndToEndPayloadSizes(t *testing.T) {
+	s := fakefcm.NewServer("PROJECT", "AUTH", fakefcm.NewDevice("DEVICE_TOKEN"), 0)
+	defer s.Close()
+
+	fl := runFakeProbes(s, &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED, ReceiveTimeout: 10,
+		PayloadSizes: []int32{1000, 5000}}, 6)
+
+	for _, l := range fl.testLogs {
+		expected := "resolved"
+		if l.payloadSize == 5000 {
+			expected = "oversize"
+		} else if l.payloadSize != 1000 {
+			t.Logf("TestEndToEndPayloadSizes: incorrect payload size logged: %d", l.payloadSize)
+			t.Fail()
+		}
+		if l.state != expected {
+			t.Logf("TestEndToEndPayloadSizes: incorrect state for payload size %d: actual: %s, expected: %s",
+				l.payloadSize, l.state, expected)
+			t.Fail()
+		}
+	}
+	if st := countStates(fl.testLogs); st["oversize"] == 0 || st["resolved"] == 0 {
+		t.Logf("TestEndToEndPayloadSizes: sizes not swept: %v", st)
+		t.Fail()
+	}
+}
+
+func TestEndToEndEmulators(t *testing.T) {
+	devs := []*fakefcm.Device{fakefcm.NewDevice("DEVICE_TOKEN_1"), fakefcm.NewDevice("DEVICE_TOKEN_2")}
+	s := fakefcm.NewServer("PROJECT", "AUTH", devs[0], 0)
+	defer s.Close()
+	s.AddDevice(devs[1])
+	s.Latency = 5 * time.Millisecond
+	cfg := &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED, ReceiveTimeout: 10}
+
+	fl := runFakeEmulators(s, fakefcm.NewEmulators(devs...), 2, []*controller.ProbeConfig{cfg, cfg}, 10)
+
+	st := countStates(fl.testLogs)
+	if st["resolved"] != s.Accepted() || len(fl.testLogs) != s.Accepted() {
+		t.Logf("TestEndToEndEmulators: incorrect outcomes: %v, expected %d resolved", st, s.Accepted())
+		t.Fail()
+	}
+	tokens := map[string]string{fakefcm.Serial(0): "DEVICE_TOKEN_1", fakefcm.Serial(1): "DEVICE_TOKEN_2"}
+	probed := make(map[string]bool)
+	for _, l := range fl.testLogs {
+		if tokens[l.device] != l.token {
+			t.Logf("TestEndToEndEmulators: incorrect device or token logged: %s, %s", l.device, l.token)
+			t.Fail()
+		}
+		probed[l.device] = true
+	}
+	if len(probed) != 2 {
+		t.Logf("TestEndToEndEmulators: probes not spread across emulators: %v", probed)
+		t.Fail()
+	}
+}
@@ -16,23 +16,34 @@
 
 package probe
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
-// Collects calls to LogProbe for later analysis
+// Collects calls to LogProbe for later analysis. Entries may be logged from several goroutines, i.e. background token
+// refreshes, so appends are guarded by lock
 type fakeLogger struct {
 	testLogs []testLog
 	errLogs  []string
+	lock     sync.Mutex
 }
 
 func (t *fakeLogger) SetRegion(reg string) {}
 func (t *fakeLogger) SetError(dest string) {}
 func (t *fakeLogger) SetLog(dest string)   {}
 
-func (t *fakeLogger) LogProbe(sp *sentProbe, st string, lat int, tok string) {
-	t.testLogs = append(t.testLogs, testLog{sp.sendTime.Format(timeLogFormat), st, lat, tok})
+func (t *fakeLogger) LogProbe(sp *sentProbe, st string, lat int) {
+	dev := sp.probe.device
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.testLogs = append(t.testLogs, testLog{sp.sendTime.Format(timeLogFormat), st, lat, dev.serial, dev.registration(),
+		sp.payloadSize, sp.sequence, sp.reorder, sp.gap, sp.reordered, sp.gaps})
 }
 
 func (t *fakeLogger) LogError(desc string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	t.errLogs = append(t.errLogs, desc)
 }
 
@@ -45,12 +56,21 @@ func (t *fakeLogger) LogFatal(desc string) {
 }
 
 func (t *fakeLogger) LogFatalf(desc string, args ...interface{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	t.errLogs = append(t.errLogs, fmt.Sprintf(desc, args...))
 }
 
 type testLog struct {
-	time    string
-	state   string
-	latency int
-	token   string
+	time        string
+	state       string
+	latency     int
+	device      string
+	token       string
+	payloadSize int
+	sequence    int64
+	reorder     int
+	gap         int
+	reordered   int
+	gaps        int
 }
@@ -0,0 +1,213 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFcmEndpoint = "https://fcm.googleapis.com"
+	defaultSendRetries = 3
+	sendTimeout        = 30 * time.Second
+	// Backoff before the first retry of a send when FCM does not provide Retry-After, doubled for each retry
+	defaultRetryBackoff = 1 * time.Second
+	fcmErrorType        = "type.googleapis.com/google.firebase.fcm.v1.FcmError"
+)
+
+// Sends messages to the FCM HTTP v1 API
+type fcmClient struct {
+	endpoint string
+	project  string
+	retries  int
+	backoff  time.Duration
+	client   *http.Client
+}
+
+type fcmRequest struct {
+	Message *fcmMessage `json:"message"`
+}
+
+type fcmMessage struct {
+	Data    map[string]string `json:"data,omitempty"`
+	Token   string            `json:"token,omitempty"`
+	Topic   string            `json:"topic,omitempty"`
+	Android *androidConfig    `json:"android,omitempty"`
+}
+
+type androidConfig struct {
+	CollapseKey  string `json:"collapse_key,omitempty"`
+	Priority     string `json:"priority,omitempty"`
+	Ttl          string `json:"ttl,omitempty"`
+	DirectBootOk bool   `json:"direct_boot_ok,omitempty"`
+}
+
+type fcmResponse struct {
+	Name string `json:"name"`
+}
+
+// Error response from FCM, following the HTTP v1 error model
+type FcmError struct {
+	HttpStatus int           // HTTP status code of the response
+	Status     string        // Canonical error status, i.e. INVALID_ARGUMENT
+	ErrorCode  string        // FCM specific error code, i.e. UNREGISTERED, if provided
+	Message    string        // Description of the error
+	RetryAfter time.Duration // Delay requested by FCM before retrying, if provided
+}
+
+type fcmErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type      string `json:"@type"`
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+func (e *FcmError) Error() string {
+	code := e.ErrorCode
+	if code == "" {
+		code = e.Status
+	}
+	return fmt.Sprintf("fcm: %d %s: %s", e.HttpStatus, code, e.Message)
+}
+
+// Whether the send may succeed if it is attempted again
+func (e *FcmError) retryable() bool {
+	switch e.ErrorCode {
+	case "QUOTA_EXCEEDED", "UNAVAILABLE", "INTERNAL":
+		return true
+	case "UNREGISTERED", "INVALID_ARGUMENT", "SENDER_ID_MISMATCH", "THIRD_PARTY_AUTH_ERROR":
+		return false
+	}
+	return e.HttpStatus == http.StatusTooManyRequests || e.HttpStatus >= http.StatusInternalServerError
+}
+
+// Whether the message was rejected for exceeding FCM's payload size limit
+func (e *FcmError) oversize() bool {
+	return e.HttpStatus == http.StatusBadRequest && strings.Contains(strings.ToLower(e.Message), "too big")
+}
+
+func newFcmClient(endpoint string, project string, retries int) *fcmClient {
+	if endpoint == "" {
+		endpoint = defaultFcmEndpoint
+	}
+	if retries <= 0 {
+		retries = defaultSendRetries
+	}
+	return &fcmClient{strings.TrimSuffix(endpoint, "/"), project, retries, defaultRetryBackoff,
+		&http.Client{Timeout: sendTimeout}}
+}
+
+// Send a message, retrying on errors that FCM reports as transient. Returns the name FCM assigned to the message
+func (f *fcmClient) send(auth string, msg *fcmMessage) (string, error) {
+	body, err := json.Marshal(&fcmRequest{msg})
+	if err != nil {
+		return "", err
+	}
+	backoff := f.backoff
+	for i := 0; ; i++ {
+		name, err := f.post(auth, body)
+		if err == nil {
+			return name, nil
+		}
+		fe, ok := err.(*FcmError)
+		if i >= f.retries || (ok && !fe.retryable()) {
+			return "", err
+		}
+		wait := backoff
+		if ok && fe.RetryAfter > 0 {
+			wait = fe.RetryAfter
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+func (f *fcmClient) post(auth string, body []byte) (string, error) {
+	url := fmt.Sprintf("%s/v1/projects/%s/messages:send", f.endpoint, f.project)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+auth)
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	rb, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", parseFcmError(res, rb)
+	}
+	fr := new(fcmResponse)
+	err = json.Unmarshal(rb, fr)
+	if err != nil {
+		return "", err
+	}
+	return fr.Name, nil
+}
+
+func parseFcmError(res *http.Response, body []byte) *FcmError {
+	ret := &FcmError{HttpStatus: res.StatusCode, RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"))}
+	er := new(fcmErrorResponse)
+	err := json.Unmarshal(body, er)
+	if err != nil {
+		// Error did not come from FCM itself, i.e. from a proxy, so report the body as is
+		ret.Message = strings.TrimSpace(string(body))
+		return ret
+	}
+	ret.Status = er.Error.Status
+	ret.Message = er.Error.Message
+	for _, d := range er.Error.Details {
+		if d.Type == fcmErrorType {
+			ret.ErrorCode = d.ErrorCode
+		}
+	}
+	return ret
+}
+
+// Retry-After may either be a number of seconds or an HTTP date
+func parseRetryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	s, err := strconv.Atoi(h)
+	if err == nil {
+		return time.Duration(s) * time.Second
+	}
+	t, err := http.ParseTime(h)
+	if err != nil {
+		return 0
+	}
+	return t.Sub(clock.Now())
+}
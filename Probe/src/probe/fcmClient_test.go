@@ -0,0 +1,164 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+const testUnregistered = `{"error": {"code": 404, "message": "Requested entity was not found.", "status": "NOT_FOUND",
+	"details": [{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "UNREGISTERED"}]}}`
+
+const testUnavailable = `{"error": {"code": 503, "message": "The service is currently unavailable.", "status": "UNAVAILABLE",
+	"details": [{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "UNAVAILABLE"}]}}`
+
+// Serve the given status codes and bodies in order, recording the number of requests made
+func newTestFcmServer(codes []int, bodies []string, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := *requests
+		*requests++
+		w.WriteHeader(codes[i])
+		w.Write([]byte(bodies[i]))
+	}))
+}
+
+func TestSend(t *testing.T) {
+	var req fcmRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/PROJECT/messages:send" || r.Header.Get("Authorization") != "Bearer AUTH" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Write([]byte(`{"name": "projects/PROJECT/messages/1"}`))
+	}))
+	defer srv.Close()
+	f := newFcmClient(srv.URL, "PROJECT", 1)
+
+	name, err := f.send("AUTH", &fcmMessage{Data: map[string]string{"sendTime": "TIME"}, Token: "TOKEN"})
+
+	if err != nil {
+		t.Logf("TestSend: error returned on valid input: %v", err)
+		t.FailNow()
+	}
+	if name != "projects/PROJECT/messages/1" {
+		t.Logf("TestSend: incorrect message name: actual: %s, expected: projects/PROJECT/messages/1", name)
+		t.Fail()
+	}
+	if req.Message == nil || req.Message.Token != "TOKEN" || req.Message.Data["sendTime"] != "TIME" {
+		t.Log("TestSend: message not sent correctly")
+		t.Fail()
+	}
+}
+
+func TestSendUnregistered(t *testing.T) {
+	requests := 0
+	srv := newTestFcmServer([]int{http.StatusNotFound}, []string{testUnregistered}, &requests)
+	defer srv.Close()
+	f := newFcmClient(srv.URL, "PROJECT", 3)
+
+	_, err := f.send("AUTH", &fcmMessage{})
+
+	fe, ok := err.(*FcmError)
+	if !ok {
+		t.Logf("TestSendUnregistered: incorrect error returned: %v", err)
+		t.FailNow()
+	}
+	if fe.ErrorCode != "UNREGISTERED" || fe.Status != "NOT_FOUND" || fe.HttpStatus != http.StatusNotFound {
+		t.Logf("TestSendUnregistered: error parsed incorrectly: %v", fe)
+		t.Fail()
+	}
+	if requests != 1 {
+		t.Logf("TestSendUnregistered: non-retryable error retried: %d requests", requests)
+		t.Fail()
+	}
+}
+
+func TestSendRetry(t *testing.T) {
+	requests := 0
+	srv := newTestFcmServer([]int{http.StatusServiceUnavailable, http.StatusOK},
+		[]string{testUnavailable, `{"name": "NAME"}`}, &requests)
+	defer srv.Close()
+	f := newFcmClient(srv.URL, "PROJECT", 1)
+	f.backoff = 0
+
+	name, err := f.send("AUTH", &fcmMessage{})
+
+	if err != nil {
+		t.Logf("TestSendRetry: error returned after successful retry: %v", err)
+		t.FailNow()
+	}
+	if name != "NAME" || requests != 2 {
+		t.Logf("TestSendRetry: send not retried: %d requests", requests)
+		t.Fail()
+	}
+}
+
+func TestSendRetriesExceeded(t *testing.T) {
+	requests := 0
+	srv := newTestFcmServer([]int{http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		[]string{testUnavailable, testUnavailable}, &requests)
+	defer srv.Close()
+	f := newFcmClient(srv.URL, "PROJECT", 1)
+	f.backoff = 0
+
+	_, err := f.send("AUTH", &fcmMessage{})
+
+	fe, ok := err.(*FcmError)
+	if !ok || fe.ErrorCode != "UNAVAILABLE" {
+		t.Logf("TestSendRetriesExceeded: incorrect error returned: %v", err)
+		t.Fail()
+	}
+	if requests != 2 {
+		t.Logf("TestSendRetriesExceeded: incorrect number of requests: actual: %d, expected: 2", requests)
+		t.Fail()
+	}
+}
+
+func TestParseFcmErrorNotJSON(t *testing.T) {
+	res := &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{}}
+
+	fe := parseFcmError(res, []byte("Bad Gateway\n"))
+
+	if fe.Message != "Bad Gateway" || !fe.retryable() {
+		t.Logf("TestParseFcmErrorNotJSON: error parsed incorrectly: %v", fe)
+		t.Fail()
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(100, 0)}, true)
+
+	if d := parseRetryAfter("5"); d != 5*time.Second {
+		t.Logf("TestParseRetryAfter: incorrect duration from seconds: actual: %v, expected: 5s", d)
+		t.Fail()
+	}
+	if d := parseRetryAfter(time.Unix(110, 0).UTC().Format(http.TimeFormat)); d != 10*time.Second {
+		t.Logf("TestParseRetryAfter: incorrect duration from date: actual: %v, expected: 10s", d)
+		t.Fail()
+	}
+	if d := parseRetryAfter("INVALID"); d != 0 {
+		t.Logf("TestParseRetryAfter: incorrect duration from invalid header: actual: %v, expected: 0s", d)
+		t.Fail()
+	}
+}
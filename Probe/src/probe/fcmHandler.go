@@ -17,58 +17,237 @@
 package probe
 
 import (
-	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+)
+
+const (
+	// Lifetime in seconds assumed for tokens acquired from the gcloud CLI
+	localTokenTtl = 30 * 60
+	// Tokens are refreshed this long before they expire, unless their lifetime is less than twice as long
+	refreshMargin = 5 * time.Minute
+	// Delay before retrying a failed refresh while the cached token is still valid
+	refreshRetryInterval = 30 * time.Second
+	// Key of the data field with which messages are padded to a payload size
+	paddingKey = "padding"
 )
 
-// Represents an authentication response, into which JSON can be parsed
+// Caches the access token used to authenticate with FCM, which is shared by all probes. Once the token is due for
+// refresh it continues to be served while a single refresh runs in the background, until the token expires
 type Auth struct {
-	Token     string        `json:"access_token"`
-	Ttl       time.Duration `json:"expires_in,int"`
-	TokenType string        `json:"token_type"`
-	deadline  time.Time
+	Token      string
+	Ttl        time.Duration // Lifetime of the token in seconds
+	TokenType  string
+	source     tokenSource
+	deadline   time.Time     // Time after which the token is refreshed
+	expiry     time.Time     // Time after which the token can no longer be used
+	refreshing chan struct{} // Closed when the refresh in flight completes, nil if there is none
+	err        error         // Error from the most recent refresh, if it failed
+	metrics    TokenMetrics
+	lock       sync.Mutex
+}
+
+// Counts of token refreshes, for monitoring of credential problems. Reported to the controller with each ping
+type TokenMetrics struct {
+	Refreshes           int           // Successful refreshes
+	Failures            int           // Failed refreshes
+	ConsecutiveFailures int           // Failed refreshes since the last success
+	LastFetchTime       time.Duration // Time taken by the most recent refresh
+}
+
+// Set the source from which tokens are acquired when the cached token expires
+func (a *Auth) setSource(s tokenSource) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.source = s
 }
 
+// Return the cached token, waiting for a refresh only if there is no usable token
 func (a *Auth) getToken() (string, error) {
-	if clock.Now().After(a.deadline) {
-		err := a.prepareAuth()
-		if err != nil {
-			return "", err
+	a.lock.Lock()
+	if a.Token != "" {
+		now := clock.Now()
+		if !now.After(a.deadline) {
+			defer a.lock.Unlock()
+			return a.Token, nil
+		}
+		if now.Before(a.expiry) {
+			defer a.lock.Unlock()
+			a.startRefresh()
+			return a.Token, nil
 		}
 	}
+	done := a.startRefresh()
+	a.lock.Unlock()
+	<-done
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.err != nil {
+		return "", a.err
+	}
 	return a.Token, nil
 }
 
-func (a *Auth) prepareAuth() error {
-	// GET request for authentication credentials for interacting with FCM and Cloud Logger
-	get, err := maker.Command("curl",
-		"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/"+metadata.GetAccount().GetServiceAccount()+"/token",
-		"-H", "Metadata-Flavor: Google").Output()
+// Start a refresh unless one is already in flight, returning a channel that is closed once it completes. Must be
+// called with the lock held
+func (a *Auth) startRefresh() chan struct{} {
+	if a.refreshing == nil {
+		a.refreshing = make(chan struct{})
+		go a.refresh(a.refreshing)
+	}
+	return a.refreshing
+}
+
+func (a *Auth) refresh(done chan struct{}) {
+	start := time.Now()
+	err := a.prepareAuth()
+
+	a.lock.Lock()
+	a.err = err
+	a.metrics.LastFetchTime = time.Since(start)
 	if err != nil {
-		return err
+		a.metrics.Failures++
+		a.metrics.ConsecutiveFailures++
+		// Keep serving the cached token, but avoid retrying on every send
+		if a.Token != "" {
+			a.deadline = clock.Now().Add(refreshRetryInterval)
+		}
+	} else {
+		a.metrics.Refreshes++
+		a.metrics.ConsecutiveFailures = 0
 	}
-	err = json.Unmarshal(get, a)
+	m := a.metrics
+	a.refreshing = nil
+	a.lock.Unlock()
+
+	if err != nil {
+		logger.LogErrorf("refresh: unable to refresh FCM access token (%d consecutive, %d total failures): %v",
+			m.ConsecutiveFailures, m.Failures, err)
+	}
+	close(done)
+}
+
+// Return a snapshot of the refresh metrics
+func (a *Auth) getMetrics() TokenMetrics {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.metrics
+}
+
+// Fetch a token from the source and cache it. The lock is not held during the fetch, so that the cached token can
+// be served in the meantime
+func (a *Auth) prepareAuth() error {
+	a.lock.Lock()
+	if a.source == nil {
+		src, err := newTokenSource(metadata.GetCredentialsFile(), metadata.GetTokenEndpoint())
+		if err != nil {
+			a.lock.Unlock()
+			return err
+		}
+		a.source = src
+	}
+	src := a.source
+	a.lock.Unlock()
+
+	res, err := src.fetch()
 	if err != nil {
 		return err
 	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.Token = res.Token
+	a.Ttl = res.Ttl
+	a.TokenType = res.TokenType
 	a.updateDeadline()
 	return nil
 }
 
 func (a *Auth) updateDeadline() {
-	a.deadline = clock.Now().Add(a.Ttl * time.Second)
+	now := clock.Now()
+	ttl := a.Ttl * time.Second
+	a.expiry = now.Add(ttl)
+	if ttl > 2*refreshMargin {
+		ttl -= refreshMargin
+	}
+	a.deadline = now.Add(ttl)
 }
 
-func (a *Auth) sendMessage(time string, ptype int) error {
+// Send a message for a probe, to the device or to the probe's topic, padded to the given payload size if it is not 0.
+// Returns the time the message was sent and the name FCM assigned to it. The send time is taken after the access
+// token is acquired, so that token refreshes are not measured as FCM latency. The message carries the probe's next
+// sequence number, which is only used up if FCM accepts the message, so that failed sends do not appear as gaps in the
+// sequence. Messages awaited by the resolver are recorded in the journal before the send time is taken, so that
+// flushing the journal to disk is not measured as FCM latency, and the send time is recorded once FCM accepts them
+func (a *Auth) sendMessage(p *probe, size int) (time.Time, string, error) {
 	auth, err := a.getToken()
 	if err != nil {
-		return err
+		return time.Time{}, "", err
 	}
-	err = maker.Command("bash", "send", "-d", deviceToken, "-a", auth, "-t", time,
-		"-p", metadata.GetAccount().GetGcpProject(), "-y", fmt.Sprintf("%d", ptype)).Run()
-	if err != nil {
-		return err
+	seq := p.sequence + 1
+	// Bursts of COLLAPSE probes are resolved as they are sent, rather than awaited by the resolver
+	if p.config.GetType() != controller.ProbeType_COLLAPSE {
+		p.entry = journal.sent(p, time.Time{}, seq, size)
 	}
-	return nil
+	tim := clock.Now()
+	msg := &fcmMessage{
+		Data: map[string]string{"sendTime": tim.Format(timeFileFormat), "type": fmt.Sprintf("%d", p.config.GetType()),
+			"sequence": strconv.FormatInt(seq, 10)},
+		Android: newAndroidConfig(p.config.GetAndroid()),
+	}
+	if size > 0 {
+		padData(msg.Data, size)
+	}
+	if p.config.GetType() == controller.ProbeType_TOPIC {
+		msg.Topic = p.topic()
+	} else {
+		msg.Token = p.device.registration()
+	}
+	if p.config.GetType() == controller.ProbeType_COLLAPSE {
+		if msg.Android == nil {
+			msg.Android = new(androidConfig)
+		}
+		msg.Android.CollapseKey = p.collapseKey()
+	}
+	name, err := fcm.send(auth, msg)
+	if err == nil {
+		p.sequence = seq
+		journal.stamp(p.entry, tim)
+	} else {
+		// No receipt is awaited for a message FCM did not accept
+		journal.finish(p.entry)
+		p.entry = 0
+	}
+	return tim, name, err
+}
+
+// Pad data so that its size, counting keys and values as FCM does, is exactly size. Data is left as is if it is
+// already too large for the padding field to fit
+func padData(data map[string]string, size int) {
+	n := 0
+	for k, v := range data {
+		n += len(k) + len(v)
+	}
+	pad := size - n - len(paddingKey)
+	if pad < 0 {
+		return
+	}
+	data[paddingKey] = strings.Repeat("x", pad)
+}
+
+// Convert a probe's Android options to the form FCM expects, leaving unset options to FCM's defaults
+func newAndroidConfig(opts *controller.AndroidOptions) *androidConfig {
+	if opts == nil {
+		return nil
+	}
+	ret := &androidConfig{CollapseKey: opts.GetCollapseKey(), Ttl: opts.GetTtl(), DirectBootOk: opts.GetDirectBootOk()}
+	if opts.GetPriority() != controller.MessagePriority_DEFAULT_PRIORITY {
+		ret.Priority = strings.ToLower(opts.GetPriority().String())
+	}
+	return ret
 }
@@ -17,10 +17,17 @@
 package probe
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
 	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
 )
 
@@ -119,3 +126,218 @@ func TestPrepareAuthInvalidJSON(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestPrepareAuthStandalone(t *testing.T) {
+	tTime := time.Unix(100, 0)
+	clock = utils.NewFakeClock([]time.Time{tTime}, false)
+	maker = utils.NewFakeCommandMaker([]string{"1111\n"}, []bool{false}, false)
+	standalone = true
+	defer func() { standalone = false }()
+	tAuth := new(Auth)
+
+	err := tAuth.prepareAuth()
+
+	if err != nil {
+		t.Logf("TestPrepareAuthStandalone: error on valid input: %v", err)
+		t.FailNow()
+	}
+	if tAuth.Token != "1111" {
+		t.Logf("TestPrepareAuthStandalone: incorrect token: actual: %s, expected: 1111", tAuth.Token)
+		t.Fail()
+	}
+	if !tAuth.deadline.Equal(tTime.Add(localTokenTtl*time.Second - refreshMargin)) {
+		t.Logf("TestPrepareAuthStandalone: deadline not correctly updated: %v", tAuth.deadline)
+		t.Fail()
+	}
+}
+
+// Token source that blocks each fetch until released, counting the fetches made
+type fakeTokenSource struct {
+	fetches int32
+	release chan struct{}
+	err     error
+}
+
+func (f *fakeTokenSource) fetch() (*tokenResponse, error) {
+	atomic.AddInt32(&f.fetches, 1)
+	<-f.release
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &tokenResponse{"NEW_TOKEN", 3600, "Bearer"}, nil
+}
+
+func TestGetTokenServesStale(t *testing.T) {
+	tTime := time.Unix(100, 0)
+	clock = utils.NewFakeClock([]time.Time{tTime}, true)
+	src := &fakeTokenSource{release: make(chan struct{})}
+	tAuth := &Auth{Token: "OLD_TOKEN", source: src, deadline: tTime.Add(-time.Second), expiry: tTime.Add(time.Minute)}
+
+	// Refresh is blocked, so the cached token must be served without waiting for it
+	for i := 0; i < 5; i++ {
+		str, err := tAuth.getToken()
+		if err != nil || str != "OLD_TOKEN" {
+			t.Logf("TestGetTokenServesStale: cached token not served during refresh: %s, %v", str, err)
+			t.Fail()
+		}
+	}
+	close(src.release)
+	for tAuth.getMetrics().Refreshes == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	str, _ := tAuth.getToken()
+
+	if str != "NEW_TOKEN" {
+		t.Logf("TestGetTokenServesStale: token not refreshed: actual: %s, expected: NEW_TOKEN", str)
+		t.Fail()
+	}
+	if atomic.LoadInt32(&src.fetches) != 1 {
+		t.Logf("TestGetTokenServesStale: concurrent refreshes not collapsed: %d fetches", src.fetches)
+		t.Fail()
+	}
+}
+
+func TestGetTokenConcurrentWait(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(100, 0)}, true)
+	logger = new(fakeLogger)
+	src := &fakeTokenSource{release: make(chan struct{})}
+	tAuth := &Auth{source: src}
+	wg := new(sync.WaitGroup)
+	toks := make([]string, 5)
+
+	for i := range toks {
+		wg.Add(1)
+		go func(i int) {
+			toks[i], _ = tAuth.getToken()
+			wg.Done()
+		}(i)
+	}
+	for atomic.LoadInt32(&src.fetches) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(src.release)
+	wg.Wait()
+
+	for _, tok := range toks {
+		if tok != "NEW_TOKEN" {
+			t.Logf("TestGetTokenConcurrentWait: incorrect token: actual: %s, expected: NEW_TOKEN", tok)
+			t.Fail()
+		}
+	}
+	if atomic.LoadInt32(&src.fetches) != 1 {
+		t.Logf("TestGetTokenConcurrentWait: concurrent refreshes not collapsed: %d fetches", src.fetches)
+		t.Fail()
+	}
+}
+
+func TestGetTokenRefreshFailure(t *testing.T) {
+	tTime := time.Unix(100, 0)
+	clock = utils.NewFakeClock([]time.Time{tTime}, true)
+	fl := new(fakeLogger)
+	logger = fl
+	src := &fakeTokenSource{release: make(chan struct{}), err: errors.New("FETCH_ERROR")}
+	close(src.release)
+	tAuth := &Auth{source: src}
+
+	_, err := tAuth.getToken()
+
+	if err == nil {
+		t.Log("TestGetTokenRefreshFailure: no error when no token could be acquired")
+		t.Fail()
+	}
+	m := tAuth.getMetrics()
+	if m.Failures != 1 || m.ConsecutiveFailures != 1 || m.Refreshes != 0 {
+		t.Logf("TestGetTokenRefreshFailure: incorrect metrics: %+v", m)
+		t.Fail()
+	}
+	if len(fl.errLogs) != 1 {
+		t.Logf("TestGetTokenRefreshFailure: refresh failure not logged: %v", fl.errLogs)
+		t.Fail()
+	}
+}
+
+func TestSendMessageAndroidOptions(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(100, 0)}, true)
+	var req fcmRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&req)
+		fmt.Fprint(w, `{"name":"MESSAGE"}`)
+	}))
+	defer srv.Close()
+	fcm = newFcmClient(srv.URL, "PROJECT", 1)
+	tAuth := &Auth{Token: "TOKEN", deadline: time.Unix(200, 0)}
+	p := newProbe(&controller.ProbeConfig{Android: &controller.AndroidOptions{
+		Priority: controller.MessagePriority_HIGH, Ttl: "0s", CollapseKey: "KEY", DirectBootOk: true}}, newTestEmulator())
+
+	_, _, err := tAuth.sendMessage(p, 0)
+
+	if err != nil {
+		t.Logf("TestSendMessageAndroidOptions: error on valid input: %v", err)
+		t.FailNow()
+	}
+	expected := androidConfig{CollapseKey: "KEY", Priority: "high", Ttl: "0s", DirectBootOk: true}
+	if req.Message == nil || req.Message.Android == nil || *req.Message.Android != expected {
+		t.Logf("TestSendMessageAndroidOptions: Android options not sent: %+v", req.Message)
+		t.Fail()
+	}
+}
+
+func TestSendMessageSequence(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(100, 0)}, true)
+	var seqs []string
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req fcmRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		seqs = append(seqs, req.Message.Data["sequence"])
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"code":400,"status":"INVALID_ARGUMENT"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"MESSAGE"}`)
+	}))
+	defer srv.Close()
+	fcm = newFcmClient(srv.URL, "PROJECT", 1)
+	tAuth := &Auth{Token: "TOKEN", deadline: time.Unix(200, 0)}
+	p := newProbe(&controller.ProbeConfig{}, newTestEmulator())
+
+	tAuth.sendMessage(p, 0)
+	fail = true
+	tAuth.sendMessage(p, 0)
+	fail = false
+	tAuth.sendMessage(p, 0)
+
+	// A rejected message does not use up its sequence number
+	if len(seqs) != 3 || seqs[0] != "1" || seqs[1] != "2" || seqs[2] != "2" || p.sequence != 2 {
+		t.Logf("TestSendMessageSequence: incorrect sequence numbers: %v, last: %d", seqs, p.sequence)
+		t.Fail()
+	}
+}
+
+func TestNewAndroidConfigDefault(t *testing.T) {
+	if newAndroidConfig(nil) != nil {
+		t.Log("TestNewAndroidConfigDefault: Android options sent for probe without options")
+		t.Fail()
+	}
+	ac := newAndroidConfig(&controller.AndroidOptions{Ttl: "60s"})
+	if ac.Priority != "" || ac.Ttl != "60s" {
+		t.Logf("TestNewAndroidConfigDefault: incorrect Android options: %+v", ac)
+		t.Fail()
+	}
+}
+
+func TestPadData(t *testing.T) {
+	data := map[string]string{"sendTime": "TIME", "type": "0"}
+
+	padData(data, 100)
+
+	n := 0
+	for k, v := range data {
+		n += len(k) + len(v)
+	}
+	if n != 100 {
+		t.Logf("TestPadData: incorrect payload size: actual: %d, expected: 100", n)
+		t.Fail()
+	}
+}
@@ -0,0 +1,311 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+)
+
+const (
+	// File in the working directory in which messages awaiting receipts are recorded, when not provided in metadata
+	defaultJournalPath = "inflight.log"
+	// Number of messages marked done after which the journal is rewritten with only those still outstanding
+	journalCompactThreshold = 1000
+)
+
+// Journal of the messages awaiting receipts, to which each message is appended before it is sent and marked done
+// once its outcome is logged. Messages that are not done when the probe restarts are resolved or timed out again
+var journal *inflightJournal
+
+// An entry in the journal. Each message is recorded as sent, and later as done under the same ID
+type journalEntry struct {
+	Op          string `json:"op"` // "sent" or "done"
+	Id          int64  `json:"id"`
+	Device      string `json:"device,omitempty"`      // Serial of the emulator to which the message was sent
+	Probe       int    `json:"probe"`                 // Index of the probe in the configuration
+	Type        int32  `json:"type"`                  // Type of the probe
+	SendTime    string `json:"sendTime,omitempty"`    // Time at which the message was sent, in RFC 3339 format, once known
+	Sequence    int64  `json:"sequence,omitempty"`    // Sequence number with which the message was sent
+	PayloadSize int    `json:"payloadSize,omitempty"` // Size to which the message's data payload was padded
+}
+
+type inflightJournal struct {
+	path    string
+	file    *os.File
+	next    int64                   // ID of the next message recorded
+	pending map[int64]*journalEntry // Messages that are not done, by ID
+	done    int                     // Messages marked done since the journal was last rewritten
+	lock    sync.Mutex
+}
+
+// Open the journal at path, creating it if it does not exist. Returns the messages that were not done when the
+// journal was last written, in the order they were sent. The journal is rewritten with only those messages
+func openJournal(path string) (*inflightJournal, []*journalEntry, error) {
+	j := &inflightJournal{path: path, next: 1, pending: make(map[int64]*journalEntry)}
+	err := j.replay()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = j.compact()
+	if err != nil {
+		return nil, nil, err
+	}
+	var ret []*journalEntry
+	for _, ent := range j.pending {
+		ret = append(ret, ent)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Id < ret[j].Id })
+	return j, ret, nil
+}
+
+// Read the entries in the journal file, if it exists. A line that cannot be read, such as one left incomplete by a
+// crash while it was written, is skipped
+func (j *inflightJournal) replay() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		ent := new(journalEntry)
+		if json.Unmarshal(sc.Bytes(), ent) != nil {
+			continue
+		}
+		switch ent.Op {
+		case "sent":
+			j.pending[ent.Id] = ent
+		case "done":
+			delete(j.pending, ent.Id)
+		}
+		if ent.Id >= j.next {
+			j.next = ent.Id + 1
+		}
+	}
+	return sc.Err()
+}
+
+// Rewrite the journal with only the messages that are not done, replacing the file atomically so that a crash
+// while it is rewritten leaves the previous journal intact. The caller must hold the lock, if the journal is shared
+func (j *inflightJournal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	var ids []int64
+	for id := range j.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	enc := json.NewEncoder(w)
+	for _, id := range ids {
+		err = enc.Encode(j.pending[id])
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	j.done = 0
+	return err
+}
+
+// Append an entry and flush it to disk, so that it survives a crash of the probe or the VM
+func (j *inflightJournal) write(ent *journalEntry) error {
+	if j.file == nil {
+		return os.ErrClosed
+	}
+	b, err := json.Marshal(ent)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Record a message of the probe about to be sent, returning its ID in the journal. If tim is zero, the send time is
+// recorded later with stamp. Returns 0 if there is no journal or the message could not be recorded, in which case the
+// message is still sent
+func (j *inflightJournal) sent(p *probe, tim time.Time, seq int64, size int) int64 {
+	if j == nil {
+		return 0
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	ent := &journalEntry{Op: "sent", Id: j.next, Device: p.device.serial, Probe: p.id, Type: int32(p.config.GetType()),
+		Sequence: seq, PayloadSize: size}
+	if !tim.IsZero() {
+		ent.SendTime = tim.Format(time.RFC3339Nano)
+	}
+	err := j.write(ent)
+	if err != nil {
+		logger.LogErrorf("journal: unable to record message of probe %d: %v", p.id, err)
+		return 0
+	}
+	j.pending[ent.Id] = ent
+	j.next++
+	return ent.Id
+}
+
+// Record the send time of a message recorded without one, by recording the message again under the same ID
+func (j *inflightJournal) stamp(id int64, tim time.Time) {
+	if j == nil || id == 0 {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	ent, ok := j.pending[id]
+	if !ok {
+		return
+	}
+	stamped := *ent
+	stamped.SendTime = tim.Format(time.RFC3339Nano)
+	err := j.write(&stamped)
+	if err != nil {
+		logger.LogErrorf("journal: unable to record send time of message %d: %v", id, err)
+		return
+	}
+	j.pending[id] = &stamped
+}
+
+// Mark a message done once its outcome is logged or it could not be sent. The journal is rewritten once enough
+// messages are done, so that it does not grow while the probe runs
+func (j *inflightJournal) finish(id int64) {
+	if j == nil || id == 0 {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, ok := j.pending[id]; !ok {
+		return
+	}
+	err := j.write(&journalEntry{Op: "done", Id: id})
+	if err != nil {
+		logger.LogErrorf("journal: unable to mark message %d done: %v", id, err)
+		return
+	}
+	delete(j.pending, id)
+	j.done++
+	if j.done >= journalCompactThreshold {
+		err = j.compact()
+		if err != nil {
+			logger.LogErrorf("journal: unable to rewrite %s: %v", j.path, err)
+		}
+	}
+}
+
+func getJournalPath() string {
+	if metadata.GetInflightLog() == "" {
+		return defaultJournalPath
+	}
+	return metadata.GetInflightLog()
+}
+
+func (j *inflightJournal) close() {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+}
+
+// Await the receipts of messages that were outstanding when the probe last stopped, so that each gets an outcome.
+// Messages are matched to the probe with the same index, type and emulator, whose sequence numbers continue from
+// theirs. Since the messages were sent before the restart, any that are not received are logged as interrupted
+// rather than timed out. Messages whose probe no longer exists are logged as interrupted immediately
+func recoverProbes(ps []*probe, ents []*journalEntry) {
+	for _, ent := range ents {
+		if ent.SendTime == "" {
+			// The probe stopped while the message was being sent, so whether it was sent is not known
+			logger.LogErrorf("recoverProbes: message %d of probe %d interrupted before its send time was recorded",
+				ent.Id, ent.Probe)
+			journal.finish(ent.Id)
+			continue
+		}
+		tim, err := time.Parse(time.RFC3339Nano, ent.SendTime)
+		if err != nil {
+			logger.LogErrorf("recoverProbes: unable to read send time of message %d: %v", ent.Id, err)
+			journal.finish(ent.Id)
+			continue
+		}
+		p := matchProbe(ps, ent)
+		if p == nil {
+			// Stands in for the probe so that the message is logged with what was recorded of it
+			sp := newSentProbe(tim, newProbe(&controller.ProbeConfig{Type: controller.ProbeType(ent.Type)},
+				&emulator{serial: ent.Device}))
+			sp.probe.id = ent.Probe
+			sp.sequence = ent.Sequence
+			sp.payloadSize = ent.PayloadSize
+			logger.LogProbe(sp, "interrupted", -1)
+			journal.finish(ent.Id)
+			continue
+		}
+		sp := newSentProbe(tim, p)
+		sp.sequence = ent.Sequence
+		sp.payloadSize = ent.PayloadSize
+		sp.entry = ent.Id
+		sp.recovered = true
+		if ent.Sequence > p.sequence {
+			p.sequence = ent.Sequence
+		}
+		addProbe(sp)
+	}
+}
+
+// Probe that sent a recorded message, or nil if no probe with its index, type and emulator exists
+func matchProbe(ps []*probe, ent *journalEntry) *probe {
+	for _, p := range ps {
+		if p.id == ent.Probe && int32(p.config.GetType()) == ent.Type && p.device.serial == ent.Device {
+			return p
+		}
+	}
+	return nil
+}
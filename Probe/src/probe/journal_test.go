@@ -0,0 +1,218 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/fakefcm"
+)
+
+func tempJournalPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "inflight.log"), func() { os.RemoveAll(dir) }
+}
+
+func TestJournal(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+	logger = new(fakeLogger)
+	p := newProbe(&controller.ProbeConfig{Type: controller.ProbeType_TOPIC}, newTestEmulator())
+	p.id = 2
+
+	j, ents, err := openJournal(path)
+	if err != nil || len(ents) != 0 {
+		t.Logf("TestJournal: new journal not opened empty: %v", err)
+		t.FailNow()
+	}
+	id1 := j.sent(p, time.Unix(1, 5000000), 1, 0)
+	id2 := j.sent(p, time.Unix(2, 0), 2, 100)
+	j.finish(id1)
+	j.close()
+
+	j, ents, err = openJournal(path)
+	if err != nil {
+		t.Logf("TestJournal: unable to reopen journal: %v", err)
+		t.FailNow()
+	}
+	defer j.close()
+	if len(ents) != 1 || ents[0].Id != id2 {
+		t.Logf("TestJournal: incorrect outstanding messages: %v", ents)
+		t.FailNow()
+	}
+	ent := ents[0]
+	if ent.Device != p.device.serial || ent.Probe != 2 || ent.Type != int32(controller.ProbeType_TOPIC) ||
+		ent.Sequence != 2 || ent.PayloadSize != 100 {
+		t.Logf("TestJournal: message recorded incorrectly: %+v", ent)
+		t.Fail()
+	}
+	if id := j.sent(p, time.Unix(3, 0), 3, 0); id <= id2 {
+		t.Logf("TestJournal: ID reused after reopening: %d", id)
+		t.Fail()
+	}
+	b, _ := ioutil.ReadFile(path)
+	if n := strings.Count(string(b), "\n"); n != 2 {
+		t.Logf("TestJournal: journal not rewritten on opening: %d lines", n)
+		t.Fail()
+	}
+}
+
+func TestJournalStamp(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+	logger = new(fakeLogger)
+	p := newProbe(&controller.ProbeConfig{}, newTestEmulator())
+	j, _, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := j.sent(p, time.Time{}, 1, 0)
+	j.stamp(id, time.Unix(1, 0))
+	j.close()
+
+	j, ents, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if len(ents) != 1 || ents[0].SendTime != time.Unix(1, 0).Format(time.RFC3339Nano) || ents[0].Sequence != 1 {
+		t.Logf("TestJournalStamp: send time not recorded: %+v", ents)
+		t.Fail()
+	}
+}
+
+func TestJournalIncomplete(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+	content := `{"op":"sent","id":1,"device":"emulator-5554","probe":0,"type":0,"sendTime":"1970-01-01T00:00:01Z"}
+{"op":"sent","id":2,"device":"emulator-5554","probe":0,"type":0,"sendTime":"1970-01-01T00:00:02Z"}
+{"op":"done","id":2}
+{"op":"sent","id":3,"dev`
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, ents, err := openJournal(path)
+
+	if err != nil {
+		t.Logf("TestJournalIncomplete: error on incomplete journal: %v", err)
+		t.FailNow()
+	}
+	defer j.close()
+	if len(ents) != 1 || ents[0].Id != 1 {
+		t.Logf("TestJournalIncomplete: incorrect outstanding messages: %v", ents)
+		t.Fail()
+	}
+}
+
+func TestRecoverProbes(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
+	fl := new(fakeLogger)
+	logger = fl
+	dev := newTestEmulator()
+	p := newProbe(&controller.ProbeConfig{ReceiveTimeout: 2}, dev)
+	// Messages to the probe, one of which was received, and to a probe that is no longer configured
+	old := newProbe(&controller.ProbeConfig{}, dev)
+	old.id = 1
+	j, _, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.sent(p, time.Unix(1, 0), 4, 0)
+	j.sent(p, time.Unix(2, 0), 5, 0)
+	j.sent(old, time.Unix(2, 0), 1, 0)
+	j.close()
+	writeReceipt(fd, newSentProbe(time.Unix(1, 0), p), "1500")
+
+	var ents []*journalEntry
+	journal, ents, err = openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		journal.close()
+		journal = nil
+	}()
+	resetResolver()
+	recoverProbes([]*probe{p}, ents)
+	now := time.Unix(10, 0)
+	resolveDevice(dev, pendingProbes()[dev], now)
+	expireProbes(now)
+
+	states := make(map[int64]string)
+	for _, l := range fl.testLogs {
+		states[l.sequence] = l.state
+	}
+	if len(fl.testLogs) != 3 || states[4] != "resolved" || states[5] != "interrupted" || states[1] != "interrupted" {
+		t.Logf("TestRecoverProbes: incorrect outcomes of recovered messages: %v", fl.testLogs)
+		t.Fail()
+	}
+	if p.sequence != 5 {
+		t.Logf("TestRecoverProbes: sequence not continued from recovered messages: %d", p.sequence)
+		t.Fail()
+	}
+	if len(journal.pending) != 0 {
+		t.Logf("TestRecoverProbes: recovered messages not marked done: %d", len(journal.pending))
+		t.Fail()
+	}
+}
+
+func TestRecoverProbesUnstamped(t *testing.T) {
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+	fl := new(fakeLogger)
+	logger = fl
+	p := newProbe(&controller.ProbeConfig{ReceiveTimeout: 2}, newTestEmulator())
+	j, _, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The probe stopped before FCM accepted the message
+	j.sent(p, time.Time{}, 1, 0)
+	j.close()
+
+	var ents []*journalEntry
+	journal, ents, err = openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		journal.close()
+		journal = nil
+	}()
+	resetResolver()
+	recoverProbes([]*probe{p}, ents)
+
+	if len(pendingProbes()) != 0 || len(fl.errLogs) != 1 || len(journal.pending) != 0 {
+		t.Logf("TestRecoverProbesUnstamped: message without send time awaited: %v", fl.errLogs)
+		t.Fail()
+	}
+}
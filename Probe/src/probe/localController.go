@@ -17,9 +17,13 @@
 package probe
 
 import (
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
 	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/adb"
 	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
 )
 
@@ -29,9 +33,15 @@ var (
 	clock        utils.Timer
 	logger       Logger
 	fcmAuth      Auth
-	deviceToken  string
-	probing      = true
-	probeLock    sync.Mutex
+	fcm          *fcmClient
+	bridge       *adb.Client
+	emulators    []*emulator
+	// Number of emulators to run, as configured by the controller or standalone configuration
+	emulatorCount int
+	probing       = true
+	probeLock     sync.Mutex
+	// Set when running without a controller or GCP metadata server
+	standalone bool
 )
 
 // Handles startup/teardown of emulator/app, also starts and stops probing
@@ -39,43 +49,110 @@ func Control(mk utils.CommandMaker, clk utils.Timer, lg Logger) {
 	maker = mk
 	clock = clk
 	logger = lg
+	bridge = adb.NewClient(adb.DefaultAddr)
 
 	acquireData()
+	defer closeLogging()
 
 	err := initClient()
 	if err != nil {
 		logger.LogFatalf("Control: unable to initialize gRPC client: %v", err)
 	}
 
+	err = runProbes(communicate)
+	if err != nil {
+		logger.LogErrorf("Control: communication error, %v", err)
+	}
+
+	err = confirmStop()
+
+	// Connection was lost to the controller for longer than the grace period, so assume it has terminated and
+	// delete VM instance
+	if err != nil {
+		deleteVM()
+	}
+}
+
+// Handles startup/teardown of emulator/app and probing without a controller, using locally provided configuration.
+// Probing continues until the process is interrupted
+func ControlStandalone(mk utils.CommandMaker, clk utils.Timer, lg Logger, cfg *controller.StandaloneConfig, host string, region string) {
+	maker = mk
+	clock = clk
+	logger = lg
+	bridge = adb.NewClient(adb.DefaultAddr)
+	standalone = true
+
+	hostname = host
+	zone = host
+	logger.SetRegion(region)
+	metadata = cfg.GetMetadata()
+	probeConfigs = cfg.GetProbes()
+	emulatorCount = int(cfg.GetEmulators())
+	logger.SetError(metadata.GetErrorLogDestination())
+	logger.SetLog(metadata.GetProbeLogDestination())
+	configureLogging(region)
+	defer closeLogging()
+
+	err := runProbes(func() error {
+		waitForInterrupt(make(chan os.Signal, 1))
+		return nil
+	})
+	if err != nil {
+		logger.LogErrorf("ControlStandalone: %v", err)
+	}
+}
+
+// Start the emulators, app, probes and resolver, and stop them once wait returns
+func runProbes(wait func() error) error {
 	defer destroyEnvironment()
 
 	initEnvironment()
-	tok, err := getToken()
+	for _, e := range emulators {
+		tok, err := e.getToken()
+		if err != nil {
+			logger.LogFatalf("runProbes: could not acquire device token from %s: %v", e.serial, err)
+		}
+		e.token = tok
+	}
+	src, err := newTokenSource(metadata.GetCredentialsFile(), metadata.GetTokenEndpoint())
+	if err != nil {
+		logger.LogFatalf("runProbes: unable to load credentials: %v", err)
+	}
+	fcmAuth.setSource(src)
+	// Acquire a token before probing starts so that the first probes are not delayed. Failures are retried on send
+	_, err = fcmAuth.getToken()
 	if err != nil {
-		logger.LogFatalf("Control: could not acquire device token: %v", err)
+		logger.LogErrorf("runProbes: unable to acquire FCM access token: %v", err)
 	}
-	deviceToken = tok
+	fcm = newFcmClient(metadata.GetFcmEndpoint(), metadata.GetAccount().GetGcpProject(), int(metadata.GetSendRetries()))
 	ps := makeProbes()
+	// Without a journal, messages awaiting receipts when the probe stops are lost
+	var ents []*journalEntry
+	journal, ents, err = openJournal(getJournalPath())
+	if err != nil {
+		logger.LogErrorf("runProbes: unable to open journal: %v", err)
+	}
 	rwg, err := startResolver()
 	if err != nil {
-		logger.LogFatalf("Control: unable to start resolver: %v", err)
+		logger.LogFatalf("runProbes: unable to start resolver: %v", err)
 	}
+	recoverProbes(ps, ents)
+	subscribeTopics(ps)
 	pwg := startProbes(ps)
+	stop, wwg := startWatchdog()
 
-	err = communicate()
-	if err != nil {
-		logger.LogErrorf("Control: communication error, %v", err)
-	}
+	err = wait()
 
+	stopWatchdog(stop, wwg)
 	stopProbes(pwg)
 	stopResolver(rwg)
+	journal.close()
+	return err
+}
 
-	err = confirmStop()
-
-	// Connection was lost to the controller, so assume it has terminated and delete VM instance
-	if err != nil {
-		deleteVM()
-	}
+func waitForInterrupt(c chan os.Signal) {
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
 }
 
 func acquireData() {
@@ -85,6 +162,8 @@ func acquireData() {
 	if err != nil {
 		logger.LogFatalf("acquireData: unable to resolve hostname: %v", err)
 	}
+	// VMs are named after their zone unless they are replacements, in which case the controller provides the zone
+	zone = hostname
 	// Update region in logger now that it has been acquired
 	logger.SetRegion(hostname)
 
@@ -97,38 +176,90 @@ func acquireData() {
 	// Update logger send destinations that were acquired with metadata
 	logger.SetError(metadata.GetErrorLogDestination())
 	logger.SetLog(metadata.GetProbeLogDestination())
+	configureLogging(hostname)
 }
 
 func initEnvironment() {
-	err := startEmulator()
-	if err != nil {
-		logger.LogFatalf("initEnvironment: could not start emulator: %v", err)
+	n := emulatorCount
+	if n <= 0 {
+		n = 1
 	}
-	err = startApp()
+	var err error
+	// Emulators that were started are recorded even on failure so that they are killed on teardown
+	emulators, err = startEmulators(n)
 	if err != nil {
-		logger.LogFatalf("initEnvironment: could not install app: %v", err)
+		logger.LogFatalf("initEnvironment: could not start emulators: %v", err)
+	}
+	for _, e := range emulators {
+		err = e.startApp()
+		if err != nil {
+			logger.LogFatalf("initEnvironment: could not install app on %s: %v", e.serial, err)
+		}
+		// Without a listener the app writes receipts to files, which are polled
+		err = e.startListener()
+		if err == nil {
+			err = e.forwardReceipts()
+		}
+		if err != nil {
+			logger.LogErrorf("initEnvironment: unable to receive pushed receipts from %s: %v", e.serial, err)
+		}
 	}
 }
 
 func destroyEnvironment() {
-	err := uninstallApp()
-	if err != nil {
-		logger.LogErrorf("destroyEnvironment: unable to uninstall app: %v", err)
-	}
-	err = killEmulator()
-	if err != nil {
-		logger.LogFatalf("destroyEnvironment: could not kill emulator: %v", err)
+	for _, e := range emulators {
+		e.stopListener()
+		err := e.uninstallApp()
+		if err != nil {
+			logger.LogErrorf("destroyEnvironment: unable to uninstall app from %s: %v", e.serial, err)
+		}
+		err = e.kill()
+		if err != nil {
+			logger.LogFatalf("destroyEnvironment: could not kill emulator %s: %v", e.serial, err)
+		}
 	}
 }
 
+// Create probes from their configurations, spreading them evenly across the emulators
 func makeProbes() []*probe {
 	var ret []*probe
-	for _, p := range probeConfigs.GetProbe() {
-		ret = append(ret, newProbe(p))
+	for i, p := range probeConfigs.GetProbe() {
+		np := newProbe(p, emulators[i%len(emulators)])
+		np.id = i
+		ret = append(ret, np)
 	}
 	return ret
 }
 
+// Subscribe the app to the topics of TOPIC probes before they start sending, logging the latency of each
+// subscription. Probes on the same emulator that share a topic share a single subscription
+func subscribeTopics(ps []*probe) {
+	subscribed := make(map[*emulator]map[string]bool)
+	for _, p := range ps {
+		if p.config.GetType() != controller.ProbeType_TOPIC || subscribed[p.device][p.topic()] {
+			continue
+		}
+		if subscribed[p.device] == nil {
+			subscribed[p.device] = make(map[string]bool)
+		}
+		subscribed[p.device][p.topic()] = true
+		p.device.topics = append(p.device.topics, p.topic())
+		start, rt, err := p.device.subscribeTopic(p.topic())
+		sp := newSentProbe(start, p)
+		if err != nil {
+			logger.LogErrorf("subscribeTopics: unable to subscribe %s to topic %s: %v", p.device.serial, p.topic(), err)
+			logger.LogProbe(sp, "subscribe_error", -1)
+			continue
+		}
+		lat, err := sp.calculateLatency(rt)
+		if err != nil {
+			logger.LogProbe(sp, "subscribe_error", -1)
+			continue
+		}
+		logger.LogProbe(sp, "subscribed", lat)
+	}
+}
+
 func startProbes(ps []*probe) *sync.WaitGroup {
 	pwg := new(sync.WaitGroup)
 	for _, p := range ps {
@@ -138,13 +269,36 @@ func startProbes(ps []*probe) *sync.WaitGroup {
 	return pwg
 }
 
+// Whether probes continue to send, which is false once probing stops
+func isProbing() bool {
+	probeLock.Lock()
+	defer probeLock.Unlock()
+	return probing
+}
+
 func stopProbes(pwg *sync.WaitGroup) {
 	probeLock.Lock()
 	probing = false
 	probeLock.Unlock()
+	wakeSenders()
 	pwg.Wait()
 }
 
+// Start the watchdog and the periodic clock synchronization, which stop together
+func startWatchdog() (chan struct{}, *sync.WaitGroup) {
+	stop := make(chan struct{})
+	wwg := new(sync.WaitGroup)
+	wwg.Add(2)
+	go watchEmulators(stop, wwg)
+	go syncClocks(stop, wwg)
+	return stop, wwg
+}
+
+func stopWatchdog(stop chan struct{}, wwg *sync.WaitGroup) {
+	close(stop)
+	wwg.Wait()
+}
+
 func startResolver() (*sync.WaitGroup, error) {
 	rwg := new(sync.WaitGroup)
 	rwg.Add(1)
@@ -162,5 +316,8 @@ func stopResolver(rwg *sync.WaitGroup) {
 }
 
 func deleteVM() {
-	maker.Command("gcloud", "compute", "instances", "delete", hostname, "--zone", hostname, "--quiet")
+	err := maker.Command("gcloud", "compute", "instances", "delete", hostname, "--zone", zone, "--quiet").Run()
+	if err != nil {
+		logger.LogErrorf("deleteVM: unable to delete VM %s in zone %s: %v", hostname, zone, err)
+	}
 }
@@ -17,11 +17,13 @@
 package probe
 
 import (
+	"os"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/fakefcm"
 	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
 )
 
@@ -49,6 +51,7 @@ func equals(o1 *controller.ProbeConfig, o2 *controller.ProbeConfig) bool {
 
 func TestMakeProbes(t *testing.T) {
 	probeConfigs = makeTestProbeConfigs()
+	emulators = []*emulator{newEmulator(0, "AVD"), newEmulator(1, "AVD")}
 	compareConfig := makeTestProbeConfig()
 	testProbes := makeProbes()
 	for i := 0; i < numProbes; i++ {
@@ -56,6 +59,10 @@ func TestMakeProbes(t *testing.T) {
 			t.Log("TestMakeProbes: probe's config does not match provided config")
 			t.Fail()
 		}
+		if testProbes[i].device != emulators[i%2] {
+			t.Logf("TestMakeProbes: probe %d not spread across emulators", i)
+			t.Fail()
+		}
 	}
 }
 
@@ -64,7 +71,7 @@ func TestStartProbes(t *testing.T) {
 	testConfig := makeTestProbeConfig()
 	var testProbes []*probe
 	for i := 0; i < numProbes; i++ {
-		testProbes = append(testProbes, newProbe(testConfig))
+		testProbes = append(testProbes, newProbe(testConfig, newTestEmulator()))
 	}
 	pwg := startProbes(testProbes)
 	pwg.Wait()
@@ -77,20 +84,21 @@ func TestStopProbes(t *testing.T) {
 	pwg := new(sync.WaitGroup)
 	for i := 0; i < numProbes; i++ {
 		pwg.Add(1)
-		go newProbe(testConfig).probe(pwg)
+		go newProbe(testConfig, newTestEmulator()).probe(pwg)
 	}
 	stopProbes(pwg)
 }
 
 func TestStartResolver(t *testing.T) {
 	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
-	maker = utils.NewFakeCommandMaker([]string{"0.0"}, []bool{false}, false)
+	defer startFakeAdb(t, fakefcm.NewDevice("TEST_TOKEN")).Close()
+	emulators = []*emulator{newTestEmulator()}
 	rwg, err := startResolver()
 	if err != nil {
 		t.Logf("TestStartResolver: error returned on valid input")
 		t.FailNow()
 	}
-	addProbe(nil)
+	closeUnresolved()
 	rwg.Wait()
 }
 
@@ -100,3 +108,81 @@ func TestStopResolver(t *testing.T) {
 	go resolveProbes(rwg)
 	stopResolver(rwg)
 }
+
+func TestRunProbes(t *testing.T) {
+	probing = true
+	probeConfigs = makeTestProbeConfigs()
+	emulatorCount = 1
+	path, cleanup := tempJournalPath(t)
+	defer cleanup()
+	metadata = &controller.MetadataConfig{TokenRetries: 1, InflightLog: path}
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	// Tokens cached by other tests would let probes send to the real FCM endpoint
+	fcmAuth = Auth{}
+	// Emulator, app, token and clock offset commands all succeed, after which probes send repeatedly
+	dev := fakefcm.NewDevice("TEST_TOKEN")
+	maker = dev
+	defer startFakeAdb(t, dev).Close()
+	logger = new(fakeLogger)
+	waited := false
+
+	err := runProbes(func() error {
+		waited = true
+		return nil
+	})
+
+	if err != nil {
+		t.Logf("TestRunProbes: error returned on valid input: %v", err)
+		t.Fail()
+	}
+	if !waited || probing {
+		t.Log("TestRunProbes: probes not stopped after waiting")
+		t.Fail()
+	}
+}
+
+func TestWaitForInterrupt(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	go func() {
+		c <- os.Interrupt
+	}()
+	waitForInterrupt(c)
+}
+
+func TestSubscribeTopics(t *testing.T) {
+	devs := []*fakefcm.Device{fakefcm.NewDevice("DEVICE_TOKEN_1"), fakefcm.NewDevice("DEVICE_TOKEN_2")}
+	maker = fakefcm.NewEmulators(devs...)
+	defer startFakeAdb(t, devs...).Close()
+	clock = new(utils.ProbeClock)
+	fl := new(fakeLogger)
+	logger = fl
+	em := []*emulator{newEmulator(0, "AVD"), newEmulator(1, "AVD")}
+	ps := []*probe{
+		newProbe(&controller.ProbeConfig{Type: controller.ProbeType_TOPIC, Topic: "TOPIC_1"}, em[0]),
+		newProbe(&controller.ProbeConfig{Type: controller.ProbeType_TOPIC, Topic: "TOPIC_1"}, em[0]),
+		newProbe(&controller.ProbeConfig{Type: controller.ProbeType_TOPIC, Topic: "TOPIC_2"}, em[0]),
+		newProbe(&controller.ProbeConfig{Type: controller.ProbeType_TOPIC, Topic: "TOPIC_1"}, em[1]),
+		newProbe(&controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED}, em[1]),
+	}
+
+	subscribeTopics(ps)
+
+	if !devs[0].Subscribed("TOPIC_1") || !devs[0].Subscribed("TOPIC_2") || !devs[1].Subscribed("TOPIC_1") {
+		t.Log("TestSubscribeTopics: device not subscribed to every probe topic")
+		t.Fail()
+	}
+	if devs[1].Subscribed("TOPIC_2") {
+		t.Log("TestSubscribeTopics: device subscribed to topic of a probe on another device")
+		t.Fail()
+	}
+	if len(fl.testLogs) != 3 {
+		t.Logf("TestSubscribeTopics: incorrect number of subscriptions logged: actual: %d, expected: 3", len(fl.testLogs))
+		t.Fail()
+	}
+	for _, l := range fl.testLogs {
+		if l.state != "subscribed" || l.latency < 0 {
+			t.Logf("TestSubscribeTopics: incorrect subscription log: %+v", l)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,319 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/logsink"
+)
+
+const (
+	defaultLoggingEndpoint = "https://logging.googleapis.com"
+	defaultLogSpoolDir     = "log-spool"
+)
+
+// Create a sink from its configuration
+func newLogSink(cfg *controller.LogSink) (logsink.Sink, error) {
+	switch cfg.GetType() {
+	case controller.LogSinkType_GCLOUD:
+		return &logsink.GcloudSink{Maker: maker, Dest: cfg.GetDestination()}, nil
+	case controller.LogSinkType_STDOUT:
+		return &logsink.WriterSink{W: os.Stdout}, nil
+	case controller.LogSinkType_FILE:
+		return logsink.NewFileSink(cfg.GetDestination(), cfg.GetMaxSize(), time.Duration(cfg.GetMaxAge())*time.Second,
+			int(cfg.GetMaxFiles()))
+	case controller.LogSinkType_CLOUD_LOGGING:
+		return newCloudLoggingSink(cfg), nil
+	case controller.LogSinkType_HTTP:
+		return logsink.NewHttpSink(cfg.GetDestination())
+	case controller.LogSinkType_CONTROLLER:
+		return new(controllerSink), nil
+	}
+	return nil, fmt.Errorf("newLogSink: unsupported sink type: %s", cfg.GetType())
+}
+
+// Writes entries to Cloud Logging through its API, with the access token with which probes send
+type cloudLoggingSink struct {
+	endpoint string
+	logName  string
+	client   *http.Client
+}
+
+type logEntry struct {
+	JsonPayload json.RawMessage `json:"jsonPayload"`
+}
+
+type writeEntriesRequest struct {
+	LogName  string            `json:"logName"`
+	Resource map[string]string `json:"resource"`
+	Entries  []*logEntry       `json:"entries"`
+}
+
+func newCloudLoggingSink(cfg *controller.LogSink) *cloudLoggingSink {
+	ep := cfg.GetEndpoint()
+	if ep == "" {
+		ep = defaultLoggingEndpoint
+	}
+	return &cloudLoggingSink{strings.TrimSuffix(ep, "/"), cfg.GetDestination(), &http.Client{Timeout: logsink.SinkTimeout}}
+}
+
+func (c *cloudLoggingSink) Write(entries [][]byte) error {
+	auth, err := fcmAuth.getToken()
+	if err != nil {
+		return err
+	}
+	req := &writeEntriesRequest{
+		LogName:  fmt.Sprintf("projects/%s/logs/%s", metadata.GetAccount().GetGcpProject(), c.logName),
+		Resource: map[string]string{"type": "global"},
+	}
+	for _, e := range entries {
+		req.Entries = append(req.Entries, &logEntry{e})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return logsink.PostJson(c.client, c.endpoint+"/v2/entries:write", auth, body)
+}
+
+func (c *cloudLoggingSink) Close() error {
+	return nil
+}
+
+// Reports errors to the controller, which logs them with the VM from which they came
+type controllerSink struct{}
+
+func (c *controllerSink) Write(entries [][]byte) error {
+	var errs []*controller.ProbeError
+	for _, e := range entries {
+		el := new(errorLog)
+		err := json.Unmarshal(e, el)
+		if err != nil {
+			return fmt.Errorf("controllerSink: entry is not an error: %v", err)
+		}
+		errs = append(errs, &controller.ProbeError{Description: el.Desc, Region: el.Region})
+	}
+	return reportErrors(errs)
+}
+
+func (c *controllerSink) Close() error {
+	return nil
+}
+
+// Logger that writes each kind of log to every sink configured for it. Kinds without sinks are written by the
+// fallback logger
+type sinkLogger struct {
+	region     string
+	probeSinks []logsink.Sink
+	errorSinks []logsink.Sink
+	fallback   Logger
+	lock       sync.Mutex
+}
+
+// Create the sinks configured for probe results and errors, in front of the fallback logger. Each sink is written
+// in batches, spooling to a file named by the kind of log and the sink's index in its configuration. Unless errors
+// are already reported to the controller, errors that cannot be written to their sinks are reported to it before
+// they are spooled
+func newSinkLogger(probes []*controller.LogSink, errs []*controller.LogSink, fallback Logger) (*sinkLogger, error) {
+	for _, cfg := range probes {
+		if cfg.GetType() == controller.LogSinkType_CONTROLLER {
+			return nil, fmt.Errorf("newSinkLogger: CONTROLLER sinks only accept errors")
+		}
+	}
+	var report logsink.Sink
+	if !standalone {
+		report = new(controllerSink)
+	}
+	for _, cfg := range errs {
+		if cfg.GetType() == controller.LogSinkType_CONTROLLER {
+			report = nil
+		}
+	}
+	ret := &sinkLogger{fallback: fallback}
+	var err error
+	ret.probeSinks, err = newBatchedSinks("probes", probes, nil)
+	if err == nil {
+		ret.errorSinks, err = newBatchedSinks("errors", errs, report)
+	}
+	if err != nil {
+		ret.close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func newBatchedSinks(kind string, cfgs []*controller.LogSink, report logsink.Sink) ([]logsink.Sink, error) {
+	var ret []logsink.Sink
+	for i, cfg := range cfgs {
+		s, err := newLogSink(cfg)
+		if err != nil {
+			for _, s := range ret {
+				s.Close()
+			}
+			return nil, err
+		}
+		spool := filepath.Join(getLogSpoolDir(), fmt.Sprintf("%s-%d.spool", kind, i))
+		ret = append(ret, logsink.NewBatchedSink(s, report, spool, getLogBatchConfig()))
+	}
+	return ret, nil
+}
+
+func (s *sinkLogger) SetRegion(reg string) {
+	s.region = reg
+	s.fallback.SetRegion(reg)
+}
+
+// Destinations of the fallback logger, since sinks are configured with their own
+func (s *sinkLogger) SetError(dest string) {
+	s.fallback.SetError(dest)
+}
+
+func (s *sinkLogger) SetLog(dest string) {
+	s.fallback.SetLog(dest)
+}
+
+// Write probe information to every probe sink
+func (s *sinkLogger) LogProbe(sp *sentProbe, st string, lat int) {
+	if len(s.probeSinks) == 0 {
+		s.fallback.LogProbe(sp, st, lat)
+		return
+	}
+	l, err := json.Marshal(newProbeLog(sp, st, lat, s.region))
+	if err != nil {
+		s.LogError(fmt.Sprintf("Unable to log probe: unable to marshal JSON: %v", err))
+		return
+	}
+	s.fanOut(s.probeSinks, l)
+}
+
+// Write errors to every error sink
+func (s *sinkLogger) LogError(desc string) {
+	if len(s.errorSinks) == 0 {
+		s.fallback.LogError(desc)
+		return
+	}
+	l, err := json.Marshal(&errorLog{desc, s.region})
+	if err != nil {
+		log.Printf("Unable to log error: unable to marshal JSON: %v", err)
+		return
+	}
+	s.fanOut(s.errorSinks, l)
+}
+
+// Write an entry to each of the sinks, which queue it to be written in the background. A sink that fails does not
+// prevent writing to the others
+func (s *sinkLogger) fanOut(sinks []logsink.Sink, entry []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, sink := range sinks {
+		err := sink.Write([][]byte{entry})
+		if err != nil {
+			log.Printf("Unable to write log: %v", err)
+		}
+	}
+}
+
+func (s *sinkLogger) LogErrorf(desc string, args ...interface{}) {
+	s.LogError(fmt.Sprintf(desc, args...))
+}
+
+func (s *sinkLogger) LogFatal(desc string) {
+	s.LogError(fmt.Sprintf("fatal: %s", desc))
+	s.close()
+	os.Exit(1)
+}
+
+func (s *sinkLogger) LogFatalf(desc string, args ...interface{}) {
+	s.LogError(fmt.Sprintf("fatal: "+desc, args...))
+	s.close()
+	os.Exit(1)
+}
+
+// Flush the entries queued for each sink and close it
+func (s *sinkLogger) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, sinks := range [][]logsink.Sink{s.probeSinks, s.errorSinks} {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+	}
+}
+
+// Write logs to the sinks configured in metadata, in front of the current logger. A kind of log without sinks is
+// written to the destination of the current logger, if it is a CloudLogger or StdoutLogger, so that it is also
+// written in the background
+func configureLogging(region string) {
+	probes, errs := metadata.GetProbeLogSinks(), metadata.GetErrorLogSinks()
+	var def *controller.LogSink
+	var errDef *controller.LogSink
+	switch l := logger.(type) {
+	case *CloudLogger:
+		def = &controller.LogSink{Type: controller.LogSinkType_GCLOUD, Destination: l.LogDest}
+		errDef = &controller.LogSink{Type: controller.LogSinkType_GCLOUD, Destination: l.ErrorDest}
+	case *StdoutLogger:
+		def = &controller.LogSink{Type: controller.LogSinkType_STDOUT}
+		errDef = def
+	}
+	if len(probes) == 0 && def != nil {
+		probes = []*controller.LogSink{def}
+	}
+	if len(errs) == 0 && errDef != nil {
+		errs = []*controller.LogSink{errDef}
+	}
+	if len(probes) == 0 && len(errs) == 0 {
+		return
+	}
+	sl, err := newSinkLogger(probes, errs, logger)
+	if err != nil {
+		logger.LogErrorf("configureLogging: unable to create log sinks: %v", err)
+		return
+	}
+	sl.region = region
+	logger = sl
+}
+
+// Close the sinks configured in metadata, if logs are written to any
+func closeLogging() {
+	if sl, ok := logger.(*sinkLogger); ok {
+		sl.close()
+	}
+}
+
+// Batching and spooling settings in metadata. Settings that are not provided take the batched sink's defaults
+func getLogBatchConfig() logsink.BatchConfig {
+	return logsink.BatchConfig{BatchSize: int(metadata.GetLogBatchSize()),
+		Interval: time.Duration(metadata.GetLogFlushInterval()) * time.Second, Retries: int(metadata.GetLogRetries()),
+		MaxSpool: metadata.GetLogSpoolSize()}
+}
+
+func getLogSpoolDir() string {
+	if metadata.GetLogSpoolDir() == "" {
+		return defaultLogSpoolDir
+	}
+	return metadata.GetLogSpoolDir()
+}
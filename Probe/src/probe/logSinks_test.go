@@ -0,0 +1,164 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/logsink"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+func TestCloudLoggingSink(t *testing.T) {
+	var body writeEntriesRequest
+	var auth, path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer srv.Close()
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	fcmAuth = Auth{Token: "TOKEN", deadline: time.Unix(100, 0)}
+	defer func() { fcmAuth = Auth{} }()
+	metadata = &controller.MetadataConfig{Account: &controller.AccountInfo{GcpProject: "PROJECT"}}
+	cs := newCloudLoggingSink(&controller.LogSink{Destination: "probes", Endpoint: srv.URL})
+
+	err := cs.Write([][]byte{[]byte(`{"state":"resolved"}`), []byte(`{"state":"timeout"}`)})
+
+	if err != nil {
+		t.Logf("TestCloudLoggingSink: error on valid write: %v", err)
+		t.FailNow()
+	}
+	if path != "/v2/entries:write" || auth != "Bearer TOKEN" {
+		t.Logf("TestCloudLoggingSink: incorrect request: %s %s", path, auth)
+		t.Fail()
+	}
+	if body.LogName != "projects/PROJECT/logs/probes" || len(body.Entries) != 2 ||
+		string(body.Entries[1].JsonPayload) != `{"state":"timeout"}` {
+		t.Logf("TestCloudLoggingSink: incorrect entries written: %+v", body)
+		t.Fail()
+	}
+}
+
+func TestControllerSink(t *testing.T) {
+	tc := new(TestClient)
+	client = tc
+	defer func() { client = nil }()
+	hostname = "VM"
+	s, _ := newLogSink(&controller.LogSink{Type: controller.LogSinkType_CONTROLLER})
+
+	err := s.Write([][]byte{[]byte(`{"description":"FIRST","region":"REGION"}`), []byte(`{"description":"SECOND"}`)})
+
+	if err != nil || len(tc.reported) != 1 || len(tc.reported[0].GetErrors()) != 2 {
+		t.Logf("TestControllerSink: errors not reported in a single request: %v %v", tc.reported, err)
+		t.FailNow()
+	}
+	if e := tc.reported[0].GetErrors()[0]; e.GetDescription() != "FIRST" || e.GetRegion() != "REGION" {
+		t.Logf("TestControllerSink: incorrect error reported: %v", e)
+		t.Fail()
+	}
+}
+
+func TestSinkLogger(t *testing.T) {
+	fl := new(fakeLogger)
+	first, second := new(bytes.Buffer), new(bytes.Buffer)
+	sl := &sinkLogger{region: "REGION", probeSinks: []logsink.Sink{&logsink.WriterSink{W: first}, &logsink.WriterSink{W: second}}, fallback: fl}
+	sp := newSentProbe(time.Unix(1, 0), newProbe(&controller.ProbeConfig{}, newTestEmulator()))
+
+	sl.LogProbe(sp, "resolved", 10)
+	sl.LogError("ERROR")
+
+	for _, b := range []*bytes.Buffer{first, second} {
+		pl := new(probeLog)
+		err := json.Unmarshal(b.Bytes(), pl)
+		if err != nil || pl.State != "resolved" || pl.Region != "REGION" || pl.Latency != 10 {
+			t.Logf("TestSinkLogger: probe not written to every sink: %q", b)
+			t.Fail()
+		}
+	}
+	if len(fl.testLogs) != 0 || len(fl.errLogs) != 1 {
+		t.Logf("TestSinkLogger: errors without sinks not written by the fallback logger: %v", fl.errLogs)
+		t.Fail()
+	}
+}
+
+func TestNewSinkLoggerInvalid(t *testing.T) {
+	_, err := newSinkLogger([]*controller.LogSink{{Type: controller.LogSinkType_STDOUT}},
+		[]*controller.LogSink{{Type: controller.LogSinkType_HTTP}}, new(fakeLogger))
+
+	if err == nil {
+		t.Log("TestNewSinkLoggerInvalid: no error on HTTP sink without a URL")
+		t.Fail()
+	}
+}
+
+func TestNewSinkLoggerControllerProbes(t *testing.T) {
+	_, err := newSinkLogger([]*controller.LogSink{{Type: controller.LogSinkType_CONTROLLER}}, nil,
+		new(fakeLogger))
+
+	if err == nil {
+		t.Log("TestNewSinkLoggerControllerProbes: no error on probe results reported to the controller")
+		t.Fail()
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configureLogging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	metadata = &controller.MetadataConfig{LogSpoolDir: dir, ErrorLogSinks: []*controller.LogSink{
+		{Type: controller.LogSinkType_FILE, Destination: filepath.Join(dir, "errors.log")}}}
+	logger = &CloudLogger{"REGION", "PROBES", "ERRORS"}
+
+	configureLogging("REGION")
+	defer closeLogging()
+
+	sl, ok := logger.(*sinkLogger)
+	if !ok {
+		t.Log("TestConfigureLogging: logger not replaced with sinks")
+		t.FailNow()
+	}
+	if len(sl.probeSinks) != 1 || len(sl.errorSinks) != 1 {
+		t.Logf("TestConfigureLogging: incorrect sinks: %d probe, %d error", len(sl.probeSinks), len(sl.errorSinks))
+		t.FailNow()
+	}
+	// Probe results without configured sinks are written in the background to the CloudLogger's destination
+	if gs, ok := sl.probeSinks[0].(*logsink.BatchedSink).Sink().(*logsink.GcloudSink); !ok || gs.Dest != "PROBES" {
+		t.Logf("TestConfigureLogging: probe results not written to the default destination: %+v", sl.probeSinks[0])
+		t.Fail()
+	}
+	if _, ok := sl.errorSinks[0].(*logsink.BatchedSink).Sink().(*logsink.FileSink); !ok {
+		t.Logf("TestConfigureLogging: errors not written to their configured sink: %+v", sl.errorSinks[0])
+		t.Fail()
+	}
+	if _, ok := sl.errorSinks[0].(*logsink.BatchedSink).Report().(*controllerSink); !ok {
+		t.Log("TestConfigureLogging: errors that cannot be written not reported to the controller")
+		t.Fail()
+	}
+}
@@ -21,6 +21,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
 )
 
 // Wrapper for logging
@@ -28,7 +30,7 @@ type Logger interface {
 	SetRegion(reg string)
 	SetError(dest string)
 	SetLog(dest string)
-	LogProbe(sp *sentProbe, st string, lat int, tok string)
+	LogProbe(sp *sentProbe, st string, lat int)
 	LogError(desc string)
 	LogErrorf(desc string, args ...interface{})
 	LogFatal(desc string)
@@ -46,13 +48,55 @@ func NewCloudLogger() *CloudLogger {
 	return &CloudLogger{"unspecified", "defaultLog", "defaultError"}
 }
 
+// Logger that writes probes and errors to stdout as JSON lines, for use without Cloud Logging
+type StdoutLogger struct {
+	Region string // Region in which probes are running
+}
+
 type probeLog struct {
-	SendTime  string `json:"sendTime"`  // Send time of probe
-	ProbeType string `json:"probeType"` // Type of probe
-	Latency   int    `json:"latency"`   // Latency of probe
-	State     string `json:"state"`     // State of probe
-	Region    string `json:"region"`    // Region in which VM is located
-	Token     string `json:"token"`     // Device token of device on which the app is located
+	SendTime     string `json:"sendTime"`               // Send time of probe
+	ProbeType    string `json:"probeType"`              // Type of probe
+	Latency      int    `json:"latency"`                // Latency of probe
+	State        string `json:"state"`                  // State of probe
+	Region       string `json:"region"`                 // Region in which VM is located
+	Device       string `json:"device"`                 // Serial of the emulator on which the app is located
+	Token        string `json:"token"`                  // Device token of device on which the app is located
+	Message      string `json:"message"`                // Name assigned to the message by FCM
+	Topic        string `json:"topic,omitempty"`        // Topic to which the message was sent, for TOPIC probes
+	Priority     string `json:"priority"`               // Android priority with which the message was sent
+	Ttl          string `json:"ttl,omitempty"`          // Android TTL with which the message was sent, if set
+	CollapseKey  string `json:"collapseKey,omitempty"`  // Collapse key with which the message was sent, if set
+	DirectBootOk bool   `json:"directBootOk,omitempty"` // Whether the message may be delivered in direct boot mode
+	Delivered    *int   `json:"delivered,omitempty"`    // Number of messages in the burst delivered, for COLLAPSE probes
+	PayloadSize  int    `json:"payloadSize,omitempty"`  // Size of the data payload, if it was padded to a size
+	Probe        int    `json:"probe"`                  // Index of the probe in the configuration
+	Sequence     int64  `json:"sequence"`               // Sequence number of the message among the probe's messages
+	Reorder      int    `json:"reorder,omitempty"`      // How far the message arrived behind the probe's latest message
+	Gap          int    `json:"gap,omitempty"`          // Number of the probe's earlier messages skipped on arrival
+	Reordered    int    `json:"reordered,omitempty"`    // Number of the probe's messages so far that arrived out of order
+	Gaps         int    `json:"gaps,omitempty"`         // Number of the probe's messages so far that arrived after a gap
+	Uncertainty  *int   `json:"uncertainty,omitempty"`  // Maximum error in milliseconds of the clock offset applied to the latency
+	ClockVersion int    `json:"clockVersion,omitempty"` // Version of the clock offset estimate applied to the latency
+	Drifted      bool   `json:"drifted,omitempty"`      // Whether the clock drifted beyond the threshold before the estimate
+}
+
+func newProbeLog(sp *sentProbe, st string, lat int, region string) *probeLog {
+	opts := sp.probe.config.GetAndroid()
+	dev := sp.probe.device
+	ret := &probeLog{sp.sendTime.Format(timeLogFormat), sp.probe.config.Type.String(), lat, st, region, dev.serial,
+		dev.registration(), sp.name,
+		sp.topic(), opts.GetPriority().String(), opts.GetTtl(), opts.GetCollapseKey(), opts.GetDirectBootOk(), nil,
+		sp.payloadSize, sp.probe.id, sp.sequence, sp.reorder, sp.gap, sp.reordered, sp.gaps, nil, 0, false}
+	if sp.clock != nil {
+		ret.Uncertainty = &sp.clock.uncertainty
+		ret.ClockVersion = sp.clock.version
+		ret.Drifted = sp.clock.drifted()
+	}
+	if sp.probe.config.GetType() == controller.ProbeType_COLLAPSE {
+		ret.CollapseKey = sp.probe.collapseKey()
+		ret.Delivered = &sp.delivered
+	}
+	return ret
 }
 
 type errorLog struct {
@@ -76,10 +120,8 @@ func (c *CloudLogger) SetLog(dest string) {
 }
 
 // Log probe information to specified log
-func (c *CloudLogger) LogProbe(sp *sentProbe, st string, lat int, tok string) {
-	cl := &probeLog{sp.sendTime.Format(timeLogFormat), sp.probe.config.Type.String(), lat, st,
-		c.Region, tok}
-	l, err := json.Marshal(cl)
+func (c *CloudLogger) LogProbe(sp *sentProbe, st string, lat int) {
+	l, err := json.Marshal(newProbeLog(sp, st, lat, c.Region))
 	if err != nil {
 		c.LogError(fmt.Sprintf("Unable to log probe: unable to marshal JSON: %v", err))
 		return
@@ -92,13 +134,11 @@ func (c *CloudLogger) LogProbe(sp *sentProbe, st string, lat int, tok string) {
 	}
 }
 
-// Log errors to specified log
+// Log errors to specified log, reporting them to the controller if they cannot be sent
 func (c *CloudLogger) LogError(desc string) {
 	//TODO(langenbahn) add any other useful information for errors
 	el := &errorLog{desc, c.Region}
 	l, err := json.Marshal(el)
-	//TODO(langenbahn): in the case that an error message cannot be sent to the server,
-	//send through gRPC connection if available
 	if err != nil {
 		log.Printf("Unable to log error: unable to marshal JSON: %v", err)
 		return
@@ -108,6 +148,10 @@ func (c *CloudLogger) LogError(desc string) {
 		"--payload-type=json", c.ErrorDest, string(l)).Run()
 	if err != nil {
 		log.Printf("Unable to log error: unable to send to server: %v", err)
+		err = reportErrors([]*controller.ProbeError{{Description: desc, Region: c.Region}})
+		if err != nil {
+			log.Printf("Unable to report error to controller: %v", err)
+		}
 	}
 }
 
@@ -127,3 +171,49 @@ func (c *CloudLogger) LogFatalf(desc string, args ...interface{}) {
 	c.LogError(fmt.Sprintf("fatal: "+desc, args...))
 	os.Exit(1)
 }
+
+// Set the region in which probes are running
+func (s *StdoutLogger) SetRegion(reg string) {
+	s.Region = reg
+}
+
+// Destinations only apply to Cloud Logging
+func (s *StdoutLogger) SetError(dest string) {}
+func (s *StdoutLogger) SetLog(dest string)   {}
+
+// Write probe information to stdout
+func (s *StdoutLogger) LogProbe(sp *sentProbe, st string, lat int) {
+	l, err := json.Marshal(newProbeLog(sp, st, lat, s.Region))
+	if err != nil {
+		s.LogError(fmt.Sprintf("Unable to log probe: unable to marshal JSON: %v", err))
+		return
+	}
+	fmt.Println(string(l))
+}
+
+// Write errors to stdout
+func (s *StdoutLogger) LogError(desc string) {
+	l, err := json.Marshal(&errorLog{desc, s.Region})
+	if err != nil {
+		log.Printf("Unable to log error: unable to marshal JSON: %v", err)
+		return
+	}
+	fmt.Println(string(l))
+}
+
+// Write errors with format to stdout
+func (s *StdoutLogger) LogErrorf(desc string, args ...interface{}) {
+	s.LogError(fmt.Sprintf(desc, args...))
+}
+
+// Write error to stdout and terminate
+func (s *StdoutLogger) LogFatal(desc string) {
+	s.LogError(fmt.Sprintf("fatal: %s", desc))
+	os.Exit(1)
+}
+
+// Write error with format to stdout and terminate
+func (s *StdoutLogger) LogFatalf(desc string, args ...interface{}) {
+	s.LogError(fmt.Sprintf("fatal: "+desc, args...))
+	os.Exit(1)
+}
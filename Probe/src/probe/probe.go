@@ -16,6 +16,7 @@
 
 /*
 Package probe implements an FCM probe that will:
+
 	Initialize a new emulator and target app
 	Send a specified number of messages to the app
 	Attempt to verify that the app received those messages
@@ -25,7 +26,6 @@ Package probe implements an FCM probe that will:
 package probe
 
 import (
-	"log"
 	"sync"
 	"time"
 
@@ -35,30 +35,175 @@ import (
 const timeFileFormat = "2006-01-02-T150405.000-Z0700"
 const timeLogFormat = time.UnixDate
 
+const (
+	// Prefix of the topic to which TOPIC probes send when none is configured, which is followed by the VM and
+	// emulator so that each emulator receives only its own probes' messages
+	defaultTopicPrefix = "fcm-external-prober"
+	// Defaults for COLLAPSE probes
+	defaultCollapseKey     = "fcm-external-prober"
+	defaultBurstSize       = 3
+	defaultOfflineDuration = 10 // Seconds
+	// Interval between messages in a burst, so that their send times, which identify their receipts, differ
+	burstInterval = 100 * time.Millisecond
+)
+
 type probe struct {
-	config *controller.ProbeConfig
+	config    *controller.ProbeConfig
+	id        int       // Index of the probe in the configuration
+	device    *emulator // Emulator to which the probe sends
+	sizeIndex int       // Index of the payload size of the next message
+	sequence  int64     // Sequence number of the last message accepted by FCM, stamped into each message's data
+	entry     int64     // ID in the journal of the last message sent, or 0 if it was not recorded
 }
 
-func newProbe(cfg *controller.ProbeConfig) *probe {
+func newProbe(cfg *controller.ProbeConfig, dev *emulator) *probe {
 	ret := new(probe)
 	ret.config = cfg
+	ret.device = dev
+	return ret
+}
+
+// Topic to which the probe sends, if it is a TOPIC probe
+func (p *probe) topic() string {
+	if p.config.GetTopic() == "" {
+		return defaultTopicPrefix + "-" + hostname + "-" + p.device.serial
+	}
+	return p.config.GetTopic()
+}
+
+// Collapse key with which the probe sends, if it is a COLLAPSE probe
+func (p *probe) collapseKey() string {
+	if p.config.GetAndroid().GetCollapseKey() == "" {
+		return defaultCollapseKey
+	}
+	return p.config.GetAndroid().GetCollapseKey()
+}
+
+func (p *probe) burstSize() int {
+	if p.config.GetBurstSize() <= 0 {
+		return defaultBurstSize
+	}
+	return int(p.config.GetBurstSize())
+}
+
+func (p *probe) offlineDuration() time.Duration {
+	if p.config.GetOfflineDuration() <= 0 {
+		return defaultOfflineDuration * time.Second
+	}
+	return time.Duration(p.config.GetOfflineDuration()) * time.Second
+}
+
+// Payload size of the next message, cycling through the configured sizes, or 0 if none are configured
+func (p *probe) nextPayloadSize() int {
+	sizes := p.config.GetPayloadSizes()
+	if len(sizes) == 0 {
+		return 0
+	}
+	ret := int(sizes[p.sizeIndex%len(sizes)])
+	p.sizeIndex++
 	return ret
 }
 
+// State with which a failed send is logged. Messages rejected for exceeding FCM's payload size limit are
+// distinguished from other failures
+func sendErrorState(err error) string {
+	if fe, ok := err.(*FcmError); ok && fe.oversize() {
+		return "oversize"
+	}
+	return "send_error"
+}
+
 func (p *probe) probe(pwg *sync.WaitGroup) {
-	if p.config.GetType() == controller.ProbeType_UNSPECIFIED {
-		for probing {
-			tim := clock.Now()
-			err := fcmAuth.sendMessage(tim.Format(timeFileFormat), int(p.config.GetType()))
+	switch p.config.GetType() {
+	case controller.ProbeType_UNSPECIFIED, controller.ProbeType_TOPIC:
+		for isProbing() {
+			if !p.device.waitAvailable() {
+				break
+			}
+			if !admitProbe() {
+				logger.LogProbe(newSentProbe(clock.Now(), p), "skipped_backpressure", -1)
+				time.Sleep(time.Duration(p.config.GetSendInterval()) * time.Second)
+				continue
+			}
+			size := p.nextPayloadSize()
+			tim, name, err := fcmAuth.sendMessage(p, size)
 			if err != nil {
-				log.Printf("probe: unable to send message: %s", err.Error())
+				// An FcmError describes itself by its HTTP status and FCM error code
+				logger.LogErrorf("probe: unable to send message of probe %d: %v", p.id, err)
+				// Failures once an access token is acquired are logged as results, so that FCM's rejections count
+				// against availability and sizes can be compared when sweeping payload sizes
+				if !tim.IsZero() {
+					sp := newSentProbe(tim, p)
+					sp.payloadSize = size
+					logger.LogProbe(sp, sendErrorState(err), -1)
+				}
+				// Failed sends keep the interval, so that sizes rejected immediately do not skew the cadence of a sweep
+				time.Sleep(time.Duration(p.config.GetSendInterval()) * time.Second)
 				continue
 			}
 			sp := newSentProbe(tim, p)
+			sp.name = name
+			sp.payloadSize = size
+			sp.sequence = p.sequence
+			sp.entry = p.entry
 			addProbe(sp)
 			// Time interval between probes
 			time.Sleep(time.Duration(p.config.GetSendInterval()) * time.Second)
 		}
+	case controller.ProbeType_COLLAPSE:
+		for isProbing() {
+			if !p.device.waitAvailable() {
+				break
+			}
+			p.probeCollapse()
+			time.Sleep(time.Duration(p.config.GetSendInterval()) * time.Second)
+		}
+	default:
+		logger.LogErrorf("probe: unsupported probe type: %s", p.config.GetType())
 	}
 	pwg.Done()
 }
+
+// Send a burst of messages with the same collapse key while the device is offline, then bring the device back online
+// and check that only the latest message is delivered. Other probes on the emulator pause while it is offline
+func (p *probe) probeCollapse() {
+	if !p.device.holdOffline() {
+		// The emulator became unavailable, or another COLLAPSE probe took it offline, since it was last checked
+		return
+	}
+	err := p.device.setOnline(false)
+	if err != nil {
+		logger.LogErrorf("probeCollapse: unable to take device offline: %v", err)
+		p.restoreNetwork()
+		return
+	}
+	var burst []*sentProbe
+	for i := 0; i < p.burstSize() && isProbing(); i++ {
+		if i > 0 {
+			time.Sleep(burstInterval)
+		}
+		tim, name, err := fcmAuth.sendMessage(p, 0)
+		if err != nil {
+			logger.LogErrorf("probeCollapse: unable to send message: %v", err)
+			continue
+		}
+		sp := newSentProbe(tim, p)
+		sp.name = name
+		sp.sequence = p.sequence
+		burst = append(burst, sp)
+	}
+	time.Sleep(p.offlineDuration())
+	p.restoreNetwork()
+	if len(burst) > 0 {
+		resolveCollapse(burst)
+	}
+}
+
+// Bring the device back online and release it to the emulator's other probes
+func (p *probe) restoreNetwork() {
+	err := p.device.setOnline(true)
+	if err != nil {
+		logger.LogErrorf("restoreNetwork: unable to bring device back online: %v", err)
+	}
+	p.device.releaseOffline()
+}
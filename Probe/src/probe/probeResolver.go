@@ -18,121 +18,552 @@ package probe
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+)
+
+const (
+	// Maximum number of outstanding probes, when not provided in metadata
+	defaultMaxUnresolved = 2000
+	// Interval at which the emulators' receipts are listed and matched against outstanding probes
+	resolveInterval = 500 * time.Millisecond
+	// Directory of the app's external storage in which it writes receipts
+	receiptDir = "logs/"
+	// Seconds for which finished probes are remembered, when not provided in metadata
+	defaultFinishedWindow = 600
 )
 
-const maxUnresolved int = 2000
+// Interval at which receipts of collapse key bursts are checked
+const collapsePollInterval = 1 * time.Second
 
 var (
-	resolve     bool
-	resolveLock sync.Mutex
-	closeLock   sync.Mutex
-	closed      bool
-	// Use buffered channel so that resolving blocks on having no probes to resolve
-	unresolved    chan *sentProbe
-	latencyOffset int
+	// Probes awaiting receipts, by emulator and receipt
+	outstanding     map[*emulator]map[string]*sentProbe
+	outstandingLock sync.Mutex
+	// Set once no more probes will be added, after which resolving stops when none are outstanding
+	closed bool
+	// Probes whose outcomes have been logged, by emulator and receipt, so that later receipts of their messages are
+	// noticed. Accessed only by the resolver
+	finished map[*emulator]map[string]*finishedProbe
+	// Order in which the messages of each probe have arrived. Accessed only by the resolver
+	ordering map[*probe]*arrivalOrder
+	// Probes abandoned under the DROP_OLDEST policy since the resolver last remembered them as finished. Guarded by
+	// outstandingLock
+	abandoned []*sentProbe
+	// Number of outstanding probes
+	unresolved int
+	// Signalled when probes stop being outstanding, waking senders waiting for the number outstanding to fall below
+	// the maximum
+	space *sync.Cond
+	// Number of probes resolved, reported to the controller with each ping
+	resolvedProbes int32
 )
 
 type sentProbe struct {
-	sendTime time.Time
-	probe    *probe
+	sendTime    time.Time
+	probe       *probe
+	name        string         // Name assigned to the message by FCM
+	delivered   int            // Number of messages in the burst that were delivered, for COLLAPSE probes
+	payloadSize int            // Size to which the message's data payload was padded, or 0 if it was not padded
+	outages     int            // Number of outages of the emulator before the probe was sent
+	sequence    int64          // Sequence number of the message among the probe's messages
+	reorder     int            // Sequence numbers by which the message arrived behind the probe's latest message
+	gap         int            // Number of the probe's messages before this one that had not arrived when it arrived
+	reordered   int            // Number of the probe's messages that had arrived behind a later one, including this one
+	gaps        int            // Number of the probe's messages that had arrived after a gap, including this one
+	clock       *clockEstimate // Clock offset estimate applied to the message's latency, if it was received
+	entry       int64          // ID of the message in the journal, or 0 if it was not recorded
+	recovered   bool           // Whether the message was sent before the probe restarted
+}
+
+// Latest arrival of a probe's messages, and counts of the probe's messages that arrived out of order
+type arrivalOrder struct {
+	latest    int64 // Sequence number of the latest message of the probe to arrive
+	reordered int   // Number of messages that arrived behind a later message
+	gaps      int   // Number of messages that arrived after a gap in the sequence
+}
+
+// A probe whose outcome has been logged
+type finishedProbe struct {
+	sp       *sentProbe
+	timedOut bool      // Whether the probe was timed out, rather than its receipt found
+	expires  time.Time // Time after which the probe is forgotten
 }
 
 func newSentProbe(tim time.Time, p *probe) *sentProbe {
-	return &sentProbe{tim, p}
+	p.device.lock.Lock()
+	defer p.device.lock.Unlock()
+	return &sentProbe{sendTime: tim, probe: p, outages: p.device.outages}
+}
+
+// Name of the file in which the app stores the receipt of the probe, without extension
+func (sp *sentProbe) receipt() string {
+	return fmt.Sprintf("%d%s", sp.probe.config.GetType(), sp.sendTime.Format(timeFileFormat))
+}
+
+// Time after which the probe is timed out if its receipt has not been found
+func (sp *sentProbe) deadline() time.Time {
+	return sp.sendTime.Add(time.Duration(sp.probe.config.GetReceiveTimeout()) * time.Second)
+}
+
+// Topic to which the probe was sent, if it was sent to a topic
+func (sp *sentProbe) topic() string {
+	if sp.probe.config.GetType() != controller.ProbeType_TOPIC {
+		return ""
+	}
+	return sp.probe.topic()
 }
 
 func initResolver() error {
-	unresolved = make(chan *sentProbe, maxUnresolved)
-	resolve = true
-	closed = false
-	var err error
-	latencyOffset, err = findTimeOffset()
-	if err != nil {
-		return err
+	resetResolver()
+	for _, e := range emulators {
+		err := e.syncClock()
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Forget all outstanding and finished probes
+func resetResolver() {
+	outstanding = make(map[*emulator]map[string]*sentProbe)
+	finished = make(map[*emulator]map[string]*finishedProbe)
+	ordering = make(map[*probe]*arrivalOrder)
+	abandoned = nil
+	unresolved = 0
+	space = sync.NewCond(&outstandingLock)
+	closed = false
+}
+
+// On each tick, match the receipts on each emulator against its outstanding probes, then time out probes past their
+// deadlines. The time at which a receipt is found does not affect the latency, which is calculated from the device
+// time the app records. Continues to resolve probes after no more messages are being sent
 func resolveProbes(wg *sync.WaitGroup) {
-	// Continue to resolve probes after no more messages are being sent
-	for resolve {
-		sp := removeProbe()
-		// use a nil value sent on the channel to indicate that there are no more probes
-		closeLock.Lock()
-		// If the channel is closed, repeatedly attempt to resolve each probe. Otherwise, add probe back to queue
-		if closed {
-			for !resolveProbe(sp) {
-			}
-		} else {
-			if !resolveProbe(sp) {
-				addProbe(sp)
+	defer wg.Done()
+	tick := time.NewTicker(resolveInterval)
+	defer tick.Stop()
+	for range tick.C {
+		now := clock.Now()
+		rememberAbandoned(now)
+		for e, probes := range pendingProbes() {
+			resolveDevice(e, probes, now)
+		}
+		expireProbes(now)
+		if drained() {
+			return
+		}
+	}
+}
+
+// Await the receipt of a sent probe. Probes are always added, even beyond the maximum, which is enforced before
+// sending by admitProbe, so that adding a probe never blocks
+func addProbe(sp *sentProbe) {
+	outstandingLock.Lock()
+	probes, ok := outstanding[sp.probe.device]
+	if !ok {
+		probes = make(map[string]*sentProbe)
+		outstanding[sp.probe.device] = probes
+	}
+	if _, ok := probes[sp.receipt()]; ok {
+		outstandingLock.Unlock()
+		// Probes of the same type sent to an emulator in the same millisecond share a receipt, so only the first is
+		// resolved
+		logger.LogProbe(sp, "error", -1)
+		journal.finish(sp.entry)
+		return
+	}
+	probes[sp.receipt()] = sp
+	unresolved++
+	outstandingLock.Unlock()
+}
+
+// Apply the overflow policy before a probe sends, if the maximum number of probes are outstanding. Returns whether
+// the probe should send. Under BLOCK, waits until a probe is finished or probing stops, under DROP_OLDEST, abandons
+// the oldest outstanding probes, and under SKIP, returns false
+func admitProbe() bool {
+	var dropped []*sentProbe
+	outstandingLock.Lock()
+	for unresolved >= getMaxUnresolved() && isProbing() {
+		if metadata.GetOverflowPolicy() == controller.OverflowPolicy_SKIP {
+			outstandingLock.Unlock()
+			return false
+		}
+		if metadata.GetOverflowPolicy() == controller.OverflowPolicy_DROP_OLDEST {
+			sp := oldestProbe()
+			delete(outstanding[sp.probe.device], sp.receipt())
+			unresolved--
+			dropped = append(dropped, sp)
+			// Finished probes are accessed only by the resolver, which remembers the probe so that a later receipt is
+			// logged as late
+			abandoned = append(abandoned, sp)
+			continue
+		}
+		space.Wait()
+	}
+	outstandingLock.Unlock()
+	for _, sp := range dropped {
+		logger.LogProbe(sp, "abandoned", -1)
+		journal.finish(sp.entry)
+	}
+	return true
+}
+
+// Outstanding probe sent earliest, or nil if none are outstanding. The caller must hold outstandingLock
+func oldestProbe() *sentProbe {
+	var ret *sentProbe
+	for _, probes := range outstanding {
+		for _, sp := range probes {
+			if ret == nil || sp.sendTime.Before(ret.sendTime) {
+				ret = sp
 			}
 		}
-		closeLock.Unlock()
 	}
-	wg.Done()
+	return ret
 }
 
-func stopResolving() {
-	resolveLock.Lock()
-	resolve = false
-	resolveLock.Unlock()
+// Wake senders waiting for outstanding probes to finish, so that they notice that probing has stopped
+func wakeSenders() {
+	if space == nil {
+		return
+	}
+	outstandingLock.Lock()
+	defer outstandingLock.Unlock()
+	space.Broadcast()
 }
 
-func addProbe(sp *sentProbe) {
-	unresolved <- sp
+// Number of outstanding probes, and the time since the oldest was sent, or 0 if none are outstanding
+func unresolvedStats() (int, time.Duration) {
+	outstandingLock.Lock()
+	defer outstandingLock.Unlock()
+	sp := oldestProbe()
+	if sp == nil {
+		return unresolved, 0
+	}
+	return unresolved, clock.Now().Sub(sp.sendTime)
+}
+
+// Stop awaiting the receipt of a probe, remembering it until the finished window after now. Returns false if the
+// probe is no longer outstanding because it was abandoned, in which case its outcome has already been logged
+func finishProbe(sp *sentProbe, timedOut bool, now time.Time) bool {
+	outstandingLock.Lock()
+	if outstanding[sp.probe.device][sp.receipt()] != sp {
+		outstandingLock.Unlock()
+		return false
+	}
+	delete(outstanding[sp.probe.device], sp.receipt())
+	unresolved--
+	space.Broadcast()
+	outstandingLock.Unlock()
+	journal.finish(sp.entry)
+	rememberFinished(sp, timedOut, now)
+	return true
+}
+
+// Remember a probe whose outcome has been logged until the finished window after now
+func rememberFinished(sp *sentProbe, timedOut bool, now time.Time) {
+	probes, ok := finished[sp.probe.device]
+	if !ok {
+		probes = make(map[string]*finishedProbe)
+		finished[sp.probe.device] = probes
+	}
+	probes[sp.receipt()] = &finishedProbe{sp, timedOut, now.Add(getFinishedWindow())}
 }
 
+// Remember the probes abandoned since the last tick as finished without their receipts, as if they had timed out
+func rememberAbandoned(now time.Time) {
+	outstandingLock.Lock()
+	sps := abandoned
+	abandoned = nil
+	outstandingLock.Unlock()
+	for _, sp := range sps {
+		rememberFinished(sp, true, now)
+	}
+}
+
+// Copy of the outstanding probes, so that emulators can be listed without holding the lock
+func pendingProbes() map[*emulator]map[string]*sentProbe {
+	outstandingLock.Lock()
+	defer outstandingLock.Unlock()
+	ret := make(map[*emulator]map[string]*sentProbe)
+	for e, probes := range outstanding {
+		if len(probes) == 0 {
+			continue
+		}
+		ret[e] = make(map[string]*sentProbe, len(probes))
+		for r, sp := range probes {
+			ret[e][r] = sp
+		}
+	}
+	return ret
+}
+
+// Indicate that no more probes will be added
 func closeUnresolved() {
-	closeLock.Lock()
+	outstandingLock.Lock()
+	defer outstandingLock.Unlock()
 	closed = true
-	unresolved <- nil
-	close(unresolved)
-	closeLock.Unlock()
 }
 
-func removeProbe() *sentProbe {
-	return <-unresolved
+// Whether no more probes will be added and none are outstanding
+func drained() bool {
+	outstandingLock.Lock()
+	defer outstandingLock.Unlock()
+	return closed && unresolved == 0
 }
 
-func resolveProbe(sp *sentProbe) bool {
-	if sp == nil {
-		stopResolving()
-		return true
-	}
-	st, err := getMessage(fmt.Sprintf("%d%s", sp.probe.config.GetType(), sp.sendTime.Format(timeFileFormat)))
-	if err != nil {
-		logger.LogProbe(sp, "error", -1, deviceToken)
-		return true
+// A receipt found on an emulator
+type arrival struct {
+	sp    *sentProbe
+	time  string // Device time at which the app received the message, as recorded in the receipt
+	state string // State with which the arrival is logged
+}
+
+// Device time in the receipt as a number, so that receipts can be ordered. Receipts that cannot be read are ordered
+// first
+func (a *arrival) order() int64 {
+	t, _ := strconv.ParseInt(a.time, 10, 64)
+	return t
+}
+
+// Find the receipts on an emulator and resolve the probes, out of those given, whose receipts are present. Receipts
+// of finished probes are logged as late or duplicate deliveries. Receipts are handled in the order in which the app
+// received the messages, so that the order of arrival of each probe's messages can be tracked. Probes are left
+// outstanding if the emulator cannot be listed, and are timed out if it does not recover by their deadlines
+func resolveDevice(e *emulator, probes map[string]*sentProbe, now time.Time) {
+	receipts := e.pushedReceipts()
+	// Receipts the app could not push are written to files, which are listed less often while receipts are pushed
+	if !e.pushing() || now.Sub(e.listed) >= fallbackListInterval {
+		ents, err := e.listReceipts()
+		if err != nil && len(receipts) == 0 {
+			return
+		}
+		if err == nil {
+			e.listed = now
+		}
+		for _, ent := range ents {
+			receipts = append(receipts, strings.TrimSuffix(ent.Name, ".txt"))
+		}
 	}
-	if st == "nf" {
-		// Time out probe if it has been unresolved for too long
-		if clock.Now().After(sp.sendTime.Add(time.Duration(sp.probe.config.GetReceiveTimeout()) * time.Second)) {
-			logger.LogProbe(sp, "timeout", -1, deviceToken)
-			return true
+	var arrived []*arrival
+	for _, r := range receipts {
+		if fp, ok := finished[e][r]; ok {
+			st, err := e.getMessage(r)
+			if err != nil || st == notFound {
+				continue
+			}
+			if fp.timedOut {
+				// Any further receipts after a late one are duplicates
+				fp.timedOut = false
+				arrived = append(arrived, &arrival{fp.sp, st, "late"})
+			} else {
+				arrived = append(arrived, &arrival{fp.sp, st, "duplicate"})
+			}
+			continue
+		}
+		sp, ok := probes[r]
+		if !ok {
+			if orphaned(r, now) {
+				e.discardReceipt(r)
+			}
+			continue
+		}
+		st, err := e.getMessage(r)
+		if err == nil && st == notFound {
+			// Removed since it was listed
+			continue
+		}
+		if !finishProbe(sp, false, now) {
+			continue
 		}
-		// File not found, so probe is still unresolved
-		return false
-	} else {
-		lat, err := calculateLatency(sp.sendTime, st)
 		if err != nil {
-			// Message received but data is not present/readable
-			logger.LogProbe(sp, "error", lat, deviceToken)
+			logger.LogProbe(sp, failureState(sp, "error"), -1)
 		} else {
-			logger.LogProbe(sp, "resolved", lat, deviceToken)
+			arrived = append(arrived, &arrival{sp, st, "resolved"})
+		}
+	}
+	sort.SliceStable(arrived, func(i, j int) bool { return arrived[i].order() < arrived[j].order() })
+	for _, a := range arrived {
+		resolveArrival(a)
+	}
+}
+
+// Whether a receipt that matches no outstanding or finished probe is too old to ever be matched. Such receipts are
+// left by messages that arrive after their probes are forgotten, by messages sent before a restart that were not
+// journaled, and by bursts of COLLAPSE probes, and are removed so that they do not accumulate on the device
+func orphaned(receipt string, now time.Time) bool {
+	// The send time follows the probe type, and starts with the four digits of the year
+	i := strings.Index(receipt, "-")
+	if i < 4 {
+		return false
+	}
+	sent, err := time.Parse(timeFileFormat, receipt[i-4:])
+	if err != nil {
+		return false
+	}
+	return now.Sub(sent) > maxReceiveTimeout()+getFinishedWindow()
+}
+
+// Longest receive timeout of the configured probes
+func maxReceiveTimeout() time.Duration {
+	var ret int32
+	for _, p := range probeConfigs.GetProbe() {
+		if p.GetReceiveTimeout() > ret {
+			ret = p.GetReceiveTimeout()
+		}
+	}
+	return time.Duration(ret) * time.Second
+}
+
+// Log an arrival with the latency of its message. Messages that arrive for the first time, on time or late, are
+// placed in the order of their probe's messages
+func resolveArrival(a *arrival) {
+	sp := a.sp
+	lat, err := sp.calculateLatency(a.time)
+	if err != nil {
+		// Message received but data is not present/readable. The outcome of a finished probe is already logged
+		if a.state == "resolved" {
+			a.state = "error"
+		}
+		logger.LogProbe(sp, a.state, lat)
+		return
+	}
+	sp.reorder, sp.gap, sp.reordered, sp.gaps = 0, 0, 0, 0
+	if a.state != "duplicate" {
+		orderArrival(sp)
+	}
+	logger.LogProbe(sp, a.state, lat)
+	if a.state == "resolved" {
+		atomic.AddInt32(&resolvedProbes, 1)
+	}
+}
+
+// Place a newly arrived message in the order of its probe's messages. A message arriving after a later message of
+// its probe is reordered by the difference in their sequence numbers, and a message arriving after a gap in the
+// sequence records the number of messages skipped. The message also records the probe's running counts of reordered
+// messages and of messages that arrived after gaps, so that each result carries the probe's totals
+func orderArrival(sp *sentProbe) {
+	o := ordering[sp.probe]
+	if o == nil {
+		o = new(arrivalOrder)
+		ordering[sp.probe] = o
+	}
+	switch {
+	case sp.sequence < o.latest:
+		sp.reorder = int(o.latest - sp.sequence)
+		o.reordered++
+	case sp.sequence > o.latest:
+		sp.gap = int(sp.sequence - o.latest - 1)
+		if sp.gap > 0 {
+			o.gaps++
+		}
+		o.latest = sp.sequence
+	}
+	sp.reordered, sp.gaps = o.reordered, o.gaps
+}
+
+// Time out the outstanding probes whose deadlines are before now, and forget finished probes that have expired
+func expireProbes(now time.Time) {
+	for _, probes := range pendingProbes() {
+		for _, sp := range probes {
+			if now.After(sp.deadline()) && finishProbe(sp, true, now) {
+				logger.LogProbe(sp, failureState(sp, "timeout"), -1)
+			}
+		}
+	}
+	for _, probes := range finished {
+		for r, fp := range probes {
+			if now.After(fp.expires) {
+				delete(probes, r)
+			}
 		}
-		return true
 	}
 }
 
-func calculateLatency(st time.Time, rt string) (int, error) {
-	t1 := st.UnixNano() / 1000000
-	t2, err := strconv.Atoi(rt)
+func getMaxUnresolved() int {
+	if metadata.GetMaxUnresolved() <= 0 {
+		return defaultMaxUnresolved
+	}
+	return int(metadata.GetMaxUnresolved())
+}
+
+// Time for which probes are remembered after their outcomes are logged
+func getFinishedWindow() time.Duration {
+	if metadata.GetFinishedWindow() <= 0 {
+		return defaultFinishedWindow * time.Second
+	}
+	return time.Duration(metadata.GetFinishedWindow()) * time.Second
+}
+
+// Wait for receipts of a burst of messages sent with the same collapse key while the device was offline, and log
+// whether only the latest message was delivered. Receipts are awaited for the full receive timeout, so that any
+// earlier messages delivered late are counted
+func resolveCollapse(burst []*sentProbe) {
+	last := burst[len(burst)-1]
+	deadline := clock.Now().Add(time.Duration(last.probe.config.GetReceiveTimeout()) * time.Second)
+	receipts := make([]string, len(burst))
+	for {
+		for i, sp := range burst {
+			if receipts[i] != "" {
+				continue
+			}
+			st, err := sp.probe.device.getMessage(sp.receipt())
+			if err == nil && st != notFound {
+				receipts[i] = st
+			}
+		}
+		if clock.Now().After(deadline) {
+			break
+		}
+		time.Sleep(collapsePollInterval)
+	}
+
+	for _, r := range receipts {
+		if r != "" {
+			last.delivered++
+		}
+	}
+	lat := -1
+	if receipts[len(burst)-1] != "" {
+		lat, _ = last.calculateLatency(receipts[len(burst)-1])
+	}
+	if last.delivered == 1 && lat != -1 {
+		logger.LogProbe(last, "pass", lat)
+		atomic.AddInt32(&resolvedProbes, 1)
+	} else {
+		logger.LogProbe(last, failureState(last, "fail"), lat)
+	}
+}
+
+// State with which a probe that failed is logged. Failures while the emulator was unavailable, or of messages sent
+// before the probe restarted, are not attributed to FCM
+func failureState(sp *sentProbe, st string) string {
+	if sp.recovered {
+		return "interrupted"
+	}
+	if sp.probe.device.disrupted(sp) {
+		return "device_unavailable"
+	}
+	return st
+}
+
+// Latency in milliseconds of the probe's message, received at device time rt. The device time is converted with the
+// clock offset estimate in effect when the message was received, which is recorded with the probe
+func (sp *sentProbe) calculateLatency(rt string) (int, error) {
+	t1 := sp.sendTime.UnixNano() / 1000000
+	t2, err := strconv.ParseInt(rt, 10, 64)
 	if err != nil {
 		return -1, err
 	}
-	return int(int64(t2)-t1) + latencyOffset, nil
+	sp.clock = sp.probe.device.clockAt(t2)
+	if sp.clock == nil {
+		return int(t2 - t1), nil
+	}
+	return int(t2-t1) + sp.clock.offset, nil
 }
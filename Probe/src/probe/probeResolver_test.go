@@ -22,23 +22,34 @@ import (
 	"time"
 
 	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/fakefcm"
 	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
 )
 
+// Write the receipt of a probe to the device as the app would, with the given content
+func writeReceipt(fd *fakefcm.Device, sp *sentProbe, content string) {
+	fd.WriteFile("logs/"+sp.receipt()+".txt", content)
+}
+
 func TestResolveProbes(t *testing.T) {
-	maker = utils.NewFakeCommandMaker([]string{"0.0", "1000", "nf", "nf"}, []bool{false, false, false, false}, false)
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	fd.Clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
+	defer startFakeAdb(t, fd).Close()
+	// A single clock sample, so that initResolver reads the clock twice
+	metadata = &controller.MetadataConfig{ClockSyncSamples: 1}
 	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0), time.Unix(0, 0),
 		time.Unix(3, 0), time.Unix(100, 0)}, false)
 	fakeLogger := new(fakeLogger)
 	logger = fakeLogger
-	deviceToken = "TEST_TOKEN"
+	dev := newTestEmulator()
+	emulators = []*emulator{dev}
 
 	testConfig := &controller.ProbeConfig{ReceiveTimeout: 2, Type: controller.ProbeType_UNSPECIFIED}
-	testProbes := []*sentProbe{newSentProbe(time.Unix(1, 0), &probe{config: testConfig}),
-		newSentProbe(time.Unix(2, 0), &probe{config: testConfig})}
+	testProbes := []*sentProbe{newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev)),
+		newSentProbe(time.Unix(2, 0), newProbe(testConfig, dev))}
+	writeReceipt(fd, testProbes[0], "1000")
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
-	resolve = true
 
 	err := initResolver()
 	if err != nil {
@@ -52,7 +63,7 @@ func TestResolveProbes(t *testing.T) {
 
 	wg.Wait()
 
-	// There should be 3 logs: one resolved, one unresolved, one timeout
+	// There should be 2 logs: one resolved, one timeout
 	logs := fakeLogger.testLogs
 	if len(logs) != 2 {
 		t.Logf("TestResolveProbes: not all probes resolved: %d", len(logs))
@@ -60,7 +71,7 @@ func TestResolveProbes(t *testing.T) {
 	}
 	for i := 0; i < 2; i++ {
 		if logs[i].token != "TEST_TOKEN" {
-			t.Logf("TestResolveProbe: incorrect token logged: actual: %s, expected: %s", logs[i].token, deviceToken)
+			t.Logf("TestResolveProbes: incorrect token logged: actual: %s, expected: %s", logs[i].token, dev.token)
 		}
 	}
 	if logs[0].time != testProbes[0].sendTime.Format(timeLogFormat) || logs[0].state != "resolved" || logs[0].latency != 0 {
@@ -73,130 +84,327 @@ func TestResolveProbes(t *testing.T) {
 	}
 }
 
-func TestResolveProbe(t *testing.T) {
-	maker = utils.NewFakeCommandMaker([]string{"1500"}, []bool{false}, false)
+// Track a probe as the only outstanding one, returning the outstanding probes of its emulator
+func awaitProbe(sp *sentProbe) map[string]*sentProbe {
+	resetResolver()
+	addProbe(sp)
+	return pendingProbes()[sp.probe.device]
+}
+
+func TestResolveDevice(t *testing.T) {
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
 	testConfig := &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED}
-	testSentProbe := newSentProbe(time.Unix(1, 0), &probe{config: testConfig})
+	dev := newTestEmulator()
+	testSentProbe := newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev))
+	writeReceipt(fd, testSentProbe, "1500")
 	fakeLogger := new(fakeLogger)
 	logger = fakeLogger
 
-	res := resolveProbe(testSentProbe)
+	resolveDevice(dev, awaitProbe(testSentProbe), time.Unix(2, 0))
 
-	if !res {
-		t.Log("TestResolveProbe: probe not resolved on valid input")
-		t.Fail()
+	if len(fakeLogger.testLogs) != 1 || len(pendingProbes()) != 0 {
+		t.Log("TestResolveDevice: probe not resolved on valid input")
+		t.FailNow()
 	}
 	log := fakeLogger.testLogs[0]
 	if log.state != "resolved" {
-		t.Logf("TestResolveProbe: incorrect probe state: actual: %s expected: resolved", log.state)
+		t.Logf("TestResolveDevice: incorrect probe state: actual: %s expected: resolved", log.state)
 		t.Fail()
 	}
 	if log.latency != 500 {
-		t.Logf("TestResolveProbe: incorrect latency: actual %d expected: 500", log.latency)
+		t.Logf("TestResolveDevice: incorrect latency: actual %d expected: 500", log.latency)
+		t.Fail()
+	}
+	if fd.Receipts() != 0 {
+		t.Log("TestResolveDevice: receipt not removed from device")
 		t.Fail()
 	}
 }
 
-func TestResolveProbeGetError(t *testing.T) {
-	maker = utils.NewFakeCommandMaker([]string{"INVALID_COMMAND"}, []bool{true}, false)
+func TestResolveDeviceUnmatched(t *testing.T) {
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
 	testConfig := &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED}
-	testSentProbe := newSentProbe(time.Unix(1, 0), &probe{config: testConfig})
+	dev := newTestEmulator()
+	testSentProbe := newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev))
+	writeReceipt(fd, newSentProbe(time.Unix(2, 0), newProbe(testConfig, dev)), "2500")
 	fakeLogger := new(fakeLogger)
 	logger = fakeLogger
 
-	res := resolveProbe(testSentProbe)
+	resolveDevice(dev, awaitProbe(testSentProbe), time.Unix(2, 0))
 
-	if !res {
-		t.Log("TestResolveProbeGetError: probe not resolved on getMessage error")
+	if len(fakeLogger.testLogs) != 0 || len(pendingProbes()[dev]) != 1 {
+		t.Log("TestResolveDeviceUnmatched: probe resolved by another probe's receipt")
 		t.Fail()
 	}
-	log := fakeLogger.testLogs[0]
-	if log.state != "error" {
-		t.Logf("TestResolveProbeGetError: incorrect probe state: actual: %s expected: error", log.state)
+	if fd.Receipts() != 1 {
+		t.Log("TestResolveDeviceUnmatched: receipt of another probe removed from device")
 		t.Fail()
 	}
-	if log.latency != -1 {
-		t.Logf("TestResolveProbeGetError: incorrect latency: actual %d expected: -1", log.latency)
+}
+
+func TestResolveDeviceOrphaned(t *testing.T) {
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
+	testConfig := &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED, ReceiveTimeout: 10}
+	probeConfigs = &controller.ProbeConfigs{Probe: []*controller.ProbeConfig{testConfig}}
+	defer func() { probeConfigs = nil }()
+	metadata = &controller.MetadataConfig{FinishedWindow: 60}
+	dev := newTestEmulator()
+	testSentProbe := newSentProbe(time.Unix(100, 0), newProbe(testConfig, dev))
+	writeReceipt(fd, newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev)), "1500")
+	writeReceipt(fd, newSentProbe(time.Unix(50, 0), newProbe(testConfig, dev)), "50500")
+	logger = new(fakeLogger)
+
+	resolveDevice(dev, awaitProbe(testSentProbe), time.Unix(100, 0))
+
+	if fd.Receipts() != 1 {
+		t.Logf("TestResolveDeviceOrphaned: incorrect receipts left on device: actual: %d, expected: 1", fd.Receipts())
+		t.Fail()
+	}
+	if len(pendingProbes()[dev]) != 1 {
+		t.Log("TestResolveDeviceOrphaned: outstanding probe resolved by an orphaned receipt")
 		t.Fail()
 	}
 }
 
-func TestResolveProbeTimeout(t *testing.T) {
-	maker = utils.NewFakeCommandMaker([]string{"nf"}, []bool{false}, false)
-	timeout := int32(2)
-	testConfig := &controller.ProbeConfig{ReceiveTimeout: timeout, Type: controller.ProbeType_UNSPECIFIED}
-	testSentProbe := newSentProbe(time.Unix(1, 0), &probe{config: testConfig})
-	// Set time to after timeout time
-	clock = utils.NewFakeClock([]time.Time{time.Unix(2, 0).Add(time.Duration(timeout) * time.Second)}, false)
+func TestResolveDeviceUnreachable(t *testing.T) {
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
+	// The emulator is unreachable, so its receipts cannot be listed
+	fd.Crash()
+	testConfig := &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED}
+	dev := newTestEmulator()
+	testSentProbe := newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev))
 	fakeLogger := new(fakeLogger)
 	logger = fakeLogger
 
-	res := resolveProbe(testSentProbe)
+	resolveDevice(dev, awaitProbe(testSentProbe), time.Unix(2, 0))
 
-	if !res {
-		t.Log("TestResolveProbeTimeout: probe not resolved on timeout")
+	if len(fakeLogger.testLogs) != 0 || len(pendingProbes()[dev]) != 1 {
+		t.Log("TestResolveDeviceUnreachable: probe not left outstanding when receipts cannot be listed")
 		t.Fail()
 	}
+}
+
+func TestResolveDeviceInvalidMessage(t *testing.T) {
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
+	testConfig := &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED}
+	dev := newTestEmulator()
+	testSentProbe := newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev))
+	writeReceipt(fd, testSentProbe, "INVALID_MESSAGE")
+	fakeLogger := new(fakeLogger)
+	logger = fakeLogger
+
+	resolveDevice(dev, awaitProbe(testSentProbe), time.Unix(2, 0))
+
+	if len(fakeLogger.testLogs) != 1 {
+		t.Log("TestResolveDeviceInvalidMessage: probe not resolved with error recorded reception time")
+		t.FailNow()
+	}
 	log := fakeLogger.testLogs[0]
-	if log.state != "timeout" {
-		t.Logf("TestResolveProbeTimeout: incorrect probe state: actual: %s expected: timeout", log.state)
+	if log.state != "error" {
+		t.Logf("TestResolveDeviceInvalidMessage: incorrect probe state: actual: %s expected: error", log.state)
 		t.Fail()
 	}
 	if log.latency != -1 {
-		t.Logf("TestResolveProbeTimeout: incorrect latency: actual %d expected: -1", log.latency)
+		t.Logf("TestResolveDeviceInvalidMessage: incorrect latency: actual %d expected: -1", log.latency)
 		t.Fail()
 	}
 }
 
-func TestResolveProbeUnresolved(t *testing.T) {
-	maker = utils.NewFakeCommandMaker([]string{"nf"}, []bool{false}, false)
-	timeout := int32(2)
-	testConfig := &controller.ProbeConfig{ReceiveTimeout: timeout, Type: controller.ProbeType_UNSPECIFIED}
-	testSentProbe := newSentProbe(time.Unix(1, 0), &probe{config: testConfig})
-	// Set time to before timeout time
-	clock = utils.NewFakeClock([]time.Time{time.Unix(1, 0).Add(time.Duration(timeout) * time.Second)}, false)
+func TestResolveDeviceDuplicate(t *testing.T) {
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
+	testConfig := &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED}
+	dev := newTestEmulator()
+	testSentProbe := newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev))
+	writeReceipt(fd, testSentProbe, "1500")
+	resolveDevice(dev, awaitProbe(testSentProbe), time.Unix(2, 0))
+	writeReceipt(fd, testSentProbe, "1700")
 	fakeLogger := new(fakeLogger)
 	logger = fakeLogger
 
-	res := resolveProbe(testSentProbe)
+	resolveDevice(dev, pendingProbes()[dev], time.Unix(3, 0))
 
-	if res {
-		t.Log("TestResolveProbeUnresolved: probe not unresolved before timeout")
+	if len(fakeLogger.testLogs) != 1 || fakeLogger.testLogs[0].state != "duplicate" {
+		t.Logf("TestResolveDeviceDuplicate: second receipt not logged as duplicate: %v", fakeLogger.testLogs)
+		t.FailNow()
+	}
+	if fakeLogger.testLogs[0].latency != 700 {
+		t.Logf("TestResolveDeviceDuplicate: incorrect latency: actual %d expected: 700", fakeLogger.testLogs[0].latency)
 		t.Fail()
 	}
+	if fd.Receipts() != 0 {
+		t.Log("TestResolveDeviceDuplicate: duplicate receipt not removed from device")
+		t.Fail()
+	}
+}
 
-	if len(fakeLogger.testLogs) != 0 {
-		t.Log("TestResolveProbeUnresolved: log written for unresolved probe")
+func TestResolveDeviceLate(t *testing.T) {
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
+	testConfig := &controller.ProbeConfig{ReceiveTimeout: 2, Type: controller.ProbeType_UNSPECIFIED}
+	dev := newTestEmulator()
+	testSentProbe := newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev))
+	awaitProbe(testSentProbe)
+	expireProbes(time.Unix(4, 0))
+	fakeLogger := new(fakeLogger)
+	logger = fakeLogger
+
+	// Delivered after the probe timed out, then delivered again
+	writeReceipt(fd, testSentProbe, "5000")
+	resolveDevice(dev, pendingProbes()[dev], time.Unix(5, 0))
+	writeReceipt(fd, testSentProbe, "5100")
+	resolveDevice(dev, pendingProbes()[dev], time.Unix(6, 0))
+
+	if len(fakeLogger.testLogs) != 2 || fakeLogger.testLogs[0].state != "late" ||
+		fakeLogger.testLogs[1].state != "duplicate" {
+		t.Logf("TestResolveDeviceLate: receipts after timeout not logged as late then duplicate: %v",
+			fakeLogger.testLogs)
+		t.FailNow()
+	}
+	if fakeLogger.testLogs[0].latency != 4000 {
+		t.Logf("TestResolveDeviceLate: incorrect latency: actual %d expected: 4000", fakeLogger.testLogs[0].latency)
+		t.Fail()
+	}
+}
+
+func TestExpireFinished(t *testing.T) {
+	metadata = &controller.MetadataConfig{FinishedWindow: 10}
+	testConfig := &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED}
+	dev := newTestEmulator()
+	testSentProbe := newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev))
+	awaitProbe(testSentProbe)
+	finishProbe(testSentProbe, false, time.Unix(2, 0))
+
+	expireProbes(time.Unix(12, 0))
+	if len(finished[dev]) != 1 {
+		t.Log("TestExpireFinished: finished probe forgotten within window")
+		t.FailNow()
+	}
+	expireProbes(time.Unix(13, 0))
+	if len(finished[dev]) != 0 {
+		t.Log("TestExpireFinished: finished probe not forgotten after window")
+		t.Fail()
 	}
 }
 
-func TestResolveProbeInvalidMessage(t *testing.T) {
-	maker = utils.NewFakeCommandMaker([]string{"INVALID_MESSAGE"}, []bool{false}, false)
+func TestResolveDeviceOrder(t *testing.T) {
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
 	testConfig := &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED}
-	testSentProbe := newSentProbe(time.Unix(1, 0), &probe{config: testConfig})
-	clock = utils.NewFakeClock([]time.Time{time.Unix(1, 0)}, false)
+	dev := newTestEmulator()
+	p := newProbe(testConfig, dev)
+	first := newSentProbe(time.Unix(1, 0), p)
+	first.sequence = 1
+	second := newSentProbe(time.Unix(2, 0), p)
+	second.sequence = 2
+	// The second message overtakes the first
+	writeReceipt(fd, first, "3000")
+	writeReceipt(fd, second, "2500")
+	awaitProbe(first)
+	addProbe(second)
 	fakeLogger := new(fakeLogger)
 	logger = fakeLogger
 
-	res := resolveProbe(testSentProbe)
+	resolveDevice(dev, pendingProbes()[dev], time.Unix(4, 0))
+
+	logs := fakeLogger.testLogs
+	if len(logs) != 2 || logs[0].sequence != 2 || logs[1].sequence != 1 {
+		t.Logf("TestResolveDeviceOrder: receipts not resolved in order of arrival: %v", logs)
+		t.FailNow()
+	}
+	if logs[0].gap != 1 || logs[0].reorder != 0 || logs[1].reorder != 1 || logs[1].gap != 0 {
+		t.Logf("TestResolveDeviceOrder: incorrect reordering and gaps: %v", logs)
+		t.Fail()
+	}
+}
+
+func TestOrderArrival(t *testing.T) {
+	ordering = make(map[*probe]*arrivalOrder)
+	p := newProbe(&controller.ProbeConfig{}, newTestEmulator())
+	var sps []*sentProbe
+	for _, seq := range []int64{1, 2, 5, 3, 6, 9, 4} {
+		sp := newSentProbe(time.Unix(seq, 0), p)
+		sp.sequence = seq
+		orderArrival(sp)
+		sps = append(sps, sp)
+	}
 
-	if !res {
-		t.Log("TestResolveProbeInvalidMessage: probe not resolved with error recorded reception time")
+	if sps[1].gap != 0 || sps[2].gap != 2 || sps[3].reorder != 2 || sps[4].gap != 0 || sps[4].reorder != 0 {
+		t.Log("TestOrderArrival: incorrect reordering and gaps")
+		t.Fail()
+	}
+	if ordering[p].latest != 9 {
+		t.Logf("TestOrderArrival: incorrect latest sequence: actual: %d, expected: 9", ordering[p].latest)
 		t.Fail()
 	}
+	// Totals carried by each arrival, after 5 and 9 skipped messages and 3 and 4 arrived behind later ones
+	expected := [][2]int{{0, 0}, {0, 0}, {0, 1}, {1, 1}, {1, 1}, {1, 2}, {2, 2}}
+	for i, sp := range sps {
+		if sp.reordered != expected[i][0] || sp.gaps != expected[i][1] {
+			t.Logf("TestOrderArrival: incorrect totals for sequence %d: actual: %d reordered, %d gaps, expected: %v",
+				sp.sequence, sp.reordered, sp.gaps, expected[i])
+			t.Fail()
+		}
+	}
+}
+
+func TestExpireProbes(t *testing.T) {
+	timeout := int32(2)
+	testConfig := &controller.ProbeConfig{ReceiveTimeout: timeout, Type: controller.ProbeType_UNSPECIFIED}
+	testSentProbe := newSentProbe(time.Unix(1, 0), newProbe(testConfig, newTestEmulator()))
+	awaitProbe(testSentProbe)
+	fakeLogger := new(fakeLogger)
+	logger = fakeLogger
+
+	// Before the deadline, the probe is left outstanding
+	expireProbes(time.Unix(1, 0).Add(time.Duration(timeout) * time.Second))
+	if len(fakeLogger.testLogs) != 0 || len(pendingProbes()) != 1 {
+		t.Log("TestExpireProbes: probe timed out before deadline")
+		t.FailNow()
+	}
+	expireProbes(time.Unix(2, 0).Add(time.Duration(timeout) * time.Second))
+	if len(fakeLogger.testLogs) != 1 || len(pendingProbes()) != 0 {
+		t.Log("TestExpireProbes: probe not timed out after deadline")
+		t.FailNow()
+	}
 	log := fakeLogger.testLogs[0]
-	if log.state != "error" {
-		t.Logf("TestResolveProbeInvalidMessage: incorrect probe state: actual: %s expected: error", log.state)
+	if log.state != "timeout" {
+		t.Logf("TestExpireProbes: incorrect probe state: actual: %s expected: timeout", log.state)
 		t.Fail()
 	}
 	if log.latency != -1 {
-		t.Logf("TestResolveProbeInvalidMessage: incorrect latency: actual %d expected: -1", log.latency)
+		t.Logf("TestExpireProbes: incorrect latency: actual %d expected: -1", log.latency)
+		t.Fail()
+	}
+}
+
+func TestAddProbeSharedReceipt(t *testing.T) {
+	testConfig := &controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED}
+	dev := newTestEmulator()
+	awaitProbe(newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev)))
+	fakeLogger := new(fakeLogger)
+	logger = fakeLogger
+
+	addProbe(newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev)))
+
+	if len(fakeLogger.testLogs) != 1 || fakeLogger.testLogs[0].state != "error" {
+		t.Logf("TestAddProbeSharedReceipt: probe sharing a receipt not logged as error: %v", fakeLogger.testLogs)
+		t.Fail()
+	}
+	if unresolved != 1 {
+		t.Logf("TestAddProbeSharedReceipt: incorrect number of outstanding probes: actual: %d, expected: 1", unresolved)
 		t.Fail()
 	}
 }
 
 func TestCalculateLatency(t *testing.T) {
-	res, err := calculateLatency(time.Unix(10, 0), "10001")
+	sp := newSentProbe(time.Unix(10, 0), newProbe(&controller.ProbeConfig{}, newTestEmulator()))
+	res, err := sp.calculateLatency("10001")
 
 	if err != nil {
 		t.Logf("TestCalculateLatency: error on valid input: %s", err.Error())
@@ -208,8 +416,23 @@ func TestCalculateLatency(t *testing.T) {
 	}
 }
 
+func TestCalculateLatencyOffset(t *testing.T) {
+	dev := newTestEmulator()
+	dev.clocks = []*clockEstimate{{version: 1, offset: 100, devTime: 0}, {version: 2, offset: 200, devTime: 10500}}
+	sp := newSentProbe(time.Unix(10, 0), newProbe(&controller.ProbeConfig{}, dev))
+
+	// Received before the second estimate was taken, so the first applies
+	res, err := sp.calculateLatency("10001")
+
+	if err != nil || res != 101 || sp.clock.version != 1 {
+		t.Logf("TestCalculateLatencyOffset: incorrect result: actual: %d, expected: 101", res)
+		t.Fail()
+	}
+}
+
 func TestCalculateLatencyError(t *testing.T) {
-	res, err := calculateLatency(time.Unix(10, 0), "INVALID_TIME")
+	sp := newSentProbe(time.Unix(10, 0), newProbe(&controller.ProbeConfig{}, newTestEmulator()))
+	res, err := sp.calculateLatency("INVALID_TIME")
 
 	if err == nil {
 		t.Logf("TestCalculateLatency: no error on invalid input")
@@ -220,3 +443,159 @@ func TestCalculateLatencyError(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestResolveCollapseAllDelivered(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0), time.Unix(1, 0)}, false)
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
+	fl := new(fakeLogger)
+	logger = fl
+	p := newProbe(&controller.ProbeConfig{Type: controller.ProbeType_COLLAPSE}, newTestEmulator())
+	burst := []*sentProbe{newSentProbe(time.Unix(0, 0), p), newSentProbe(time.Unix(0, 1000000), p)}
+	writeReceipt(fd, burst[0], "1000")
+	writeReceipt(fd, burst[1], "1000")
+
+	resolveCollapse(burst)
+
+	if len(fl.testLogs) != 1 || fl.testLogs[0].state != "fail" {
+		t.Logf("TestResolveCollapseAllDelivered: collapse not logged as failed: %v", fl.testLogs)
+		t.Fail()
+	}
+	if burst[1].delivered != 2 {
+		t.Logf("TestResolveCollapseAllDelivered: incorrect delivered count: actual: %d, expected: 2", burst[1].delivered)
+		t.Fail()
+	}
+}
+
+// Track probes sent at the given times as outstanding, under the given overflow policy and maximum
+func fillUnresolved(policy controller.OverflowPolicy, max int32, times ...int64) []*sentProbe {
+	metadata = &controller.MetadataConfig{OverflowPolicy: policy, MaxUnresolved: max}
+	resetResolver()
+	var ret []*sentProbe
+	dev := newTestEmulator()
+	for _, tim := range times {
+		sp := newSentProbe(time.Unix(tim, 0), newProbe(&controller.ProbeConfig{}, dev))
+		addProbe(sp)
+		ret = append(ret, sp)
+	}
+	return ret
+}
+
+func TestAdmitProbeSkip(t *testing.T) {
+	probing = true
+	fillUnresolved(controller.OverflowPolicy_SKIP, 1, 1)
+
+	if admitProbe() {
+		t.Log("TestAdmitProbeSkip: probe admitted while maximum outstanding")
+		t.Fail()
+	}
+	if unresolved != 1 {
+		t.Logf("TestAdmitProbeSkip: outstanding probes changed: %d", unresolved)
+		t.Fail()
+	}
+}
+
+func TestAdmitProbeDropOldest(t *testing.T) {
+	probing = true
+	fakeLogger := new(fakeLogger)
+	logger = fakeLogger
+	sps := fillUnresolved(controller.OverflowPolicy_DROP_OLDEST, 2, 2, 1)
+
+	if !admitProbe() {
+		t.Log("TestAdmitProbeDropOldest: probe not admitted")
+		t.FailNow()
+	}
+	logs := fakeLogger.testLogs
+	if len(logs) != 1 || logs[0].state != "abandoned" || logs[0].time != sps[1].sendTime.Format(timeLogFormat) {
+		t.Logf("TestAdmitProbeDropOldest: oldest probe not abandoned: %v", logs)
+		t.Fail()
+	}
+	if unresolved != 1 {
+		t.Logf("TestAdmitProbeDropOldest: incorrect number of outstanding probes: %d", unresolved)
+		t.Fail()
+	}
+	// The resolver may already have copied the abandoned probe, which must not get a second outcome
+	if finishProbe(sps[1], false, time.Unix(3, 0)) {
+		t.Log("TestAdmitProbeDropOldest: abandoned probe finished")
+		t.Fail()
+	}
+}
+
+func TestAdmitProbeDropOldestLate(t *testing.T) {
+	probing = true
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
+	fakeLogger := new(fakeLogger)
+	logger = fakeLogger
+	sps := fillUnresolved(controller.OverflowPolicy_DROP_OLDEST, 1, 1)
+	writeReceipt(fd, sps[0], "1500")
+	admitProbe()
+
+	rememberAbandoned(time.Unix(2, 0))
+	resolveDevice(sps[0].probe.device, pendingProbes()[sps[0].probe.device], time.Unix(2, 0))
+
+	logs := fakeLogger.testLogs
+	if len(logs) != 2 || logs[0].state != "abandoned" || logs[1].state != "late" || logs[1].latency != 500 {
+		t.Logf("TestAdmitProbeDropOldestLate: receipt of abandoned probe not logged as late: %v", logs)
+		t.Fail()
+	}
+	if fd.Receipts() != 0 {
+		t.Log("TestAdmitProbeDropOldestLate: receipt of abandoned probe not removed from device")
+		t.Fail()
+	}
+}
+
+func TestAdmitProbeBlock(t *testing.T) {
+	probing = true
+	sps := fillUnresolved(controller.OverflowPolicy_BLOCK, 1, 1)
+	admitted := make(chan bool)
+
+	go func() { admitted <- admitProbe() }()
+	select {
+	case <-admitted:
+		t.Log("TestAdmitProbeBlock: probe admitted while maximum outstanding")
+		t.FailNow()
+	case <-time.After(50 * time.Millisecond):
+	}
+	finishProbe(sps[0], false, time.Unix(2, 0))
+
+	select {
+	case ok := <-admitted:
+		if !ok {
+			t.Log("TestAdmitProbeBlock: probe not admitted once a probe finished")
+			t.Fail()
+		}
+	case <-time.After(time.Second):
+		t.Log("TestAdmitProbeBlock: probe still blocked once a probe finished")
+		t.Fail()
+	}
+}
+
+func TestAdmitProbeBlockStopped(t *testing.T) {
+	probing = true
+	fillUnresolved(controller.OverflowPolicy_BLOCK, 1, 1)
+	admitted := make(chan bool)
+
+	go func() { admitted <- admitProbe() }()
+	time.Sleep(50 * time.Millisecond)
+	stopProbes(new(sync.WaitGroup))
+
+	select {
+	case <-admitted:
+	case <-time.After(time.Second):
+		t.Log("TestAdmitProbeBlockStopped: sender still blocked after probing stopped")
+		t.Fail()
+	}
+}
+
+func TestUnresolvedStats(t *testing.T) {
+	fillUnresolved(controller.OverflowPolicy_BLOCK, 0, 5, 2, 8)
+	clock = utils.NewFakeClock([]time.Time{time.Unix(10, 0)}, true)
+
+	n, age := unresolvedStats()
+
+	if n != 3 || age != 8*time.Second {
+		t.Logf("TestUnresolvedStats: incorrect stats: actual: %d, %v expected: 3, 8s", n, age)
+		t.Fail()
+	}
+}
@@ -17,47 +17,165 @@
 package probe
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/fakefcm"
 	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
 )
 
 func TestProbe(t *testing.T) {
 	interval := int32(0)
 	cfg := &controller.ProbeConfig{SendInterval: interval, Type: controller.ProbeType_UNSPECIFIED}
-	testClock := utils.NewFakeBoolClock(make([]time.Time, 6), &probing)
+	// Distinct send times, so that the probes' receipts are distinct, all before the token expires
+	times := make([]time.Time, 6)
+	for i := range times {
+		times[i] = time.Time{}.Add(time.Duration(i) * time.Second)
+	}
+	metadata = &controller.MetadataConfig{ClockSyncSamples: 1}
+	testClock := utils.NewFakeBoolClock(times, &probing)
 	clock = testClock
-	testMaker := utils.NewFakeCommandMaker([]string{"0.0", ""}, []bool{false}, true)
-	maker = testMaker
+	defer startFakeAdb(t, fakefcm.NewDevice("TEST_TOKEN")).Close()
+	sent := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent++
+		fmt.Fprint(w, `{"name":"MESSAGE"}`)
+	}))
+	defer srv.Close()
+	fcm = newFcmClient(srv.URL, "PROJECT", 1)
+	fcmAuth = Auth{Token: "TOKEN", deadline: time.Unix(0, 1)}
 
-	p := newProbe(cfg)
+	emulators = []*emulator{newTestEmulator()}
+	p := newProbe(cfg, emulators[0])
 	pwg := new(sync.WaitGroup)
 	pwg.Add(1)
 
 	initResolver()
 	go p.probe(pwg)
 	pwg.Wait()
-	addProbe(nil)
 
-	// Subtract command call and one clock call for initResolver
-	if testClock.TimesCalled()-2 != 2*(testMaker.TimesCalled()-1) {
-		t.Log("TestProbe: clock and maker not accessed same number of times")
+	// Subtract two clock calls for initResolver's single clock sample. Each probe reads the clock to check the token and to record its send time
+	if testClock.TimesCalled()-2 != 2*sent {
+		t.Log("TestProbe: clock not accessed twice for each message sent")
 		t.Fail()
 	}
 
-	i := 0
-	current := <-unresolved
-	for current != nil {
-		i++
-		current = <-unresolved
+	probes := pendingProbes()[emulators[0]]
+	for _, sp := range probes {
+		if sp.name != "MESSAGE" {
+			t.Logf("TestProbe: incorrect message name: actual: %s, expected: MESSAGE", sp.name)
+			t.Fail()
+		}
+	}
+
+	if len(probes) != sent {
+		t.Log("TestProbe: number of probes sent not equal to number of messages received by FCM")
+		t.Fail()
 	}
+}
 
-	// Subtract command call for initResolver
-	if i != testMaker.TimesCalled()-1 {
-		t.Log("TestProbe: number of probes sent not equal to number of times sendMessage was called")
+func TestProbeSendErrorInterval(t *testing.T) {
+	cfg := &controller.ProbeConfig{SendInterval: 1, Type: controller.ProbeType_UNSPECIFIED, PayloadSizes: []int32{5000}}
+	times := make([]time.Time, 4)
+	for i := range times {
+		times[i] = time.Time{}.Add(time.Duration(i) * time.Second)
+	}
+	probing = true
+	clock = utils.NewFakeBoolClock(times, &probing)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":{"code":400,"message":"Message is too big","status":"INVALID_ARGUMENT"}}`)
+	}))
+	defer srv.Close()
+	fcm = newFcmClient(srv.URL, "PROJECT", 1)
+	fcmAuth = Auth{Token: "TOKEN", deadline: time.Unix(0, 1)}
+	fl := new(fakeLogger)
+	logger = fl
+	p := newProbe(cfg, newTestEmulator())
+	pwg := new(sync.WaitGroup)
+	pwg.Add(1)
+	start := time.Now()
+
+	go p.probe(pwg)
+	pwg.Wait()
+
+	if len(fl.testLogs) < 2 || fl.testLogs[0].state != "oversize" {
+		t.Logf("TestProbeSendErrorInterval: rejected sends not logged as oversize: %v", fl.testLogs)
+		t.FailNow()
+	}
+	if elapsed := time.Since(start); elapsed < time.Duration(len(fl.testLogs)-1)*time.Second {
+		t.Logf("TestProbeSendErrorInterval: %d rejected sends within %v, ignoring the send interval", len(fl.testLogs),
+			elapsed)
+		t.Fail()
+	}
+}
+
+func TestProbeSendErrorReported(t *testing.T) {
+	cfg := &controller.ProbeConfig{SendInterval: 0, Type: controller.ProbeType_UNSPECIFIED}
+	probing = true
+	clock = utils.NewFakeBoolClock([]time.Time{time.Time{}.Add(time.Second), time.Time{}.Add(2 * time.Second)}, &probing)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, testUnregistered)
+	}))
+	defer srv.Close()
+	fcm = newFcmClient(srv.URL, "PROJECT", 1)
+	fcmAuth = Auth{Token: "TOKEN", deadline: time.Unix(0, 1)}
+	journal = nil
+	fl := new(fakeLogger)
+	logger = fl
+	p := newProbe(cfg, newTestEmulator())
+	pwg := new(sync.WaitGroup)
+	pwg.Add(1)
+
+	go p.probe(pwg)
+	pwg.Wait()
+
+	if len(fl.errLogs) == 0 || !strings.Contains(fl.errLogs[0], "UNREGISTERED") {
+		t.Logf("TestProbeSendErrorReported: rejected send not logged with its FCM error code: %v", fl.errLogs)
+		t.Fail()
+	}
+	if len(fl.testLogs) == 0 || fl.testLogs[0].state != "send_error" {
+		t.Logf("TestProbeSendErrorReported: rejected send not logged as a result: %v", fl.testLogs)
+		t.Fail()
+	}
+}
+
+func TestNextPayloadSize(t *testing.T) {
+	p := newProbe(&controller.ProbeConfig{PayloadSizes: []int32{100, 200}}, nil)
+	sizes := []int{p.nextPayloadSize(), p.nextPayloadSize(), p.nextPayloadSize()}
+
+	if sizes[0] != 100 || sizes[1] != 200 || sizes[2] != 100 {
+		t.Logf("TestNextPayloadSize: payload sizes not cycled through: %v", sizes)
+		t.Fail()
+	}
+	if newProbe(&controller.ProbeConfig{}, nil).nextPayloadSize() != 0 {
+		t.Log("TestNextPayloadSize: payload size set for probe without sizes")
+		t.Fail()
+	}
+}
+
+func TestTopicDefault(t *testing.T) {
+	hostname = "us-east1-b"
+	first := newProbe(&controller.ProbeConfig{Type: controller.ProbeType_TOPIC}, newEmulator(0, "AVD"))
+	second := newProbe(&controller.ProbeConfig{Type: controller.ProbeType_TOPIC}, newEmulator(1, "AVD"))
+
+	if first.topic() != "fcm-external-prober-us-east1-b-emulator-5554" {
+		t.Logf("TestTopicDefault: incorrect default topic: %s", first.topic())
+		t.Fail()
+	}
+	if first.topic() == second.topic() {
+		t.Log("TestTopicDefault: emulators share a default topic")
+		t.Fail()
+	}
+	if !topicPattern.MatchString(first.topic()) {
+		t.Logf("TestTopicDefault: default topic %s is not a valid topic name", first.topic())
 		t.Fail()
 	}
 }
@@ -0,0 +1,198 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Port on the emulator to which the app posts receipts, forwarded to the emulator's listener on the VM
+	receiptPort = "tcp:8765"
+	// Interval at which receipt files are listed while receipts are pushed, to find those the app could not post
+	fallbackListInterval = 5 * time.Second
+)
+
+// Receipt posted by the app as soon as it receives a message
+type pushedReceipt struct {
+	Type         string `json:"type"`
+	SendTime     string `json:"sendTime"`
+	Id           string `json:"id"`           // Message ID assigned by FCM
+	ReceivedTime int64  `json:"receivedTime"` // Device time at which the app received the message, in milliseconds
+}
+
+// Accepts receipts posted by the app on one emulator, holding them until they are read. Receipts that are not read
+// within the finished window, such as those of probes sent before the probe restarted, are discarded
+type receiptListener struct {
+	listener net.Listener
+	receipts map[string][]string    // Device receive times of the receipts that have not been read, by receipt
+	posted   map[string][]time.Time // Times at which the receipts were posted, by receipt
+	lock     sync.Mutex
+}
+
+// Start accepting receipts on an ephemeral local port
+func newReceiptListener() (*receiptListener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	rl := &receiptListener{listener: l, receipts: make(map[string][]string), posted: make(map[string][]time.Time)}
+	go http.Serve(l, rl)
+	return rl, nil
+}
+
+func (rl *receiptListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/receipts" {
+		http.NotFound(w, r)
+		return
+	}
+	pr := new(pushedReceipt)
+	err := json.NewDecoder(r.Body).Decode(pr)
+	if err != nil {
+		// The app falls back to writing the receipt to a file
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rl.add(pr.Type+pr.SendTime, strconv.FormatInt(pr.ReceivedTime, 10))
+}
+
+func (rl *receiptListener) add(receipt string, rt string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.receipts[receipt] = append(rl.receipts[receipt], rt)
+	rl.posted[receipt] = append(rl.posted[receipt], time.Now())
+}
+
+// Port on which the listener accepts receipts, as a socket spec
+func (rl *receiptListener) port() string {
+	return "tcp:" + strconv.Itoa(rl.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Receipts that have not been read, discarding those posted more than the finished window ago
+func (rl *receiptListener) pending() []string {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	var ret []string
+	for r, posted := range rl.posted {
+		for len(posted) > 0 && time.Since(posted[0]) > getFinishedWindow() {
+			posted = posted[1:]
+			rl.receipts[r] = rl.receipts[r][1:]
+		}
+		if len(posted) == 0 {
+			delete(rl.posted, r)
+			delete(rl.receipts, r)
+			continue
+		}
+		rl.posted[r] = posted
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// Read and remove the earliest posted copy of a receipt, returning whether one was posted
+func (rl *receiptListener) take(receipt string) (string, bool) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rts := rl.receipts[receipt]
+	if len(rts) == 0 {
+		return "", false
+	}
+	if len(rts) == 1 {
+		delete(rl.receipts, receipt)
+		delete(rl.posted, receipt)
+	} else {
+		rl.receipts[receipt] = rts[1:]
+		rl.posted[receipt] = rl.posted[receipt][1:]
+	}
+	return rts[0], true
+}
+
+func (rl *receiptListener) close() {
+	rl.listener.Close()
+}
+
+// Start a receipt listener for the emulator, to which receipts are pushed once the receipt port is forwarded
+func (e *emulator) startListener() error {
+	rl, err := newReceiptListener()
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.listener = rl
+	return nil
+}
+
+// Forward the app's receipt port to the emulator's listener. Forwards are lost when the emulator restarts, so this is
+// repeated on recovery. While the port is not forwarded, the app writes receipts to files
+func (e *emulator) forwardReceipts() error {
+	e.lock.Lock()
+	rl := e.listener
+	e.lock.Unlock()
+	if rl == nil {
+		return nil
+	}
+	err := bridge.Reverse(e.serial, receiptPort, rl.port())
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.forwarded = err == nil
+	return err
+}
+
+// Whether receipts are pushed from the emulator, in which case receipt files are only listed occasionally
+func (e *emulator) pushing() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.listener != nil && e.forwarded
+}
+
+// Receipts pushed from the emulator that have not been read
+func (e *emulator) pushedReceipts() []string {
+	e.lock.Lock()
+	rl := e.listener
+	e.lock.Unlock()
+	if rl == nil {
+		return nil
+	}
+	return rl.pending()
+}
+
+// Read a pushed receipt, returning whether it was pushed
+func (e *emulator) takePushed(receipt string) (string, bool) {
+	e.lock.Lock()
+	rl := e.listener
+	e.lock.Unlock()
+	if rl == nil {
+		return "", false
+	}
+	return rl.take(receipt)
+}
+
+func (e *emulator) stopListener() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.listener != nil {
+		e.listener.close()
+		e.listener = nil
+		e.forwarded = false
+	}
+}
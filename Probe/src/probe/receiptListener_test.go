@@ -0,0 +1,138 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/fakefcm"
+)
+
+// Post a receipt to a listener as the app does, returning the response status
+func postReceipt(t *testing.T, rl *receiptListener, body string) int {
+	resp, err := http.Post("http://127.0.0.1:"+strings.TrimPrefix(rl.port(), "tcp:")+"/receipts", "application/json",
+		strings.NewReader(body))
+	if err != nil {
+		t.Logf("postReceipt: unable to post receipt: %v", err)
+		t.FailNow()
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestReceiptListener(t *testing.T) {
+	rl, err := newReceiptListener()
+	if err != nil {
+		t.Logf("TestReceiptListener: unable to start listener: %v", err)
+		t.FailNow()
+	}
+	defer rl.close()
+
+	st := postReceipt(t, rl, `{"type":"0","sendTime":"SEND_TIME","id":"1","receivedTime":1500}`)
+	postReceipt(t, rl, `{"type":"0","sendTime":"SEND_TIME","id":"1","receivedTime":1600}`)
+
+	if st != http.StatusOK {
+		t.Logf("TestReceiptListener: incorrect status: actual: %d, expected: 200", st)
+		t.FailNow()
+	}
+	if p := rl.pending(); len(p) != 1 || p[0] != "0SEND_TIME" {
+		t.Logf("TestReceiptListener: incorrect pending receipts: %v", p)
+		t.FailNow()
+	}
+	// Duplicates are read in the order they were posted
+	rt1, ok1 := rl.take("0SEND_TIME")
+	rt2, ok2 := rl.take("0SEND_TIME")
+	_, ok3 := rl.take("0SEND_TIME")
+	if rt1 != "1500" || rt2 != "1600" || !ok1 || !ok2 || ok3 || len(rl.pending()) != 0 {
+		t.Logf("TestReceiptListener: incorrect receipts read: %s, %s", rt1, rt2)
+		t.Fail()
+	}
+}
+
+func TestReceiptListenerInvalid(t *testing.T) {
+	rl, err := newReceiptListener()
+	if err != nil {
+		t.Logf("TestReceiptListenerInvalid: unable to start listener: %v", err)
+		t.FailNow()
+	}
+	defer rl.close()
+
+	st := postReceipt(t, rl, `INVALID`)
+
+	if st != http.StatusBadRequest || len(rl.pending()) != 0 {
+		t.Logf("TestReceiptListenerInvalid: invalid receipt accepted: %d", st)
+		t.Fail()
+	}
+}
+
+func TestForwardReceipts(t *testing.T) {
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	defer startFakeAdb(t, fd).Close()
+	e := newTestEmulator()
+	if e.forwardReceipts() != nil || e.pushing() {
+		t.Log("TestForwardReceipts: receipts pushed without a listener")
+		t.FailNow()
+	}
+	e.startListener()
+	defer e.stopListener()
+
+	err := e.forwardReceipts()
+
+	if err != nil || !e.pushing() {
+		t.Logf("TestForwardReceipts: receipts not pushed: %v", err)
+		t.Fail()
+	}
+	fd.Crash()
+	if e.forwardReceipts() == nil || e.pushing() {
+		t.Log("TestForwardReceipts: receipts pushed from unreachable emulator")
+		t.Fail()
+	}
+}
+
+func TestResolveDevicePushed(t *testing.T) {
+	fd := fakefcm.NewDevice("TEST_TOKEN")
+	as := startFakeAdb(t, fd)
+	defer as.Close()
+	dev := newTestEmulator()
+	dev.startListener()
+	defer dev.stopListener()
+	dev.forwardReceipts()
+	sp := newSentProbe(time.Unix(1, 0), newProbe(&controller.ProbeConfig{Type: controller.ProbeType_UNSPECIFIED}, dev))
+	fakeLogger := new(fakeLogger)
+	logger = fakeLogger
+	probes := awaitProbe(sp)
+	postReceipt(t, dev.listener, `{"type":"0","sendTime":"`+sp.sendTime.Format(timeFileFormat)+`","receivedTime":1500}`)
+	dev.listed = time.Unix(2, 0)
+	req := as.Requests()
+
+	resolveDevice(dev, probes, time.Unix(2, 0))
+
+	logs := fakeLogger.testLogs
+	if len(logs) != 1 || logs[0].state != "resolved" || logs[0].latency != 500 {
+		t.Logf("TestResolveDevicePushed: pushed receipt not resolved: %v", logs)
+		t.Fail()
+	}
+	// Receipt files were listed recently, so the emulator is not contacted
+	if as.Requests() != req {
+		t.Log("TestResolveDevicePushed: receipt files listed while receipts are pushed")
+		t.Fail()
+	}
+}
@@ -20,9 +20,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
+	"io/ioutil"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
@@ -34,12 +36,25 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-const certFile = "cert.pem"
+const (
+	certFile = "cert.pem"
+	// Defaults used when reconnection settings are not provided in metadata
+	defaultOrphanGracePeriod   = 30  // Minutes
+	defaultReconnectBackoff    = 5   // Seconds
+	defaultReconnectMaxBackoff = 300 // Seconds
+	// Timeout of each report of errors to the controller
+	reportTimeout = 10 * time.Second
+)
 
 var (
+	// Connection to the controller, replaced on reconnect while errors may be reported from other goroutines. Guarded
+	// by clientLock
 	client     controller.ProbeCommunicatorClient
+	conn       *grpc.ClientConn
+	clientLock sync.Mutex
 	pingConfig *controller.PingConfig
 	hostname   string
+	zone       string
 	metadata   *controller.MetadataConfig
 )
 
@@ -86,48 +101,74 @@ func getMetadata() error {
 	if err != nil {
 		return err
 	}
-	cf, err := os.Create("cert.pem")
-	if err != nil {
-		return err
-	}
-	_, err = cf.Write([]byte(metadata.GetCert()))
+	return ioutil.WriteFile(certFile, []byte(metadata.GetCert()), 0644)
+}
+
+func initClient() error {
+	cfg, err := connect()
 	if err != nil {
 		return err
 	}
+	probeConfigs = cfg.GetProbes()
+	emulatorCount = int(cfg.GetEmulators())
+	// Replacement VMs are not named after their zone, so logs are labelled with the zone the controller provides
+	logger.SetRegion(zone)
 	return nil
 }
 
-func initClient() error {
+// Dial the controller and register with it, replacing any existing connection
+func connect() (*controller.RegisterResponse, error) {
 	tls, err := credentials.NewClientTLSFromFile(certFile, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(metadata.GetRegisterTimeout())*time.Second)
 	defer cancel()
-	conn, err := grpc.DialContext(ctx, fmt.Sprintf("%s:%d", metadata.GetHostIp(), metadata.GetPort()),
+	c, err := grpc.DialContext(ctx, fmt.Sprintf("%s:%d", metadata.GetHostIp(), metadata.GetPort()),
 		grpc.WithTransportCredentials(tls), grpc.WithBlock())
 	if err != nil {
-		return err
+		return nil, err
 	}
+	clientLock.Lock()
+	old := conn
+	conn = c
 	client = controller.NewProbeCommunicatorClient(conn)
+	clientLock.Unlock()
+	if old != nil {
+		// Errors may still be being reported on the old connection, so it is closed once their reports time out
+		time.AfterFunc(reportTimeout, func() { old.Close() })
+	}
 
 	cfg, err := register()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	probeConfigs = cfg.GetProbes()
 	pingConfig = cfg.GetPingConfig()
-	return nil
+	if cfg.GetZone() != "" {
+		zone = cfg.GetZone()
+	}
+	return cfg, nil
+}
+
+// Re-acquire the controller's address and certificate, which change if the controller is restarted, and register again.
+// Probes continue with the configuration they were started with
+func reconnect() error {
+	err := getMetadata()
+	if err != nil {
+		return err
+	}
+	_, err = connect()
+	return err
 }
 
 func register() (*controller.RegisterResponse, error) {
 	req := &controller.RegisterRequest{Source: hostname}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(metadata.GetRegisterTimeout())*time.Second)
-	defer cancel()
 
 	for i := 0; i < int(metadata.GetRegisterRetries()); i++ {
-		cfg, err := client.Register(ctx, req)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(metadata.GetRegisterTimeout())*time.Second)
+		cfg, err := getClient().Register(ctx, req)
+		cancel()
 		st := status.Convert(err)
 		switch st.Code() {
 		case codes.DeadlineExceeded:
@@ -141,17 +182,66 @@ func register() (*controller.RegisterResponse, error) {
 	return nil, errors.New("register: maximum register retries exceeded")
 }
 
+// Ping the controller until it requests that probing stop. If the controller cannot be reached, reconnect with
+// exponential backoff while probes continue, and only return an error once the orphan grace period has elapsed
 func communicate() error {
-	stop := false
-	for !stop {
-		hb, err := pingServer(stop)
+	lastContact := clock.Now()
+	connected := true
+	backoff := getReconnectBackoff()
+	for {
+		hb, err := pingServer(false)
+		if err == nil {
+			if hb.GetStop() {
+				return nil
+			}
+			lastContact = clock.Now()
+			connected = true
+			backoff = getReconnectBackoff()
+			time.Sleep(time.Duration(pingConfig.GetInterval()) * time.Minute)
+			continue
+		}
+
+		if connected {
+			connected = false
+			logger.LogErrorf("communicate: lost connection to controller, reconnecting: %v", err)
+		}
+		grace := getOrphanGracePeriod()
+		if clock.Now().After(lastContact.Add(grace)) {
+			return fmt.Errorf("communicate: unable to reach controller for %v: %v", grace, err)
+		}
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+		err = reconnect()
 		if err != nil {
-			return err
+			logger.LogErrorf("communicate: unable to reconnect to controller: %v", err)
 		}
-		stop = hb.GetStop()
-		time.Sleep(time.Duration(pingConfig.GetInterval()) * time.Minute)
 	}
-	return nil
+}
+
+func getOrphanGracePeriod() time.Duration {
+	if metadata.GetOrphanGracePeriod() <= 0 {
+		return defaultOrphanGracePeriod * time.Minute
+	}
+	return time.Duration(metadata.GetOrphanGracePeriod()) * time.Minute
+}
+
+func getReconnectBackoff() time.Duration {
+	if metadata.GetReconnectBackoff() <= 0 {
+		return defaultReconnectBackoff * time.Second
+	}
+	return time.Duration(metadata.GetReconnectBackoff()) * time.Second
+}
+
+func nextBackoff(b time.Duration) time.Duration {
+	max := time.Duration(metadata.GetReconnectMaxBackoff()) * time.Second
+	if max <= 0 {
+		max = defaultReconnectMaxBackoff * time.Second
+	}
+	b *= 2
+	if b > max {
+		return max
+	}
+	return b
 }
 
 func confirmStop() error {
@@ -164,12 +254,18 @@ func confirmStop() error {
 }
 
 func pingServer(stop bool) (*controller.Heartbeat, error) {
-	hb := &controller.Heartbeat{Stop: stop, Source: hostname}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(pingConfig.GetTimeout())*time.Second)
-	defer cancel()
+	n, age := unresolvedStats()
+	m := fcmAuth.getMetrics()
+	hb := &controller.Heartbeat{Stop: stop, Source: hostname, Resolved: atomic.LoadInt32(&resolvedProbes),
+		Unresolved: int32(n), OldestUnresolved: int32(age.Seconds()), TokenRefreshes: int32(m.Refreshes),
+		TokenRefreshFailures: int32(m.Failures), TokenConsecutiveFailures: int32(m.ConsecutiveFailures),
+		TokenFetchMillis: int32(m.LastFetchTime / time.Millisecond)}
 
+	c := getClient()
 	for i := 0; i < int(pingConfig.GetRetries()); i++ {
-		hb, err := client.Ping(ctx, hb)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(pingConfig.GetTimeout())*time.Second)
+		hb, err := c.Ping(ctx, hb)
+		cancel()
 		st := status.Convert(err)
 		switch st.Code() {
 		case codes.DeadlineExceeded:
@@ -177,13 +273,32 @@ func pingServer(stop bool) (*controller.Heartbeat, error) {
 		case codes.OK:
 			return hb, nil
 		default:
-			time.Sleep(time.Duration(pingConfig.GetRetryInterval()))
+			time.Sleep(time.Duration(pingConfig.GetRetryInterval()) * time.Second)
 		}
 	}
 	return nil, errors.New("pingServer: maximum register retries exceeded")
 
 }
 
+// Send errors to the controller, which logs them with the VM from which they came
+func reportErrors(errs []*controller.ProbeError) error {
+	c := getClient()
+	if c == nil {
+		return errors.New("reportErrors: not connected to controller")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+	_, err := c.ReportErrors(ctx, &controller.ErrorReport{Source: hostname, Errors: errs})
+	return err
+}
+
+// Client of the current connection to the controller, or nil if there is none
+func getClient() controller.ProbeCommunicatorClient {
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	return client
+}
+
 func getHostname() (string, error) {
 	n, err := maker.Command("curl", "-H", "Metadata-Flavor:Google", "http://metadata.google.internal/computeMetadata/v1/instance/name").Output()
 	if err != nil {
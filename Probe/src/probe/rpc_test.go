@@ -19,6 +19,7 @@ package probe
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
 	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
@@ -28,6 +29,7 @@ import (
 )
 
 type TestClient struct {
+	reported []*controller.ErrorReport
 }
 
 func (tc *TestClient) Register(ctx context.Context, in *controller.RegisterRequest, opts ...grpc.CallOption) (*controller.RegisterResponse, error) {
@@ -42,6 +44,14 @@ func (tc *TestClient) Register(ctx context.Context, in *controller.RegisterReque
 	}
 }
 
+func (tc *TestClient) ReportErrors(ctx context.Context, in *controller.ErrorReport, opts ...grpc.CallOption) (*controller.ErrorReportResponse, error) {
+	tc.reported = append(tc.reported, in)
+	if in.GetSource() == "Unavailable" {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	return &controller.ErrorReportResponse{}, nil
+}
+
 func (tc *TestClient) Ping(ctx context.Context, in *controller.Heartbeat, opts ...grpc.CallOption) (*controller.Heartbeat, error) {
 	switch in.GetSource() {
 	case "Exceeded":
@@ -62,6 +72,7 @@ func (tc *TestClient) Ping(ctx context.Context, in *controller.Heartbeat, opts .
 func initVars(host string, retries int32) {
 	hostname = host
 	client = new(TestClient)
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0)}, true)
 	pingConfig = &controller.PingConfig{Retries: retries}
 	metadata = &controller.MetadataConfig{RegisterRetries: retries}
 }
@@ -135,6 +146,33 @@ func TestCommunicate(t *testing.T) {
 	}
 }
 
+func TestCommunicateOrphaned(t *testing.T) {
+	initVars("Unavailable", 1)
+	metadata.OrphanGracePeriod = 1
+	clock = utils.NewFakeClock([]time.Time{time.Unix(0, 0), time.Unix(61, 0)}, false)
+	logger = new(fakeLogger)
+
+	err := communicate()
+	if err == nil {
+		t.Log("TestCommunicateOrphaned: nil error returned after orphan grace period elapsed")
+		t.Fail()
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	metadata = &controller.MetadataConfig{ReconnectBackoff: 1, ReconnectMaxBackoff: 3}
+	expected := []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second}
+
+	b := getReconnectBackoff()
+	for i, e := range expected {
+		b = nextBackoff(b)
+		if b != e {
+			t.Logf("TestNextBackoff: incorrect backoff after %d attempts: actual: %v, expected: %v", i+1, b, e)
+			t.Fail()
+		}
+	}
+}
+
 func TestPingServerExpected(t *testing.T) {
 	initVars("testHost", 1)
 
@@ -145,6 +183,25 @@ func TestPingServerExpected(t *testing.T) {
 	}
 }
 
+func TestPingServerTokenMetrics(t *testing.T) {
+	initVars("testHost", 1)
+	fcmAuth.metrics = TokenMetrics{Refreshes: 5, Failures: 2, ConsecutiveFailures: 1, LastFetchTime: 120 * time.Millisecond}
+	defer func() { fcmAuth.metrics = TokenMetrics{} }()
+
+	hb, err := pingServer(false)
+	if err != nil {
+		t.Log("TestPingServerTokenMetrics: received non-nil error output on valid input")
+		t.FailNow()
+	}
+	if hb.GetTokenRefreshes() != 5 || hb.GetTokenRefreshFailures() != 2 || hb.GetTokenConsecutiveFailures() != 1 ||
+		hb.GetTokenFetchMillis() != 120 {
+		t.Logf("TestPingServerTokenMetrics: incorrect token metrics: actual: %d, %d, %d, %dms expected: 5, 2, 1, 120ms",
+			hb.GetTokenRefreshes(), hb.GetTokenRefreshFailures(), hb.GetTokenConsecutiveFailures(),
+			hb.GetTokenFetchMillis())
+		t.Fail()
+	}
+}
+
 func TestPingServerExceeded(t *testing.T) {
 	initVars("Exceeded", 1)
 
@@ -175,3 +232,41 @@ func TestPingServerUnavailable(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestReportErrors(t *testing.T) {
+	tc := new(TestClient)
+	client = tc
+	hostname = "VM"
+
+	err := reportErrors([]*controller.ProbeError{{Description: "ERROR", Region: "REGION"}})
+
+	if err != nil || len(tc.reported) != 1 || tc.reported[0].GetSource() != "VM" ||
+		tc.reported[0].GetErrors()[0].GetDescription() != "ERROR" {
+		t.Logf("TestReportErrors: errors not reported to the controller: %v %v", tc.reported, err)
+		t.Fail()
+	}
+
+	client = nil
+	err = reportErrors([]*controller.ProbeError{{Description: "ERROR"}})
+
+	if err == nil {
+		t.Log("TestReportErrors: no error reporting without a connection to the controller")
+		t.Fail()
+	}
+}
+
+func TestLogErrorReported(t *testing.T) {
+	tc := new(TestClient)
+	client = tc
+	defer func() { client = nil }()
+	hostname = "VM"
+	maker = utils.NewFakeCommandMaker([]string{""}, []bool{true}, false)
+	cl := &CloudLogger{"REGION", "PROBES", "ERRORS"}
+
+	cl.LogError("ERROR")
+
+	if len(tc.reported) != 1 || tc.reported[0].GetErrors()[0].GetRegion() != "REGION" {
+		t.Logf("TestLogErrorReported: error not reported to the controller after failing to log: %v", tc.reported)
+		t.Fail()
+	}
+}
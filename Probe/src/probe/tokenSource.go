@@ -0,0 +1,360 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTokenEndpoint = "https://oauth2.googleapis.com/token"
+	// Scopes required to send messages with FCM and write to Cloud Logging
+	tokenScopes    = "https://www.googleapis.com/auth/firebase.messaging https://www.googleapis.com/auth/cloud-platform"
+	jwtGrantType   = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	stsGrantType   = "urn:ietf:params:oauth:grant-type:token-exchange"
+	stsTokenType   = "urn:ietf:params:oauth:token-type:access_token"
+	jwtLifetime    = 3600 // Seconds
+	requestTimeout = 30 * time.Second
+)
+
+// Source from which OAuth access tokens are acquired
+type tokenSource interface {
+	fetch() (*tokenResponse, error)
+}
+
+// Represents an OAuth token response, into which JSON can be parsed
+type tokenResponse struct {
+	Token     string        `json:"access_token"`
+	Ttl       time.Duration `json:"expires_in,int"` // Lifetime of the token in seconds
+	TokenType string        `json:"token_type"`
+}
+
+// Choose a token source based on configuration. A credentials file takes precedence, then the gcloud CLI when
+// running standalone, then the GCE metadata server
+func newTokenSource(cfgFile string, endpoint string) (tokenSource, error) {
+	if cfgFile == "" {
+		if standalone {
+			return new(gcloudTokenSource), nil
+		}
+		return &metadataTokenSource{metadata.GetAccount().GetServiceAccount()}, nil
+	}
+	b, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	var cf struct {
+		Type string `json:"type"`
+	}
+	err = json.Unmarshal(b, &cf)
+	if err != nil {
+		return nil, err
+	}
+	switch cf.Type {
+	case "service_account":
+		return newServiceAccountTokenSource(b, endpoint)
+	case "external_account":
+		return newExternalAccountTokenSource(b, endpoint)
+	}
+	return nil, fmt.Errorf("newTokenSource: unsupported credentials type: %s", cf.Type)
+}
+
+// Acquires tokens for the VM's service account from the GCE metadata server
+type metadataTokenSource struct {
+	account string
+}
+
+func (m *metadataTokenSource) fetch() (*tokenResponse, error) {
+	// GET request for authentication credentials for interacting with FCM and Cloud Logger
+	get, err := maker.Command("curl",
+		"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/"+m.account+"/token",
+		"-H", "Metadata-Flavor: Google").Output()
+	if err != nil {
+		return nil, err
+	}
+	ret := new(tokenResponse)
+	err = json.Unmarshal(get, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Acquires tokens from the gcloud CLI, for use where there is no metadata server
+type gcloudTokenSource struct{}
+
+func (g *gcloudTokenSource) fetch() (*tokenResponse, error) {
+	tok, err := maker.Command("gcloud", "auth", "print-access-token").Output()
+	if err != nil {
+		return nil, err
+	}
+	// gcloud does not report the lifetime of the token, so refresh well before the default lifetime of one hour
+	return &tokenResponse{strings.TrimSpace(string(tok)), localTokenTtl, "Bearer"}, nil
+}
+
+// Acquires tokens by exchanging a JWT signed with a service account key
+type serviceAccountTokenSource struct {
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	endpoint string
+	client   *http.Client
+}
+
+func newServiceAccountTokenSource(cfg []byte, endpoint string) (*serviceAccountTokenSource, error) {
+	var sa struct {
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		PrivateKeyID string `json:"private_key_id"`
+		TokenURI     string `json:"token_uri"`
+	}
+	err := json.Unmarshal(cfg, &sa)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKey([]byte(sa.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	if endpoint == "" {
+		endpoint = sa.TokenURI
+	}
+	if endpoint == "" {
+		endpoint = defaultTokenEndpoint
+	}
+	return &serviceAccountTokenSource{sa.ClientEmail, sa.PrivateKeyID, key, endpoint,
+		&http.Client{Timeout: requestTimeout}}, nil
+}
+
+func parseKey(p []byte) (*rsa.PrivateKey, error) {
+	b, _ := pem.Decode(p)
+	if b == nil {
+		return nil, errors.New("parseKey: private key is not PEM encoded")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(b.Bytes)
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("parseKey: private key is not an RSA key")
+	}
+	return rk, nil
+}
+
+func (s *serviceAccountTokenSource) fetch() (*tokenResponse, error) {
+	jwt, err := s.signJWT()
+	if err != nil {
+		return nil, err
+	}
+	res := new(tokenResponse)
+	err = postForm(s.client, s.endpoint, url.Values{"grant_type": {jwtGrantType}, "assertion": {jwt}}, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *serviceAccountTokenSource) signJWT() (string, error) {
+	iat := clock.Now().Unix()
+	h, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.keyID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(map[string]interface{}{"iss": s.email, "scope": tokenScopes, "aud": s.endpoint,
+		"iat": iat, "exp": iat + jwtLifetime})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Acquires tokens through workload identity federation, by exchanging a token issued by an external identity
+// provider with the Security Token Service, then optionally impersonating a service account
+type externalAccountTokenSource struct {
+	Audience         string `json:"audience"`
+	SubjectTokenType string `json:"subject_token_type"`
+	TokenURL         string `json:"token_url"`
+	ImpersonationURL string `json:"service_account_impersonation_url"`
+	CredentialSource struct {
+		File    string            `json:"file"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Format  struct {
+			Type      string `json:"type"`
+			FieldName string `json:"subject_token_field_name"`
+		} `json:"format"`
+	} `json:"credential_source"`
+	client *http.Client
+}
+
+func newExternalAccountTokenSource(cfg []byte, endpoint string) (*externalAccountTokenSource, error) {
+	ret := new(externalAccountTokenSource)
+	err := json.Unmarshal(cfg, ret)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint != "" {
+		ret.TokenURL = endpoint
+	}
+	if ret.TokenURL == "" {
+		return nil, errors.New("newExternalAccountTokenSource: no token URL provided")
+	}
+	ret.client = &http.Client{Timeout: requestTimeout}
+	return ret, nil
+}
+
+func (e *externalAccountTokenSource) fetch() (*tokenResponse, error) {
+	st, err := e.subjectToken()
+	if err != nil {
+		return nil, err
+	}
+	res := new(tokenResponse)
+	err = postForm(e.client, e.TokenURL, url.Values{
+		"grant_type":           {stsGrantType},
+		"audience":             {e.Audience},
+		"scope":                {tokenScopes},
+		"requested_token_type": {stsTokenType},
+		"subject_token":        {st},
+		"subject_token_type":   {e.SubjectTokenType},
+	}, res)
+	if err != nil {
+		return nil, err
+	}
+	if e.ImpersonationURL == "" {
+		return res, nil
+	}
+	return e.impersonate(res.Token)
+}
+
+// Read the token issued by the external identity provider from a file or URL
+func (e *externalAccountTokenSource) subjectToken() (string, error) {
+	cs := e.CredentialSource
+	var b []byte
+	var err error
+	if cs.File != "" {
+		b, err = ioutil.ReadFile(cs.File)
+	} else if cs.URL != "" {
+		b, err = get(e.client, cs.URL, cs.Headers)
+	} else {
+		err = errors.New("subjectToken: no credential source provided")
+	}
+	if err != nil {
+		return "", err
+	}
+	if cs.Format.Type != "json" {
+		return strings.TrimSpace(string(b)), nil
+	}
+	var fields map[string]interface{}
+	err = json.Unmarshal(b, &fields)
+	if err != nil {
+		return "", err
+	}
+	tok, ok := fields[cs.Format.FieldName].(string)
+	if !ok {
+		return "", fmt.Errorf("subjectToken: field %s not found in credential source", cs.Format.FieldName)
+	}
+	return tok, nil
+}
+
+func (e *externalAccountTokenSource) impersonate(fed string) (*tokenResponse, error) {
+	body, err := json.Marshal(map[string]interface{}{"scope": strings.Fields(tokenScopes),
+		"lifetime": fmt.Sprintf("%ds", jwtLifetime)})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.ImpersonationURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+fed)
+	var res struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	err = doJSON(e.client, req, &res)
+	if err != nil {
+		return nil, err
+	}
+	ttl := res.ExpireTime.Sub(clock.Now()) / time.Second
+	return &tokenResponse{res.AccessToken, ttl, "Bearer"}, nil
+}
+
+func postForm(c *http.Client, u string, v url.Values, res interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doJSON(c, req, res)
+}
+
+func get(c *http.Client, u string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return do(c, req)
+}
+
+func doJSON(c *http.Client, req *http.Request, res interface{}) error {
+	b, err := do(c, req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, res)
+}
+
+func do(c *http.Client, req *http.Request) ([]byte, error) {
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %d: %s", req.Method, req.URL, res.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
@@ -0,0 +1,207 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+func writeCredentials(t *testing.T, dir string, cfg map[string]interface{}) string {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "credentials.json")
+	err = ioutil.WriteFile(p, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestServiceAccountTokenSource(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(100, 0)}, true)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	var claims map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if r.PostForm.Get("grant_type") != jwtGrantType || len(parts) != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		c, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(c, &claims)
+		fmt.Fprint(w, `{"access_token":"SA_TOKEN","expires_in":3599,"token_type":"Bearer"}`)
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "tokenSource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := writeCredentials(t, dir, map[string]interface{}{"type": "service_account", "client_email": "SA_EMAIL",
+		"private_key": string(kb), "private_key_id": "KEY_ID", "token_uri": srv.URL})
+
+	src, err := newTokenSource(p, "")
+	if err != nil {
+		t.Logf("TestServiceAccountTokenSource: error on valid credentials: %v", err)
+		t.FailNow()
+	}
+	res, err := src.fetch()
+
+	if err != nil {
+		t.Logf("TestServiceAccountTokenSource: error on valid token request: %v", err)
+		t.FailNow()
+	}
+	if res.Token != "SA_TOKEN" || res.Ttl != 3599 {
+		t.Logf("TestServiceAccountTokenSource: incorrect token response: %+v", res)
+		t.Fail()
+	}
+	if claims["iss"] != "SA_EMAIL" || claims["aud"] != srv.URL || claims["iat"] != float64(100) {
+		t.Logf("TestServiceAccountTokenSource: incorrect JWT claims: %v", claims)
+		t.Fail()
+	}
+}
+
+func TestExternalAccountTokenSource(t *testing.T) {
+	clock = utils.NewFakeClock([]time.Time{time.Unix(100, 0)}, true)
+	var mux http.ServeMux
+	mux.HandleFunc("/subject", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "True" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"id_token":"SUBJECT_TOKEN"}`)
+	})
+	mux.HandleFunc("/sts", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("subject_token") != "SUBJECT_TOKEN" || r.PostForm.Get("audience") != "AUDIENCE" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"FEDERATED_TOKEN","expires_in":3600,"token_type":"Bearer"}`)
+	})
+	mux.HandleFunc("/impersonate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer FEDERATED_TOKEN" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"accessToken":"SA_TOKEN","expireTime":"%s"}`, time.Unix(1900, 0).UTC().Format(time.RFC3339))
+	})
+	srv := httptest.NewServer(&mux)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "tokenSource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := writeCredentials(t, dir, map[string]interface{}{"type": "external_account", "audience": "AUDIENCE",
+		"token_url": srv.URL + "/sts", "service_account_impersonation_url": srv.URL + "/impersonate",
+		"credential_source": map[string]interface{}{"url": srv.URL + "/subject",
+			"headers": map[string]string{"Metadata": "True"},
+			"format":  map[string]string{"type": "json", "subject_token_field_name": "id_token"}}})
+
+	src, err := newTokenSource(p, "")
+	if err != nil {
+		t.Logf("TestExternalAccountTokenSource: error on valid credentials: %v", err)
+		t.FailNow()
+	}
+	res, err := src.fetch()
+
+	if err != nil {
+		t.Logf("TestExternalAccountTokenSource: error on valid token exchange: %v", err)
+		t.FailNow()
+	}
+	if res.Token != "SA_TOKEN" || res.Ttl != 1800 {
+		t.Logf("TestExternalAccountTokenSource: incorrect token response: %+v", res)
+		t.Fail()
+	}
+}
+
+func TestNewTokenSourceDefault(t *testing.T) {
+	metadata = &controller.MetadataConfig{}
+
+	src, err := newTokenSource("", "")
+
+	if err != nil {
+		t.Logf("TestNewTokenSourceDefault: error without credentials file: %v", err)
+		t.FailNow()
+	}
+	if _, ok := src.(*metadataTokenSource); !ok {
+		t.Logf("TestNewTokenSourceDefault: metadata server not used by default: %T", src)
+		t.Fail()
+	}
+}
+
+func TestNewTokenSourceUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokenSource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := writeCredentials(t, dir, map[string]interface{}{"type": "authorized_user"})
+
+	_, err = newTokenSource(p, "")
+
+	if err == nil {
+		t.Log("TestNewTokenSourceUnsupported: no error on unsupported credentials type")
+		t.Fail()
+	}
+}
+
+func TestUpdateDeadlineEarlyRefresh(t *testing.T) {
+	tTime := time.Unix(100, 0)
+	clock = utils.NewFakeClock([]time.Time{tTime}, true)
+	tAuth := &Auth{Ttl: 3600}
+
+	tAuth.updateDeadline()
+
+	if !tAuth.deadline.Equal(tTime.Add(time.Hour - refreshMargin)) {
+		t.Logf("TestUpdateDeadlineEarlyRefresh: token not refreshed early: %v", tAuth.deadline)
+		t.Fail()
+	}
+}
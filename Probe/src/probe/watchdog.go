@@ -0,0 +1,241 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Interval between health checks of each emulator
+	watchdogInterval = 30 * time.Second
+	// Interval at which probes on an unavailable emulator check whether it has recovered
+	unavailablePollInterval = 1 * time.Second
+	bootRetries             = 60
+	bootRetryInterval       = 5 * time.Second
+)
+
+type health int
+
+const (
+	healthy      health = iota
+	appDown             // The emulator is running but the app is not
+	emulatorDown        // The emulator is unreachable through adb or has not finished booting
+)
+
+// Periodically check the health of every emulator, recovering those that are unhealthy, until stop is closed
+func watchEmulators(stop chan struct{}, wwg *sync.WaitGroup) {
+	defer wwg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(watchdogInterval):
+		}
+		for _, e := range emulators {
+			checkEmulator(e)
+		}
+	}
+}
+
+// Recover the emulator if it is unhealthy, or if an earlier recovery failed after the emulator or app was restarted,
+// in which case the emulator is healthy but remains unavailable until its token and clock offset are re-read
+func checkEmulator(e *emulator) {
+	h := e.checkHealth()
+	if h == healthy && !e.recovering() {
+		return
+	}
+	if h == healthy {
+		logger.LogErrorf("checkEmulator: %s has not finished recovering, retrying", e.serial)
+	} else {
+		logger.LogErrorf("checkEmulator: %s is unhealthy (%s), recovering", e.serial, h)
+	}
+	err := e.recover(h)
+	if err != nil {
+		logger.LogErrorf("checkEmulator: unable to recover %s: %v", e.serial, err)
+	}
+}
+
+func (h health) String() string {
+	switch h {
+	case healthy:
+		return "healthy"
+	case appDown:
+		return "app not running"
+	default:
+		return "emulator offline"
+	}
+}
+
+// Check that the emulator is reachable through adb and fully booted, and that the app is running on it
+func (e *emulator) checkHealth() health {
+	st, err := bridge.State(e.serial)
+	if err != nil || st != "device" {
+		return emulatorDown
+	}
+	out, err := e.shell("getprop sys.boot_completed")
+	if err != nil || strings.TrimSpace(out) != "1" {
+		return emulatorDown
+	}
+	out, err = e.shell("pidof " + appPackage)
+	if err != nil || strings.TrimSpace(out) == "" {
+		return appDown
+	}
+	return healthy
+}
+
+// Restart the emulator or relaunch the app, then re-read the app's token and re-estimate the emulator's clock offset.
+// Probes on the emulator are paused until it has recovered, and the emulator stays unavailable if any step fails, so
+// that the watchdog retries it
+func (e *emulator) recover(h health) error {
+	e.setAvailable(false)
+	if h == emulatorDown {
+		// The emulator may still be running but unresponsive, so it is killed before being restarted
+		e.kill()
+		err := e.start(e.shared)
+		if err != nil {
+			return err
+		}
+		err = e.waitForBoot()
+		if err != nil {
+			return err
+		}
+	}
+	// A healthy emulator is only finishing an earlier recovery, so its running app is not relaunched
+	if h != healthy {
+		err := e.startApp()
+		if err != nil {
+			return err
+		}
+	}
+	err := e.forwardReceipts()
+	if err != nil {
+		// Receipts are written to files until the port is forwarded again
+		logger.LogErrorf("recover: unable to forward receipts from %s: %v", e.serial, err)
+	}
+	tok, err := e.getToken()
+	if err != nil {
+		return err
+	}
+	// The emulator may have been restarted by this or an earlier recovery, in which case its earlier offsets no longer
+	// apply
+	e.resetClock()
+	err = e.syncClock()
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	e.token = tok
+	e.lock.Unlock()
+	e.resubscribe()
+	e.setAvailable(true)
+	return nil
+}
+
+// Subscribe the app to its topics again, since a restarted emulator or reinstalled app has lost its subscriptions.
+// Failures are logged, as they are when probing starts
+func (e *emulator) resubscribe() {
+	for _, topic := range e.topics {
+		_, _, err := e.subscribeTopic(topic)
+		if err != nil {
+			logger.LogErrorf("resubscribe: unable to subscribe %s to topic %s: %v", e.serial, topic, err)
+		}
+	}
+}
+
+func (e *emulator) waitForBoot() error {
+	err := e.adb("wait-for-device").Run()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < bootRetries; i++ {
+		out, err := e.shell("getprop sys.boot_completed")
+		if err == nil && strings.TrimSpace(out) == "1" {
+			return nil
+		}
+		time.Sleep(bootRetryInterval)
+	}
+	return errors.New("waitForBoot: timed out waiting for " + e.serial + " to boot")
+}
+
+// Mark the emulator as available to probes or not. Each period of unavailability is counted as an outage
+func (e *emulator) setAvailable(available bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.unavailable == !available {
+		return
+	}
+	e.unavailable = !available
+	if !available {
+		e.outages++
+	}
+}
+
+// Take the device offline for a COLLAPSE probe, unless the emulator is unavailable or another probe holds it offline.
+// Other probes on the emulator pause until it is released, and the period offline is counted as an outage, so that
+// messages delayed by it are not attributed to FCM. Returns whether the device is now held
+func (e *emulator) holdOffline() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.unavailable || e.offline {
+		return false
+	}
+	e.offline = true
+	e.outages++
+	return true
+}
+
+func (e *emulator) releaseOffline() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.offline = false
+}
+
+// Whether the emulator was made unavailable for recovery and has not yet recovered
+func (e *emulator) recovering() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.unavailable
+}
+
+func (e *emulator) isAvailable() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return !e.unavailable && !e.offline
+}
+
+// Whether the emulator is unavailable or offline, or has been since the probe was sent, in which case a missing or
+// unreadable receipt is not attributable to FCM
+func (e *emulator) disrupted(sp *sentProbe) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.unavailable || e.offline || e.outages != sp.outages
+}
+
+// Block until the emulator is available or probing stops. Returns whether the emulator is available
+func (e *emulator) waitAvailable() bool {
+	for !e.isAvailable() {
+		if !isProbing() {
+			return false
+		}
+		time.Sleep(unavailablePollInterval)
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package probe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/FirebaseExtended/fcm-external-prober/Controller/src/controller"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/fakefcm"
+	"github.com/FirebaseExtended/fcm-external-prober/Probe/src/utils"
+)
+
+func TestCheckHealth(t *testing.T) {
+	dev := fakefcm.NewDevice("DEVICE_TOKEN")
+	defer startFakeAdb(t, dev).Close()
+	e := newEmulator(0, "AVD")
+
+	if h := e.checkHealth(); h != healthy {
+		t.Logf("TestCheckHealth: running device reported as %s", h)
+		t.Fail()
+	}
+	dev.StopApp()
+	if h := e.checkHealth(); h != appDown {
+		t.Logf("TestCheckHealth: stopped app reported as %s", h)
+		t.Fail()
+	}
+	dev.Crash()
+	if h := e.checkHealth(); h != emulatorDown {
+		t.Logf("TestCheckHealth: crashed emulator reported as %s", h)
+		t.Fail()
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dev := fakefcm.NewDevice("DEVICE_TOKEN")
+	maker = dev
+	defer startFakeAdb(t, dev).Close()
+	clock = new(utils.ProbeClock)
+	metadata = &controller.MetadataConfig{TokenRetries: 1}
+	logger = new(fakeLogger)
+	e := newEmulator(0, "AVD")
+	e.token = "OLD_TOKEN"
+	// The restarted emulator's offset is far from the one estimated before it crashed
+	e.clocks = []*clockEstimate{{version: 1, offset: -3600000}}
+	dev.Crash()
+
+	err := e.recover(e.checkHealth())
+
+	if err != nil {
+		t.Logf("TestRecover: error recovering crashed emulator: %v", err)
+		t.FailNow()
+	}
+	if !dev.Running() || !e.isAvailable() {
+		t.Log("TestRecover: emulator not restarted or not made available")
+		t.Fail()
+	}
+	if e.registration() != "DEVICE_TOKEN" {
+		t.Logf("TestRecover: token not re-read: actual: %s, expected: DEVICE_TOKEN", e.registration())
+		t.Fail()
+	}
+	if e.outages != 1 {
+		t.Logf("TestRecover: incorrect number of outages: actual: %d, expected: 1", e.outages)
+		t.Fail()
+	}
+	if len(e.clocks) != 1 || e.clocks[0].version != 2 || e.clocks[0].drifted() {
+		t.Logf("TestRecover: clock estimated against offsets from before the restart: %+v", e.clocks)
+		t.Fail()
+	}
+}
+
+func TestRecoverResubscribe(t *testing.T) {
+	dev := fakefcm.NewDevice("DEVICE_TOKEN")
+	maker = dev
+	defer startFakeAdb(t, dev).Close()
+	clock = new(utils.ProbeClock)
+	logger = new(fakeLogger)
+	metadata = &controller.MetadataConfig{TokenRetries: 1}
+	e := newEmulator(0, "AVD")
+	p := newProbe(&controller.ProbeConfig{Type: controller.ProbeType_TOPIC, Topic: "TOPIC"}, e)
+	subscribeTopics([]*probe{p})
+	dev.Crash()
+
+	err := e.recover(e.checkHealth())
+
+	if err != nil {
+		t.Logf("TestRecoverResubscribe: error recovering crashed emulator: %v", err)
+		t.FailNow()
+	}
+	if !dev.Subscribed("TOPIC") {
+		t.Log("TestRecoverResubscribe: app not subscribed to its topic again after restart")
+		t.Fail()
+	}
+}
+
+func TestRecoverFailure(t *testing.T) {
+	maker = utils.NewFakeCommandMaker([]string{"INSTALL_FAILED"}, []bool{true}, true)
+	e := newTestEmulator()
+
+	err := e.recover(appDown)
+
+	if err == nil {
+		t.Log("TestRecoverFailure: no error when app could not be relaunched")
+		t.Fail()
+	}
+	if e.isAvailable() {
+		t.Log("TestRecoverFailure: emulator made available without recovering")
+		t.Fail()
+	}
+}
+
+func TestCheckEmulatorUnrecovered(t *testing.T) {
+	dev := fakefcm.NewDevice("DEVICE_TOKEN")
+	maker = dev
+	defer startFakeAdb(t, dev).Close()
+	clock = new(utils.ProbeClock)
+	logger = new(fakeLogger)
+	metadata = &controller.MetadataConfig{TokenRetries: 1}
+	e := newEmulator(0, "AVD")
+	// An earlier recovery relaunched the app but failed before the emulator was made available again
+	e.setAvailable(false)
+
+	checkEmulator(e)
+
+	if !e.isAvailable() {
+		t.Log("TestCheckEmulatorUnrecovered: healthy emulator left unavailable after a failed recovery")
+		t.Fail()
+	}
+	if e.registration() != "DEVICE_TOKEN" {
+		t.Logf("TestCheckEmulatorUnrecovered: token not re-read: actual: %s, expected: DEVICE_TOKEN", e.registration())
+		t.Fail()
+	}
+	if e.outages != 1 {
+		t.Logf("TestCheckEmulatorUnrecovered: incorrect number of outages: actual: %d, expected: 1", e.outages)
+		t.Fail()
+	}
+}
+
+func TestResolveProbeDeviceUnavailable(t *testing.T) {
+	testConfig := &controller.ProbeConfig{ReceiveTimeout: 2, Type: controller.ProbeType_UNSPECIFIED}
+	dev := newTestEmulator()
+	testSentProbe := newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev))
+	awaitProbe(testSentProbe)
+	// The emulator recovers after the probe is sent, before it times out
+	dev.setAvailable(false)
+	dev.setAvailable(true)
+	fl := new(fakeLogger)
+	logger = fl
+
+	expireProbes(time.Unix(10, 0))
+
+	if len(fl.testLogs) != 1 || fl.testLogs[0].state != "device_unavailable" {
+		t.Logf("TestResolveProbeDeviceUnavailable: timeout attributed to FCM: %v", fl.testLogs)
+		t.Fail()
+	}
+}
+
+func TestWaitAvailable(t *testing.T) {
+	e := newTestEmulator()
+	e.setAvailable(false)
+	probing = false
+
+	if e.waitAvailable() {
+		t.Log("TestWaitAvailable: unavailable emulator reported as available")
+		t.Fail()
+	}
+	e.setAvailable(true)
+	if !e.waitAvailable() {
+		t.Log("TestWaitAvailable: available emulator reported as unavailable")
+		t.Fail()
+	}
+}
+
+func TestHoldOffline(t *testing.T) {
+	testConfig := &controller.ProbeConfig{ReceiveTimeout: 2, Type: controller.ProbeType_UNSPECIFIED}
+	dev := newTestEmulator()
+	testSentProbe := newSentProbe(time.Unix(1, 0), newProbe(testConfig, dev))
+	awaitProbe(testSentProbe)
+
+	if !dev.holdOffline() {
+		t.Log("TestHoldOffline: available emulator not taken offline")
+		t.FailNow()
+	}
+	if dev.isAvailable() {
+		t.Log("TestHoldOffline: emulator available to other probes while offline")
+		t.Fail()
+	}
+	if dev.holdOffline() {
+		t.Log("TestHoldOffline: emulator taken offline by two probes at once")
+		t.Fail()
+	}
+	dev.releaseOffline()
+	if !dev.isAvailable() {
+		t.Log("TestHoldOffline: emulator not available once released")
+		t.Fail()
+	}
+	fl := new(fakeLogger)
+	logger = fl
+
+	expireProbes(time.Unix(10, 0))
+
+	if len(fl.testLogs) != 1 || fl.testLogs[0].state != "device_unavailable" {
+		t.Logf("TestHoldOffline: timeout while offline attributed to FCM: %v", fl.testLogs)
+		t.Fail()
+	}
+}
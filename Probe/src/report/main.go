@@ -0,0 +1,260 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+/*
+Command report summarizes probe logs by payload size, showing the availability and latency of messages of each size,
+and by probe, showing how often each probe's messages arrived out of order or after gaps.
+Logs are read from the files given as arguments, or from stdin if there are none. Either the JSON lines written with
+-log=stdout or the output of "gcloud logging read --format=json" may be read.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// Fields of a probe log used in the report
+type record struct {
+	State       string `json:"state"`
+	Latency     int    `json:"latency"`
+	PayloadSize int    `json:"payloadSize"`
+	Probe       int    `json:"probe"`
+	Reorder     int    `json:"reorder"`
+	Gap         int    `json:"gap"`
+}
+
+// Cloud Logging entry, in which the probe log is the JSON payload
+type entry struct {
+	JsonPayload json.RawMessage `json:"jsonPayload"`
+}
+
+// Results of messages of a single payload size
+type bucket struct {
+	size      int
+	sent      int
+	resolved  int
+	timeout   int
+	errors    int
+	oversize  int
+	late      int // Messages delivered after their timeouts were logged, which are also counted as timeouts
+	duplicate int // Repeated deliveries of messages, which are not counted as sent
+	latencies []int
+}
+
+// Order of arrival of a single probe's messages
+type ordering struct {
+	probe      int
+	arrived    int // Messages that arrived for the first time, on time or late
+	reordered  int // Messages that arrived after a later message of the probe
+	maxReorder int
+	gaps       int // Arrivals that skipped earlier messages of the probe
+	skipped    int // Messages skipped by arrivals, some of which may have arrived later
+}
+
+func main() {
+	var in []byte
+	var err error
+	if len(os.Args) < 2 {
+		in, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		for _, f := range os.Args[1:] {
+			var b []byte
+			b, err = ioutil.ReadFile(f)
+			if err != nil {
+				break
+			}
+			in = append(in, b...)
+			in = append(in, '\n')
+		}
+	}
+	if err != nil {
+		log.Fatalf("Main: unable to read logs: %v", err)
+	}
+	recs, err := parseRecords(in)
+	if err != nil {
+		log.Fatalf("Main: unable to parse logs: %v", err)
+	}
+	writeReport(os.Stdout, summarize(recs))
+	fmt.Println()
+	writeOrderReport(os.Stdout, summarizeOrder(recs))
+}
+
+// Parse probe logs from JSON lines, or from a JSON array of Cloud Logging entries
+func parseRecords(in []byte) ([]*record, error) {
+	var raw []json.RawMessage
+	in = bytes.TrimSpace(in)
+	if bytes.HasPrefix(in, []byte("[")) {
+		err := json.Unmarshal(in, &raw)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(in))
+		for {
+			var r json.RawMessage
+			err := dec.Decode(&r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			raw = append(raw, r)
+		}
+	}
+
+	var ret []*record
+	for _, r := range raw {
+		e := new(entry)
+		err := json.Unmarshal(r, e)
+		if err != nil {
+			return nil, err
+		}
+		if e.JsonPayload != nil {
+			r = e.JsonPayload
+		}
+		rec := new(record)
+		err = json.Unmarshal(r, rec)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, rec)
+	}
+	return ret, nil
+}
+
+// Group results of sent messages by payload size, in order of size. Late and duplicate deliveries are counted
+// separately from the messages sent. Other logs that are not results of sent messages, such as error logs and topic
+// subscriptions, are ignored
+func summarize(recs []*record) []*bucket {
+	buckets := make(map[int]*bucket)
+	for _, r := range recs {
+		b, ok := buckets[r.PayloadSize]
+		if !ok {
+			b = &bucket{size: r.PayloadSize}
+		}
+		switch r.State {
+		case "resolved":
+			b.resolved++
+			b.latencies = append(b.latencies, r.Latency)
+		case "timeout":
+			b.timeout++
+		case "error", "send_error":
+			b.errors++
+		case "oversize":
+			b.oversize++
+		case "late":
+			b.late++
+		case "duplicate":
+			b.duplicate++
+		default:
+			continue
+		}
+		if r.State != "late" && r.State != "duplicate" {
+			b.sent++
+		}
+		buckets[r.PayloadSize] = b
+	}
+
+	var ret []*bucket
+	for _, b := range buckets {
+		sort.Ints(b.latencies)
+		ret = append(ret, b)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].size < ret[j].size })
+	return ret
+}
+
+// Fraction of messages resolved, excluding those rejected as oversize, which are reported separately
+func (b *bucket) availability() float64 {
+	if b.sent == b.oversize {
+		return 0
+	}
+	return float64(b.resolved) / float64(b.sent-b.oversize)
+}
+
+// Latency at percentile p of resolved messages, or -1 if none were resolved
+func (b *bucket) percentile(p int) int {
+	if len(b.latencies) == 0 {
+		return -1
+	}
+	return b.latencies[(len(b.latencies)-1)*p/100]
+}
+
+// Group the order of arrival of messages by probe, in order of probe. Only the first arrival of each message is placed
+// in its probe's order, so other logs are ignored
+func summarizeOrder(recs []*record) []*ordering {
+	orders := make(map[int]*ordering)
+	for _, r := range recs {
+		if r.State != "resolved" && r.State != "late" {
+			continue
+		}
+		o, ok := orders[r.Probe]
+		if !ok {
+			o = &ordering{probe: r.Probe}
+			orders[r.Probe] = o
+		}
+		o.arrived++
+		if r.Reorder > 0 {
+			o.reordered++
+			if r.Reorder > o.maxReorder {
+				o.maxReorder = r.Reorder
+			}
+		}
+		if r.Gap > 0 {
+			o.gaps++
+			o.skipped += r.Gap
+		}
+	}
+
+	var ret []*ordering
+	for _, o := range orders {
+		ret = append(ret, o)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].probe < ret[j].probe })
+	return ret
+}
+
+func writeReport(w io.Writer, buckets []*bucket) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tSENT\tAVAILABILITY\tP50\tP95\tP99\tTIMEOUT\tLATE\tDUPLICATE\tERROR\tOVERSIZE")
+	for _, b := range buckets {
+		size := fmt.Sprintf("%d", b.size)
+		if b.size == 0 {
+			size = "unpadded"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.2f%%\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", size, b.sent, 100*b.availability(),
+			b.percentile(50), b.percentile(95), b.percentile(99), b.timeout, b.late, b.duplicate, b.errors, b.oversize)
+	}
+	tw.Flush()
+}
+
+func writeOrderReport(w io.Writer, orders []*ordering) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROBE\tARRIVED\tREORDERED\tMAX REORDER\tGAPS\tSKIPPED")
+	for _, o := range orders {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t%d\n", o.probe, o.arrived, o.reordered, o.maxReorder, o.gaps, o.skipped)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,141 @@
+/*
+ *  Copyright 2020 Google LLC
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      https://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseRecordsLines(t *testing.T) {
+	in := `{"state":"resolved","latency":10,"payloadSize":100}
+{"state":"oversize","latency":-1,"payloadSize":5000}`
+
+	recs, err := parseRecords([]byte(in))
+
+	if err != nil {
+		t.Logf("TestParseRecordsLines: error on valid input: %v", err)
+		t.FailNow()
+	}
+	if len(recs) != 2 || recs[0].PayloadSize != 100 || recs[1].State != "oversize" {
+		t.Logf("TestParseRecordsLines: records incorrectly parsed: %+v", recs)
+		t.Fail()
+	}
+}
+
+func TestParseRecordsCloudLogging(t *testing.T) {
+	in := `[{"jsonPayload":{"state":"resolved","latency":10,"payloadSize":100},"severity":"DEFAULT"}]`
+
+	recs, err := parseRecords([]byte(in))
+
+	if err != nil {
+		t.Logf("TestParseRecordsCloudLogging: error on valid input: %v", err)
+		t.FailNow()
+	}
+	if len(recs) != 1 || recs[0].Latency != 10 || recs[0].PayloadSize != 100 {
+		t.Logf("TestParseRecordsCloudLogging: records incorrectly parsed: %+v", recs)
+		t.Fail()
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	recs := []*record{
+		{State: "resolved", Latency: 30, PayloadSize: 1000}, {State: "resolved", Latency: 10, PayloadSize: 1000},
+		{State: "timeout", Latency: -1, PayloadSize: 1000}, {State: "send_error", Latency: -1, PayloadSize: 1000},
+		{State: "oversize", Latency: -1, PayloadSize: 5000}, {State: "resolved", Latency: 5},
+		{State: "subscribed", Latency: 100},
+	}
+
+	buckets := summarize(recs)
+
+	if len(buckets) != 3 || buckets[0].size != 0 || buckets[1].size != 1000 || buckets[2].size != 5000 {
+		t.Logf("TestSummarize: incorrect buckets: %+v", buckets)
+		t.FailNow()
+	}
+	b := buckets[1]
+	if b.sent != 4 || b.resolved != 2 || b.timeout != 1 || b.errors != 1 || b.availability() != 0.5 {
+		t.Logf("TestSummarize: incorrect bucket: %+v", b)
+		t.Fail()
+	}
+	if b.percentile(50) != 10 || b.percentile(99) != 10 || buckets[2].percentile(50) != -1 {
+		t.Log("TestSummarize: incorrect latency percentiles")
+		t.Fail()
+	}
+	if buckets[0].sent != 1 {
+		t.Log("TestSummarize: logs other than message results counted")
+		t.Fail()
+	}
+	if buckets[2].oversize != 1 || buckets[2].availability() != 0 {
+		t.Logf("TestSummarize: oversize rejections incorrectly counted: %+v", buckets[2])
+		t.Fail()
+	}
+}
+
+func TestSummarizeLateAndDuplicate(t *testing.T) {
+	recs := []*record{
+		{State: "timeout", Latency: -1}, {State: "late", Latency: 12000}, {State: "resolved", Latency: 10},
+		{State: "duplicate", Latency: 20},
+	}
+
+	buckets := summarize(recs)
+
+	if len(buckets) != 1 {
+		t.Logf("TestSummarizeLateAndDuplicate: incorrect buckets: %+v", buckets)
+		t.FailNow()
+	}
+	b := buckets[0]
+	if b.sent != 2 || b.late != 1 || b.duplicate != 1 || b.availability() != 0.5 {
+		t.Logf("TestSummarizeLateAndDuplicate: incorrect bucket: %+v", b)
+		t.Fail()
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	var out bytes.Buffer
+
+	writeReport(&out, []*bucket{{size: 1000, sent: 2, resolved: 1, timeout: 1, latencies: []int{10}}})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "1000") || !strings.Contains(lines[1], "50.00%") {
+		t.Logf("TestWriteReport: incorrect report: %s", out.String())
+		t.Fail()
+	}
+}
+
+func TestSummarizeOrder(t *testing.T) {
+	recs := []*record{
+		{State: "resolved", Probe: 0}, {State: "resolved", Probe: 0, Gap: 2}, {State: "late", Probe: 0, Reorder: 1},
+		{State: "duplicate", Probe: 0, Reorder: 3}, {State: "timeout", Probe: 1}, {State: "resolved", Probe: 1, Reorder: 2},
+	}
+
+	orders := summarizeOrder(recs)
+
+	if len(orders) != 2 || orders[0].probe != 0 || orders[1].probe != 1 {
+		t.Logf("TestSummarizeOrder: incorrect probes: %+v", orders)
+		t.FailNow()
+	}
+	o := orders[0]
+	if o.arrived != 3 || o.reordered != 1 || o.maxReorder != 1 || o.gaps != 1 || o.skipped != 2 {
+		t.Logf("TestSummarizeOrder: incorrect ordering: %+v", o)
+		t.Fail()
+	}
+	if orders[1].arrived != 1 || orders[1].maxReorder != 2 {
+		t.Logf("TestSummarizeOrder: incorrect ordering: %+v", orders[1])
+		t.Fail()
+	}
+}
@@ -20,6 +20,7 @@ import "time"
 
 type Timer interface {
 	Now() time.Time
+	Sleep(d time.Duration)
 }
 
 type ProbeClock struct{}
@@ -27,3 +28,7 @@ type ProbeClock struct{}
 func (p *ProbeClock) Now() time.Time {
 	return time.Now()
 }
+
+func (p *ProbeClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
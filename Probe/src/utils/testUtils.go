@@ -83,10 +83,11 @@ type FakeClock struct {
 	times  []time.Time
 	index  int
 	repeat bool
+	slept  time.Duration
 }
 
 func NewFakeClock(times []time.Time, repeat bool) *FakeClock {
-	return &FakeClock{times, 0, repeat}
+	return &FakeClock{times: times, repeat: repeat}
 }
 
 func (t *FakeClock) Now() time.Time {
@@ -103,14 +104,24 @@ func (t *FakeClock) TimesCalled() int {
 	return t.index
 }
 
+// Returns immediately, adding d to the total time slept
+func (t *FakeClock) Sleep(d time.Duration) {
+	t.slept += d
+}
+
+func (t *FakeClock) Slept() time.Duration {
+	return t.slept
+}
+
 type FakeBoolClock struct {
 	times    []time.Time
 	index    int
 	toChange *bool
+	slept    time.Duration
 }
 
 func NewFakeBoolClock(times []time.Time, toChange *bool) *FakeBoolClock {
-	return &FakeBoolClock{times, 0, toChange}
+	return &FakeBoolClock{times: times, toChange: toChange}
 }
 
 func (f *FakeBoolClock) Now() time.Time {
@@ -125,3 +136,12 @@ func (f *FakeBoolClock) Now() time.Time {
 func (f *FakeBoolClock) TimesCalled() int {
 	return f.index
 }
+
+// Returns immediately, adding d to the total time slept
+func (f *FakeBoolClock) Sleep(d time.Duration) {
+	f.slept += d
+}
+
+func (f *FakeBoolClock) Slept() time.Duration {
+	return f.slept
+}